@@ -0,0 +1,1101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+
+	"github.com/brian14708/wg-gatekeeper/auditlog"
+	"github.com/brian14708/wg-gatekeeper/models"
+	"github.com/brian14708/wg-gatekeeper/openapi"
+)
+
+const apiPrefix = "/api/v1"
+
+// apiError is returned as JSON by all API endpoints on failure.
+type apiError struct {
+	status  int
+	Message string            `json:"error"`
+	Fields  map[string]string `json:"fields,omitempty" doc:"validation errors by field name"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, msg string) *apiError {
+	return &apiError{status: status, Message: msg}
+}
+
+// validation collects the validation errors of a request.
+type validation map[string]string
+
+func (v validation) check(ok bool, field, format string, args ...any) {
+	if !ok && v[field] == "" {
+		v[field] = fmt.Sprintf(format, args...)
+	}
+}
+
+// requestAPIError returns the API error of an error of a change shared with
+// the web UI. Other errors are server errors and returned as they are.
+func requestAPIError(err error) error {
+	var re *requestError
+	if !errors.As(err, &re) {
+		return err
+	}
+	if re.conflict {
+		return newAPIError(http.StatusConflict, re.msg)
+	}
+	return newAPIError(http.StatusUnprocessableEntity, re.msg)
+}
+
+func (v validation) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return &apiError{status: http.StatusUnprocessableEntity, Message: "validation failed", Fields: v}
+}
+
+// errorHandler responds with JSON errors for the API and the default error
+// pages otherwise.
+func errorHandler(c *fiber.Ctx, err error) error {
+	if !strings.HasPrefix(c.Path(), "/api/") {
+		return fiber.DefaultErrorHandler(c, err)
+	}
+
+	var ae *apiError
+	var fe *fiber.Error
+	switch {
+	case errors.As(err, &ae):
+	case errors.As(err, &fe):
+		ae = newAPIError(fe.Code, fe.Message)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		ae = newAPIError(http.StatusNotFound, "not found")
+	default:
+		log.Printf("api: %s %s: %v", c.Method(), c.Path(), err)
+		ae = newAPIError(http.StatusInternalServerError, "internal server error")
+	}
+	return c.Status(ae.status).JSON(ae)
+}
+
+// apiAuth authenticates API requests with a bearer token and grants the
+// role of the token.
+func apiAuth(c *fiber.Ctx) error {
+	auth := c.Get(fiber.HeaderAuthorization)
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || token == "" {
+		return newAPIError(http.StatusUnauthorized, "missing bearer token")
+	}
+	tok, err := lookupToken(token)
+	if err != nil {
+		return newAPIError(http.StatusUnauthorized, "invalid token")
+	}
+
+	c.Locals("user", &models.User{Username: "token:" + tok.Name, Role: tok.Role})
+	return c.Next()
+}
+
+// lookupToken returns the API token and records its use.
+func lookupToken(token string) (*models.APIToken, error) {
+	hash := sha256.Sum256([]byte(token))
+	var tok models.APIToken
+	if ret := models.DB.Where("token_hash = ?", hash[:]).First(&tok); ret.Error != nil {
+		return nil, ret.Error
+	}
+	models.DB.Model(&tok).Update("last_used_at", time.Now())
+	return &tok, nil
+}
+
+// decode parses the JSON request body into v, rejecting unknown fields.
+func decode(c *fiber.Ctx, v any) error {
+	d := json.NewDecoder(bytes.NewReader(c.Body()))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid request body: "+err.Error())
+	}
+	return nil
+}
+
+type apiRoute struct {
+	openapi.Route
+	Role    models.Role
+	Handler fiber.Handler
+}
+
+// apiHandler registers the API routes, auth authenticates the requests.
+func apiHandler(app *fiber.App, auth fiber.Handler) {
+	spec := openapi.New("Gatekeeper", "v1")
+	spec.TypeName = func(t reflect.Type) string {
+		name := strings.TrimPrefix(t.Name(), "api")
+		return strings.ToUpper(name[:1]) + name[1:]
+	}
+	api := app.Group(apiPrefix)
+	api.Get("/openapi.json", func(c *fiber.Ctx) error {
+		return c.JSON(spec)
+	})
+	api.Use(auth)
+
+	for _, r := range apiRoutes {
+		r.Route.Summary += " (requires " + string(r.Role) + ")"
+		spec.Add(apiPrefix, r.Route, apiError{})
+		api.Add(r.Method, r.Path, requireRole(r.Role), r.Handler)
+	}
+}
+
+var apiRoutes = []apiRoute{
+	{
+		Route: openapi.Route{Method: "GET", Path: "/interfaces", Summary: "List interfaces", Tags: []string{"interfaces"},
+			Response: []apiInterface{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			var ifaces []models.Interface
+			if ret := models.DB.Order("id").Find(&ifaces); ret.Error != nil {
+				return ret.Error
+			}
+			result := []apiInterface{}
+			for _, iface := range ifaces {
+				result = append(result, toAPIInterface(iface))
+			}
+			return c.JSON(result)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "POST", Path: "/interfaces", Summary: "Create interface", Tags: []string{"interfaces"},
+			Request: apiInterfaceRequest{}, Response: apiInterface{}, Status: http.StatusCreated},
+		Role: models.RoleAdmin,
+		Handler: func(c *fiber.Ctx) error {
+			var req apiInterfaceRequest
+			if err := decode(c, &req); err != nil {
+				return err
+			}
+			iface := models.Interface{Name: req.Name}
+			if err := req.apply(&iface); err != nil {
+				return err
+			}
+			recordEvent(actor(c), "create", nil, interfaceSnapshot(iface))
+			return c.Status(http.StatusCreated).JSON(toAPIInterface(iface))
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/interfaces/:id", Summary: "Get interface", Tags: []string{"interfaces"},
+			Response: apiInterface{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			var iface models.Interface
+			if ret := models.DB.First(&iface, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			return c.JSON(toAPIInterface(iface))
+		},
+	},
+	{
+		Route: openapi.Route{Method: "PUT", Path: "/interfaces/:id", Summary: "Update interface", Tags: []string{"interfaces"},
+			Request: apiInterfaceRequest{}, Response: apiInterface{}},
+		Role: models.RoleAdmin,
+		Handler: func(c *fiber.Ctx) error {
+			var iface models.Interface
+			if ret := models.DB.First(&iface, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			var req apiInterfaceRequest
+			if err := decode(c, &req); err != nil {
+				return err
+			}
+			if req.Name != iface.Name {
+				return validation{"name": "cannot be changed"}.err()
+			}
+			before := interfaceSnapshot(iface)
+			if err := req.apply(&iface); err != nil {
+				return err
+			}
+			recordEvent(actor(c), "update", before, interfaceSnapshot(iface))
+			return c.JSON(toAPIInterface(iface))
+		},
+	},
+	{
+		Route: openapi.Route{Method: "DELETE", Path: "/interfaces/:id", Summary: "Delete interface", Tags: []string{"interfaces"}},
+		Role:  models.RoleAdmin,
+		Handler: func(c *fiber.Ctx) error {
+			var iface models.Interface
+			if ret := models.DB.First(&iface, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			if ret := models.DB.Delete(&iface); ret.Error != nil {
+				return ret.Error
+			}
+			recordEvent(actor(c), "delete", interfaceSnapshot(iface), nil)
+			syncers.DeleteInterface(iface.ID)
+			return c.SendStatus(http.StatusNoContent)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/accounts", Summary: "List accounts", Tags: []string{"accounts"},
+			Query: []*openapi.Parameter{{Name: "interface", In: "query", Description: "only list accounts of this interface",
+				Schema: &openapi.Schema{Type: "integer"}}},
+			Response: []apiAccount{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			var accs []models.Account
+			q := models.DB.Order("id")
+			if id := c.QueryInt("interface"); id != 0 {
+				q = q.Where("interface_id = ?", id)
+			}
+			if ret := q.Find(&accs); ret.Error != nil {
+				return ret.Error
+			}
+			result := []apiAccount{}
+			for _, acc := range accs {
+				result = append(result, toAPIAccount(acc))
+			}
+			return c.JSON(result)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "POST", Path: "/accounts", Summary: "Create account", Tags: []string{"accounts"},
+			Request: apiAccountRequest{}, Response: apiAccount{}, Status: http.StatusCreated},
+		Role: models.RoleOperator,
+		Handler: func(c *fiber.Ctx) error {
+			var req apiAccountRequest
+			if err := decode(c, &req); err != nil {
+				return err
+			}
+			v := validation{}
+			v.check(req.Name != "", "name", "must not be empty")
+			var iface models.Interface
+			v.check(models.DB.First(&iface, req.InterfaceID).Error == nil, "interface_id", "interface %d does not exist", req.InterfaceID)
+			req.validate(v)
+			if err := v.err(); err != nil {
+				return err
+			}
+
+			acc := models.Account{Name: req.Name, InterfaceID: iface.ID}
+			req.apply(&acc)
+			if ret := models.DB.Create(&acc); ret.Error != nil {
+				return ret.Error
+			}
+			recordEvent(actor(c), "create", nil, accountSnapshot(acc))
+			return c.Status(http.StatusCreated).JSON(toAPIAccount(acc))
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/accounts/:id", Summary: "Get account with its clients", Tags: []string{"accounts"},
+			Response: apiAccount{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			var acc models.Account
+			if ret := models.DB.Preload("Clients").First(&acc, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			return c.JSON(toAPIAccount(acc))
+		},
+	},
+	{
+		Route: openapi.Route{Method: "PUT", Path: "/accounts/:id", Summary: "Update account limits", Tags: []string{"accounts"},
+			Request: apiAccountLimits{}, Response: apiAccount{}},
+		Role: models.RoleOperator,
+		Handler: func(c *fiber.Ctx) error {
+			var acc models.Account
+			if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			var req apiAccountLimits
+			if err := decode(c, &req); err != nil {
+				return err
+			}
+			v := validation{}
+			req.validate(v)
+			if err := v.err(); err != nil {
+				return err
+			}
+
+			before := accountSnapshot(acc)
+			req.apply(&acc)
+			if ret := models.DB.Save(&acc); ret.Error != nil {
+				return ret.Error
+			}
+			recordEvent(actor(c), "update", before, accountSnapshot(acc))
+			syncers.UpdateAccounts(acc.InterfaceID)
+			return c.JSON(toAPIAccount(acc))
+		},
+	},
+	{
+		Route: openapi.Route{Method: "DELETE", Path: "/accounts/:id", Summary: "Delete account", Tags: []string{"accounts"}},
+		Role:  models.RoleOperator,
+		Handler: func(c *fiber.Ctx) error {
+			var acc models.Account
+			if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			if ret := models.DB.Delete(&acc); ret.Error != nil {
+				return ret.Error
+			}
+			recordEvent(actor(c), "delete", accountSnapshot(acc), nil)
+			syncers.UpdateAccounts(acc.InterfaceID)
+			return c.SendStatus(http.StatusNoContent)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/accounts/:id/usage", Summary: "Get traffic totals of an account", Tags: []string{"usage"},
+			Response: apiUsage{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			var acc models.Account
+			if ret := models.DB.Preload("Clients").First(&acc, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			u := apiUsage{BytesIn: acc.BytesIn, BytesOut: acc.BytesOut}
+			if auditDB != nil {
+				var err error
+				u.AuditEnabled = true
+				u.TCPSent, u.TCPRecv, err = auditDB.Total(accountIPs(acc))
+				if err != nil {
+					return err
+				}
+			}
+			return c.JSON(u)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/accounts/:id/clients/status", Summary: "Get the wireguard peer status of the clients of an account", Tags: []string{"clients"},
+			Response: []apiClientStatus{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			var acc models.Account
+			if ret := models.DB.Preload("Clients").First(&acc, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			return c.JSON(clientStatusList(acc))
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/accounts/:id/usage/series", Summary: "Get the traffic of an account over time", Tags: []string{"usage"},
+			Query: []*openapi.Parameter{
+				{Name: "range", In: "query", Description: "day (5 minute buckets), week (hourly) or month (daily), defaults to day",
+					Schema: &openapi.Schema{Type: "string"}},
+			},
+			Response: []apiUsagePoint{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			var acc models.Account
+			if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			points, err := usageSeries(acc.ID, 0, c.Query("range", "day"))
+			if err != nil {
+				return validation{"range": err.Error()}.err()
+			}
+			result := []apiUsagePoint{}
+			for _, p := range points {
+				result = append(result, apiUsagePoint(p))
+			}
+			return c.JSON(result)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/accounts/:id/audit", Summary: "Query TCP destinations of an account", Tags: []string{"usage"},
+			Query: []*openapi.Parameter{
+				{Name: "since", In: "query", Description: "start of the time range, defaults to 2 hours ago",
+					Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+				{Name: "limit", In: "query", Description: "maximum number of destinations, defaults to 100",
+					Schema: &openapi.Schema{Type: "integer"}},
+			},
+			Response: []apiAccessLog{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			if auditDB == nil {
+				return newAPIError(http.StatusNotFound, "audit log is not enabled")
+			}
+			var acc models.Account
+			if ret := models.DB.Preload("Clients").First(&acc, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+
+			v := validation{}
+			since := time.Now().Add(-2 * time.Hour)
+			if s := c.Query("since"); s != "" {
+				t, err := time.Parse(time.RFC3339, s)
+				v.check(err == nil, "since", "must be a RFC 3339 timestamp")
+				since = t
+			}
+			limit := c.QueryInt("limit", 100)
+			v.check(limit > 0 && limit <= 10000, "limit", "must be between 1 and 10000")
+			if err := v.err(); err != nil {
+				return err
+			}
+
+			logs, err := auditDB.Query(accountIPs(acc), since.UTC(), limit)
+			if err != nil {
+				return err
+			}
+			result := []apiAccessLog{}
+			for _, l := range logs {
+				result = append(result, apiAccessLog{ServerName: l.ServerName, Sent: l.Sent, Recv: l.Recv})
+			}
+			return c.JSON(result)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/audit", Summary: "Search and aggregate the audit log", Tags: []string{"usage"},
+			Query: []*openapi.Parameter{
+				{Name: "account", In: "query", Description: "only connections of the clients of this account",
+					Schema: &openapi.Schema{Type: "integer"}},
+				{Name: "client", In: "query", Description: "only connections of this client",
+					Schema: &openapi.Schema{Type: "integer"}},
+				{Name: "from", In: "query", Description: "start of the time range",
+					Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+				{Name: "to", In: "query", Description: "end of the time range, exclusive",
+					Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+				{Name: "protocol", In: "query", Description: "tcp, http or tls, may be repeated",
+					Schema: &openapi.Schema{Type: "string"}},
+				{Name: "destination", In: "query", Description: "only destinations containing this, ignoring case",
+					Schema: &openapi.Schema{Type: "string"}},
+				{Name: "suffix", In: "query", Description: "only destinations ending with this",
+					Schema: &openapi.Schema{Type: "string"}},
+				{Name: "port", In: "query", Description: "only connections to this port, searches the recent log only",
+					Schema: &openapi.Schema{Type: "integer"}},
+				{Name: "group", In: "query", Description: "destination, client, hour or day, lists connections if empty",
+					Schema: &openapi.Schema{Type: "string"}},
+				{Name: "sort", In: "query", Description: "recv, sent, connections or group, defaults to recv for groups and time for connections",
+					Schema: &openapi.Schema{Type: "string"}},
+				{Name: "order", In: "query", Description: "asc or desc, defaults to desc",
+					Schema: &openapi.Schema{Type: "string"}},
+				{Name: "limit", In: "query", Description: "maximum number of rows, defaults to 100",
+					Schema: &openapi.Schema{Type: "integer"}},
+				{Name: "cursor", In: "query", Description: "next_cursor of the previous page",
+					Schema: &openapi.Schema{Type: "string"}},
+			},
+			Response: apiAuditSearch{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			if auditDB == nil {
+				return newAPIError(http.StatusNotFound, "audit log is not enabled")
+			}
+			s, ok, err := auditSearch(c)
+			if err != nil {
+				return err
+			}
+			result := apiAuditSearch{Rows: []apiAuditRow{}}
+			if !ok {
+				return c.JSON(result)
+			}
+			r, err := auditDB.Search(s)
+			if errors.Is(err, auditlog.ErrInvalidCursor) {
+				return validation{"cursor": "is invalid"}.err()
+			} else if err != nil {
+				return err
+			}
+			clients, err := auditClients()
+			if err != nil {
+				return err
+			}
+			for _, row := range r.Rows {
+				result.Rows = append(result.Rows, toAPIAuditRow(row, clients))
+			}
+			result.NextCursor = r.NextCursor
+			return c.JSON(result)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/audit/export", Summary: "Export the connections of the audit log as CSV or Parquet", Tags: []string{"usage"},
+			Query: []*openapi.Parameter{
+				{Name: "account", In: "query", Description: "only connections of the clients of this account",
+					Schema: &openapi.Schema{Type: "integer"}},
+				{Name: "client", In: "query", Description: "only connections of this client",
+					Schema: &openapi.Schema{Type: "integer"}},
+				{Name: "from", In: "query", Description: "start of the time range",
+					Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+				{Name: "to", In: "query", Description: "end of the time range, exclusive",
+					Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+				{Name: "format", In: "query", Description: "csv or parquet, defaults to csv",
+					Schema: &openapi.Schema{Type: "string"}},
+			},
+			Response: []byte{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			if auditDB == nil {
+				return newAPIError(http.StatusNotFound, "audit log is not enabled")
+			}
+			e, err := auditExport(c)
+			if err != nil {
+				return err
+			}
+			return sendAuditExport(c, e)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/accounts/:id/clients", Summary: "List clients of an account", Tags: []string{"clients"},
+			Response: []apiClient{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			var acc models.Account
+			if ret := models.DB.Preload("Clients").First(&acc, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			return c.JSON(toAPIAccount(acc).Clients)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "POST", Path: "/accounts/:id/clients", Summary: "Create client", Tags: []string{"clients"},
+			Request: apiClientRequest{}, Response: apiClientConfig{}, Status: http.StatusCreated},
+		Role: models.RoleOperator,
+		Handler: func(c *fiber.Ctx) error {
+			var acc models.Account
+			if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+				return ret.Error
+			}
+			var req apiClientRequest
+			if err := decode(c, &req); err != nil {
+				return err
+			}
+			v := validation{}
+			v.check(req.Name != "", "name", "must not be empty")
+			v.check(req.PersistentKeepalive >= 0 && req.PersistentKeepalive <= 65535, "persistent_keepalive", "must be between 0 and 65535")
+			if req.PublicKey != "" {
+				_, err := wgtypes.ParseKey(req.PublicKey)
+				v.check(err == nil, "public_key", "invalid key")
+			}
+			if err := v.err(); err != nil {
+				return err
+			}
+
+			psk := req.PresharedKey == nil || *req.PresharedKey
+			cli, iface, privateKey, err := newClient(acc, req.Name, req.PublicKey, req.PersistentKeepalive, psk, req.IPAddress)
+			if err != nil {
+				return requestAPIError(err)
+			}
+			recordEvent(actor(c), "create", nil, clientSnapshot(cli))
+			resp, err := toAPIClientConfig(iface, cli, privateKey)
+			if err != nil {
+				return err
+			}
+			return c.Status(http.StatusCreated).JSON(resp)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/accounts/:id/clients/:cid", Summary: "Get client with its configuration", Tags: []string{"clients"},
+			Response: apiClientConfig{}},
+		Role: models.RoleOperator,
+		Handler: func(c *fiber.Ctx) error {
+			acc, cli, err := apiLoadClient(c)
+			if err != nil {
+				return err
+			}
+			privateKey, err := openPrivateKey(cli)
+			if err != nil {
+				return err
+			}
+			var iface models.Interface
+			if ret := models.DB.First(&iface, acc.InterfaceID); ret.Error != nil {
+				return ret.Error
+			}
+			resp, err := toAPIClientConfig(iface, cli, privateKey)
+			if err != nil {
+				return err
+			}
+			return c.JSON(resp)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/accounts/:id/clients/:cid/config", Summary: "Download client configuration", Tags: []string{"clients"},
+			Response: ""},
+		Role: models.RoleOperator,
+		Handler: func(c *fiber.Ctx) error {
+			acc, cli, err := apiLoadClient(c)
+			if err != nil {
+				return err
+			}
+			privateKey, err := openPrivateKey(cli)
+			if err != nil {
+				return err
+			}
+			var iface models.Interface
+			if ret := models.DB.First(&iface, acc.InterfaceID); ret.Error != nil {
+				return ret.Error
+			}
+			config, err := clientConfig(iface, cli, privateKey)
+			if err != nil {
+				return err
+			}
+			return c.SendString(config)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "POST", Path: "/accounts/:id/clients/:cid/key", Summary: "Rotate client key", Tags: []string{"clients"},
+			Request: apiClientKeyRequest{}, Response: apiClientConfig{}},
+		Role: models.RoleOperator,
+		Handler: func(c *fiber.Ctx) error {
+			acc, cli, err := apiLoadClient(c)
+			if err != nil {
+				return err
+			}
+			var req apiClientKeyRequest
+			if err := decode(c, &req); err != nil {
+				return err
+			}
+			if req.PublicKey != "" {
+				if _, err := wgtypes.ParseKey(req.PublicKey); err != nil {
+					return validation{"public_key": "invalid key"}.err()
+				}
+			}
+
+			before := clientSnapshot(cli)
+			iface, privateKey, err := rotateClientKey(acc, &cli, req.PublicKey)
+			if err != nil {
+				return requestAPIError(err)
+			}
+			recordEvent(actor(c), "rotate_key", before, clientSnapshot(cli))
+			resp, err := toAPIClientConfig(iface, cli, privateKey)
+			if err != nil {
+				return err
+			}
+			return c.JSON(resp)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "DELETE", Path: "/accounts/:id/clients/:cid", Summary: "Delete client", Tags: []string{"clients"}},
+		Role:  models.RoleOperator,
+		Handler: func(c *fiber.Ctx) error {
+			acc, cli, err := apiLoadClient(c)
+			if err != nil {
+				return err
+			}
+			if ret := models.DB.Delete(&cli); ret.Error != nil {
+				return ret.Error
+			}
+			recordEvent(actor(c), "delete", clientSnapshot(cli), nil)
+			syncers.UpdateClients(acc.InterfaceID)
+			return c.SendStatus(http.StatusNoContent)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/events", Summary: "List the change history, newest first", Tags: []string{"history"},
+			Query: []*openapi.Parameter{
+				{Name: "account", In: "query", Description: "only changes of this account and its clients",
+					Schema: &openapi.Schema{Type: "integer"}},
+				{Name: "entity", In: "query", Description: "only changes of this entity type",
+					Schema: &openapi.Schema{Type: "string"}},
+				{Name: "entity_id", In: "query", Description: "only changes of the entity with this ID",
+					Schema: &openapi.Schema{Type: "integer"}},
+				{Name: "actor", In: "query", Description: "only changes made by this actor",
+					Schema: &openapi.Schema{Type: "string"}},
+				{Name: "before", In: "query", Description: "only events older than this event ID, for paging",
+					Schema: &openapi.Schema{Type: "integer"}},
+				{Name: "limit", In: "query", Description: "maximum number of events, defaults to 100",
+					Schema: &openapi.Schema{Type: "integer"}},
+			},
+			Response: []apiEvent{}},
+		Role: models.RoleAuditor,
+		Handler: func(c *fiber.Ctx) error {
+			limit := c.QueryInt("limit", 100)
+			if limit <= 0 || limit > 10000 {
+				return validation{"limit": "must be between 1 and 10000"}.err()
+			}
+			var events []models.Event
+			if ret := eventQuery(c).Order("id DESC").Limit(limit).Find(&events); ret.Error != nil {
+				return ret.Error
+			}
+			result := []apiEvent{}
+			for _, e := range events {
+				result = append(result, toAPIEvent(e))
+			}
+			return c.JSON(result)
+		},
+	},
+	{
+		Route: openapi.Route{Method: "POST", Path: "/import", Summary: "Import accounts and clients from a backup or CSV (text/csv) file", Tags: []string{"bulk"},
+			Query: []*openapi.Parameter{
+				{Name: "dry_run", In: "query", Description: "only validate and preview the changes",
+					Schema: &openapi.Schema{Type: "boolean"}},
+			},
+			Request: backup{}, Response: importResult{}},
+		Role: models.RoleOperator,
+		Handler: func(c *fiber.Ctx) error {
+			dryRun, _ := strconv.ParseBool(c.Query("dry_run", "false"))
+			var b *backup
+			if strings.HasPrefix(c.Get(fiber.HeaderContentType), "text/csv") {
+				var err error
+				if b, err = parseBackup(c.Body()); err != nil {
+					return newAPIError(http.StatusBadRequest, err.Error())
+				}
+			} else {
+				b = &backup{}
+				if err := decode(c, b); err != nil {
+					return err
+				}
+			}
+			return c.JSON(importBackup(b, currentUser(c).Role, actor(c), dryRun))
+		},
+	},
+	{
+		Route: openapi.Route{Method: "GET", Path: "/export", Summary: "Export interfaces, accounts and clients including their keys", Tags: []string{"bulk"},
+			Response: backup{}},
+		Role: models.RoleAdmin,
+		Handler: func(c *fiber.Ctx) error {
+			b, err := exportBackup()
+			if err != nil {
+				return err
+			}
+			return c.JSON(b)
+		},
+	},
+}
+
+type apiEvent struct {
+	ID        int            `json:"id"`
+	Time      time.Time      `json:"time"`
+	Actor     string         `json:"actor" doc:"user name, token:<name>, cli:<system user> or portal:<account>"`
+	Action    string         `json:"action"`
+	Entity    string         `json:"entity" doc:"account, client, interface, user or token"`
+	EntityID  int            `json:"entity_id"`
+	AccountID int            `json:"account_id,omitempty"`
+	Before    map[string]any `json:"before,omitempty" doc:"state before the change, missing for created entities"`
+	After     map[string]any `json:"after,omitempty" doc:"state after the change, missing for deleted entities"`
+}
+
+func toAPIEvent(e models.Event) apiEvent {
+	a := apiEvent{
+		ID:        e.ID,
+		Time:      e.CreatedAt,
+		Actor:     e.Actor,
+		Action:    e.Action,
+		Entity:    e.Entity,
+		EntityID:  e.EntityID,
+		AccountID: e.AccountID,
+	}
+	if e.Before != "" {
+		a.Before = decodeSnapshot(e.Before)
+	}
+	if e.After != "" {
+		a.After = decodeSnapshot(e.After)
+	}
+	return a
+}
+
+func apiLoadClient(c *fiber.Ctx) (acc models.Account, cli models.Client, err error) {
+	if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+		return acc, cli, ret.Error
+	}
+	ret := models.DB.Where("account_id = ?", acc.ID).First(&cli, c.Params("cid"))
+	return acc, cli, ret.Error
+}
+
+type apiInterface struct {
+	ID                  int    `json:"id"`
+	Name                string `json:"name"`
+	PublicKey           string `json:"public_key"`
+	ListenPort          int    `json:"listen_port"`
+	Subnet              string `json:"subnet"`
+	NatIface            string `json:"nat_iface" doc:"interface for masquerading client traffic, empty to disable NAT"`
+	ExternalIP          string `json:"external_ip" doc:"endpoint address used in client configurations"`
+	DNS                 string `json:"dns"`
+	PersistentKeepalive int    `json:"persistent_keepalive" doc:"seconds, 0 to disable"`
+}
+
+func toAPIInterface(iface models.Interface) apiInterface {
+	var pub string
+	if key, err := wgtypes.NewKey(iface.PrivateKey); err == nil {
+		pub = key.PublicKey().String()
+	}
+	return apiInterface{
+		ID:                  iface.ID,
+		Name:                iface.Name,
+		PublicKey:           pub,
+		ListenPort:          iface.ListenPort,
+		Subnet:              iface.Subnet,
+		NatIface:            iface.NatIface,
+		ExternalIP:          iface.ExternalIP,
+		DNS:                 iface.DNS,
+		PersistentKeepalive: iface.PersistentKeepalive,
+	}
+}
+
+type apiInterfaceRequest struct {
+	Name                string `json:"name" doc:"cannot be changed after creation"`
+	ListenPort          int    `json:"listen_port"`
+	Subnet              string `json:"subnet"`
+	NatIface            string `json:"nat_iface,omitempty"`
+	ExternalIP          string `json:"external_ip"`
+	DNS                 string `json:"dns,omitempty"`
+	PersistentKeepalive int    `json:"persistent_keepalive,omitempty"`
+}
+
+// apply validates the request and saves it to iface.
+func (r apiInterfaceRequest) apply(iface *models.Interface) error {
+	v := validation{}
+	v.check(r.Name != "", "name", "must not be empty")
+	v.check(r.ListenPort > 0 && r.ListenPort <= 65535, "listen_port", "must be between 1 and 65535")
+	_, _, err := net.ParseCIDR(r.Subnet)
+	v.check(err == nil, "subnet", "must be a CIDR")
+	v.check(r.ExternalIP != "", "external_ip", "must not be empty")
+	v.check(r.PersistentKeepalive >= 0 && r.PersistentKeepalive <= 65535, "persistent_keepalive", "must be between 0 and 65535")
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	if len(iface.PrivateKey) == 0 {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			return err
+		}
+		iface.PrivateKey = key[:]
+	}
+	iface.ListenPort = r.ListenPort
+	iface.Subnet = r.Subnet
+	iface.NatIface = r.NatIface
+	iface.ExternalIP = r.ExternalIP
+	iface.DNS = r.DNS
+	iface.PersistentKeepalive = r.PersistentKeepalive
+	if err := checkInterface(iface); err != nil {
+		return requestAPIError(err)
+	}
+	if ret := models.DB.Save(iface); ret.Error != nil {
+		return ret.Error
+	}
+	syncers.UpdateInterface(iface.ID)
+	return nil
+}
+
+type apiAccount struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	InterfaceID int    `json:"interface_id"`
+	apiAccountLimits
+	BytesIn  int64       `json:"bytes_in"`
+	BytesOut int64       `json:"bytes_out"`
+	Clients  []apiClient `json:"clients,omitempty" doc:"only included when getting a single account"`
+}
+
+func toAPIAccount(acc models.Account) apiAccount {
+	a := apiAccount{
+		ID:          acc.ID,
+		Name:        acc.Name,
+		InterfaceID: acc.InterfaceID,
+		apiAccountLimits: apiAccountLimits{
+			BandwidthInLimit:  float64(acc.BandwidthInLimit) / 1024 / 1024,
+			BandwidthOutLimit: float64(acc.BandwidthOutLimit) / 1024 / 1024,
+			DeviceLimit:       acc.DeviceLimit,
+		},
+		BytesIn:  acc.BytesIn,
+		BytesOut: acc.BytesOut,
+	}
+	if acc.Clients != nil {
+		a.Clients = []apiClient{}
+		for _, cli := range acc.Clients {
+			a.Clients = append(a.Clients, toAPIClient(cli))
+		}
+	}
+	return a
+}
+
+type apiAccountLimits struct {
+	BandwidthInLimit  float64 `json:"bandwidth_in_limit" doc:"download limit in Mb/s"`
+	BandwidthOutLimit float64 `json:"bandwidth_out_limit" doc:"upload limit in Mb/s"`
+	DeviceLimit       int     `json:"device_limit,omitempty" doc:"clients the account holder may create in the portal, 0 for no limit"`
+}
+
+func (r apiAccountLimits) validate(v validation) {
+	v.check(r.BandwidthInLimit > 0, "bandwidth_in_limit", "must be positive")
+	v.check(r.BandwidthOutLimit > 0, "bandwidth_out_limit", "must be positive")
+	v.check(r.DeviceLimit >= 0, "device_limit", "must not be negative")
+}
+
+func (r apiAccountLimits) apply(acc *models.Account) {
+	acc.BandwidthInLimit = int64(r.BandwidthInLimit * 1024 * 1024)
+	acc.BandwidthOutLimit = int64(r.BandwidthOutLimit * 1024 * 1024)
+	acc.DeviceLimit = r.DeviceLimit
+}
+
+type apiAccountRequest struct {
+	Name        string `json:"name"`
+	InterfaceID int    `json:"interface_id"`
+	apiAccountLimits
+}
+
+type apiClient struct {
+	ID                  int    `json:"id"`
+	Name                string `json:"name"`
+	IPAddress           string `json:"ip_address"`
+	PublicKey           string `json:"public_key"`
+	PresharedKey        bool   `json:"preshared_key" doc:"whether a preshared key is used"`
+	PrivateKeyStored    bool   `json:"private_key_stored" doc:"whether the configuration can be downloaded with the private key"`
+	PersistentKeepalive int    `json:"persistent_keepalive" doc:"seconds, 0 to use the interface setting"`
+	BytesIn             int64  `json:"bytes_in"`
+	BytesOut            int64  `json:"bytes_out"`
+	PacketsIn           int64  `json:"packets_in"`
+	PacketsOut          int64  `json:"packets_out"`
+}
+
+func toAPIClient(cli models.Client) apiClient {
+	var pub string
+	if key, err := wgtypes.NewKey(cli.PublicKey); err == nil {
+		pub = key.String()
+	}
+	return apiClient{
+		ID:                  cli.ID,
+		Name:                cli.Name,
+		IPAddress:           cli.IPAddress,
+		PublicKey:           pub,
+		PresharedKey:        len(cli.PresharedKey) > 0,
+		PrivateKeyStored:    len(cli.PrivateKey) > 0,
+		PersistentKeepalive: cli.PersistentKeepalive,
+		BytesIn:             cli.BytesIn,
+		BytesOut:            cli.BytesOut,
+		PacketsIn:           cli.PacketsIn,
+		PacketsOut:          cli.PacketsOut,
+	}
+}
+
+type apiClientConfig struct {
+	Client     apiClient `json:"client"`
+	Config     string    `json:"config" doc:"wireguard configuration, contains a placeholder if the private key is unknown"`
+	PrivateKey string    `json:"private_key,omitempty" doc:"only included if generated by the server"`
+}
+
+func toAPIClientConfig(iface models.Interface, cli models.Client, privateKey string) (apiClientConfig, error) {
+	config, err := clientConfig(iface, cli, privateKey)
+	if err != nil {
+		return apiClientConfig{}, err
+	}
+	return apiClientConfig{
+		Client:     toAPIClient(cli),
+		Config:     config,
+		PrivateKey: privateKey,
+	}, nil
+}
+
+type apiClientRequest struct {
+	Name                string `json:"name"`
+	PublicKey           string `json:"public_key,omitempty" doc:"generated by the server if empty"`
+	PersistentKeepalive int    `json:"persistent_keepalive,omitempty" doc:"seconds, 0 to use the interface setting"`
+	PresharedKey        *bool  `json:"preshared_key,omitempty" doc:"use a preshared key, defaults to true"`
+	IPAddress           string `json:"ip_address,omitempty" doc:"fixed address in the subnet of the interface, the next free address if empty"`
+}
+
+type apiClientKeyRequest struct {
+	PublicKey string `json:"public_key,omitempty" doc:"generated by the server if empty"`
+}
+
+type apiUsage struct {
+	BytesIn      int64  `json:"bytes_in"`
+	BytesOut     int64  `json:"bytes_out"`
+	AuditEnabled bool   `json:"audit_enabled"`
+	TCPSent      uint64 `json:"tcp_sent,omitempty" doc:"bytes sent over TCP, requires the audit log"`
+	TCPRecv      uint64 `json:"tcp_recv,omitempty" doc:"bytes received over TCP, requires the audit log"`
+}
+
+type apiClientStatus struct {
+	ClientID      int        `json:"client_id"`
+	Online        bool       `json:"online" doc:"whether the client completed a handshake in the last three minutes"`
+	LastHandshake *time.Time `json:"last_handshake" doc:"null if the client never connected"`
+	Endpoint      string     `json:"endpoint" doc:"address the client last connected from"`
+	DownloadRate  float64    `json:"download_rate" doc:"bytes per second sent to the client"`
+	UploadRate    float64    `json:"upload_rate" doc:"bytes per second received from the client"`
+}
+
+func toAPIClientStatus(clientID int, p PeerStatus) apiClientStatus {
+	st := apiClientStatus{
+		ClientID:     clientID,
+		Online:       p.Online(),
+		Endpoint:     p.Endpoint,
+		DownloadRate: p.TransmitRate,
+		UploadRate:   p.ReceiveRate,
+	}
+	if !p.LastHandshake.IsZero() {
+		t := p.LastHandshake
+		st.LastHandshake = &t
+	}
+	return st
+}
+
+// clientStatus returns the peer status of the clients of an account by
+// client ID. Clients missing from the interface are omitted.
+func clientStatus(acc models.Account) map[int]apiClientStatus {
+	peers := syncers.Peers(acc.InterfaceID)
+	ret := make(map[int]apiClientStatus)
+	for _, cli := range acc.Clients {
+		key, err := wgtypes.NewKey(cli.PublicKey)
+		if err != nil {
+			continue
+		}
+		if p, ok := peers[key]; ok {
+			ret[cli.ID] = toAPIClientStatus(cli.ID, p)
+		}
+	}
+	return ret
+}
+
+func clientStatusList(acc models.Account) []apiClientStatus {
+	status := clientStatus(acc)
+	ret := []apiClientStatus{}
+	for _, cli := range acc.Clients {
+		if st, ok := status[cli.ID]; ok {
+			ret = append(ret, st)
+		}
+	}
+	return ret
+}
+
+type apiUsagePoint struct {
+	Time     time.Time `json:"time" doc:"start of the bucket"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+type apiAccessLog struct {
+	ServerName string `json:"server_name"`
+	Sent       uint64 `json:"sent"`
+	Recv       uint64 `json:"recv"`
+}
+
+type apiAuditSearch struct {
+	Rows       []apiAuditRow `json:"rows"`
+	NextCursor string        `json:"next_cursor,omitempty" doc:"cursor of the next page, missing on the last page"`
+}
+
+type apiAuditRow struct {
+	Time        *time.Time `json:"time,omitempty" doc:"start of the connection, hour or day"`
+	ClientIP    string     `json:"client_ip,omitempty"`
+	ClientID    int        `json:"client_id,omitempty"`
+	Client      string     `json:"client,omitempty"`
+	AccountID   int        `json:"account_id,omitempty"`
+	Account     string     `json:"account,omitempty"`
+	ServerName  string     `json:"server_name,omitempty"`
+	Protocol    string     `json:"protocol,omitempty"`
+	Port        uint16     `json:"port,omitempty"`
+	Connections uint64     `json:"connections"`
+	Sent        uint64     `json:"sent"`
+	Recv        uint64     `json:"recv"`
+}
+
+func toAPIAuditRow(r auditlog.SearchRow, clients map[string]auditClient) apiAuditRow {
+	a := apiAuditRow{
+		ServerName:  r.ServerName,
+		Protocol:    string(r.Protocol),
+		Port:        r.Port,
+		Connections: r.Connections,
+		Sent:        r.Sent,
+		Recv:        r.Recv,
+	}
+	if !r.Time.IsZero() {
+		a.Time = &r.Time
+	}
+	if r.Client != nil {
+		a.ClientIP = r.Client.String()
+		cli := clients[a.ClientIP]
+		a.ClientID, a.Client, a.AccountID, a.Account = cli.ID, cli.Name, cli.AccountID, cli.AccountName
+	}
+	return a
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+// testToken creates an API token with the role and returns it.
+func testToken(t *testing.T, role models.Role) string {
+	token := "token-" + string(role)
+	hash := sha256.Sum256([]byte(token))
+	assert.NoError(t, models.DB.Create(&models.APIToken{Name: string(role), TokenHash: hash[:], Role: role}).Error)
+	return token
+}
+
+// apiCall sends body as JSON to the API and returns the status and the
+// decoded error message, if any.
+func apiCall(t *testing.T, app *fiber.App, token, method, path string, body any) (int, apiError) {
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		assert.NoError(t, err)
+	}
+	req := httptest.NewRequest(method, apiPrefix+path, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := app.Test(req, -1)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	var ae apiError
+	if resp.StatusCode >= 400 {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&ae))
+	}
+	return resp.StatusCode, ae
+}
+
+func TestAPIRoles(t *testing.T) {
+	app, iface := testApp(t)
+	auditor := testToken(t, models.RoleAuditor)
+	operator := testToken(t, models.RoleOperator)
+	admin := testToken(t, models.RoleAdmin)
+
+	status, _ := apiCall(t, app, "", "GET", "/accounts", nil)
+	assert.Equal(t, 401, status)
+	status, _ = apiCall(t, app, "invalid", "GET", "/accounts", nil)
+	assert.Equal(t, 401, status)
+
+	account := apiAccountRequest{Name: "bob", InterfaceID: iface.ID,
+		apiAccountLimits: apiAccountLimits{BandwidthInLimit: 10, BandwidthOutLimit: 10}}
+	for _, tc := range []struct {
+		token  string
+		method string
+		path   string
+		body   any
+		status int
+	}{
+		{auditor, "GET", "/accounts", nil, 200},
+		{auditor, "POST", "/accounts", account, 403},
+		{operator, "POST", "/accounts", account, 201},
+		{auditor, "GET", "/interfaces", nil, 200},
+		{operator, "DELETE", "/interfaces/" + strconv.Itoa(iface.ID), nil, 403},
+		{admin, "DELETE", "/interfaces/" + strconv.Itoa(iface.ID), nil, 204},
+	} {
+		status, ae := apiCall(t, app, tc.token, tc.method, tc.path, tc.body)
+		assert.Equal(t, tc.status, status, "%s %s as %s: %s", tc.method, tc.path, tc.token, ae.Message)
+	}
+}
+
+func TestAPICreateClient(t *testing.T) {
+	app, iface := testApp(t)
+	token := testToken(t, models.RoleOperator)
+	acc := models.Account{Name: "bob", InterfaceID: iface.ID}
+	assert.NoError(t, models.DB.Create(&acc).Error)
+	key, err := wgtypes.GeneratePrivateKey()
+	assert.NoError(t, err)
+	path := "/accounts/" + strconv.Itoa(acc.ID) + "/clients"
+
+	status, ae := apiCall(t, app, token, "POST", path, apiClientRequest{Name: "laptop", PublicKey: key.PublicKey().String(), IPAddress: "10.0.0.5"})
+	assert.Equal(t, 201, status, ae.Message)
+
+	for _, tc := range []struct {
+		name   string
+		req    apiClientRequest
+		status int
+		msg    string
+	}{
+		{"missing name", apiClientRequest{}, 422, "validation failed"},
+		{"invalid key", apiClientRequest{Name: "a", PublicKey: "invalid"}, 422, "validation failed"},
+		{"address outside subnet", apiClientRequest{Name: "a", IPAddress: "10.1.0.5"}, 422, "IP address 10.1.0.5 is not in 10.0.0.0/24"},
+		{"reserved address", apiClientRequest{Name: "a", IPAddress: "10.0.0.1"}, 422, "IP address 10.0.0.1 is reserved"},
+		{"used address", apiClientRequest{Name: "a", IPAddress: "10.0.0.5"}, 409, "IP address 10.0.0.5 is already used"},
+		{"used key", apiClientRequest{Name: "a", PublicKey: key.PublicKey().String()}, 409, "Public key is already used by another client"},
+	} {
+		status, ae := apiCall(t, app, token, "POST", path, tc.req)
+		assert.Equal(t, tc.status, status, tc.name)
+		assert.Equal(t, tc.msg, ae.Message, tc.name)
+	}
+
+	status, _ = apiCall(t, app, token, "POST", "/accounts/100/clients", apiClientRequest{Name: "a"})
+	assert.Equal(t, 404, status)
+	status, _ = apiCall(t, app, token, "POST", path, map[string]any{"name": "a", "unknown": 1})
+	assert.Equal(t, 400, status)
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"log"
 	"net"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
@@ -22,82 +24,99 @@ import (
 
 func appHandler(app *fiber.App) {
 	// all accounts
-	app.Get("/", func(c *fiber.Ctx) error {
-		var iface models.Interface
-		models.DB.Last(&iface)
+	app.Get("/", requireRole(models.RoleAuditor), func(c *fiber.Ctx) error {
+		var ifaces []models.Interface
+		models.DB.Order("id").Find(&ifaces)
 
 		type Account struct {
-			ID      int
-			Name    string
-			Clients int
+			ID        int
+			Name      string
+			Interface string
+			Clients   int
 		}
 		var result []Account
-		rows, err := models.DB.Table("accounts").
-			Select("accounts.id, accounts.name, count(clients.id)").
-			Joins("left join clients on clients.account_id = accounts.id").
-			Where("accounts.deleted_at IS NULL AND clients.deleted_at IS NULL AND accounts.interface_id = ?", iface.ID).
-			Group("clients.account_id").
-			Rows()
+		q := models.DB.Table("accounts").
+			Select("accounts.id, accounts.name, interfaces.name, count(clients.id)").
+			Joins("join interfaces on interfaces.id = accounts.interface_id").
+			Joins("left join clients on clients.account_id = accounts.id AND clients.deleted_at IS NULL").
+			Where("accounts.deleted_at IS NULL AND interfaces.deleted_at IS NULL")
+		if id := c.QueryInt("interface"); id != 0 {
+			q = q.Where("accounts.interface_id = ?", id)
+		}
+		rows, err := q.Group("accounts.id").Order("accounts.id").Rows()
 		if err != nil {
 			return c.SendStatus(500)
 		}
 		defer rows.Close()
 		for rows.Next() {
 			var r Account
-			if err := rows.Scan(&r.ID, &r.Name, &r.Clients); err != nil {
+			if err := rows.Scan(&r.ID, &r.Name, &r.Interface, &r.Clients); err != nil {
 				return c.SendStatus(500)
 			}
 			result = append(result, r)
 		}
 
+		var deleted []models.Account
+		recentlyDeleted(models.DB).Order("deleted_at DESC").Find(&deleted)
+
+		live, err := liveAccounts()
+		if err != nil {
+			return err
+		}
+
 		return c.Render("all_account", fiber.Map{
-			"Accounts": result,
+			"Accounts":     result,
+			"Live":         live,
+			"AuditEnabled": auditDB != nil,
+			"Deleted":      deleted,
+			"Interfaces":   ifaces,
+			"Selected":     c.QueryInt("interface"),
 		})
 	})
 
 	// get account
-	app.Get("/account/:id", func(c *fiber.Ctx) error {
+	app.Get("/account/:id", requireRole(models.RoleAuditor), func(c *fiber.Ctx) error {
 		var acc models.Account
 		models.DB.Preload("Clients", func(db *gorm.DB) *gorm.DB {
 			return db.Order("clients.id DESC")
 		}).First(&acc, c.Params("id"))
 
-		var al []auditlog.AccessLog
-		var totalSent, totalRecv uint64
-		var audit bool
-		if auditDB != nil {
-			audit = true
-			var cips []net.IP
-			for _, c := range acc.Clients {
-				cips = append(cips, net.ParseIP(c.IPAddress).To4())
-			}
-			var err error
-			al, err = auditDB.Query(cips, time.Now().UTC().Add(-time.Hour*2), 10)
-			if err != nil {
-				fmt.Println(err)
-				return c.SendStatus(500)
-			}
+		data, err := accountUsage(acc)
+		if err != nil {
+			log.Printf("account: usage of account %d: %v", acc.ID, err)
+			return c.SendStatus(500)
+		}
+		var deleted []models.Client
+		recentlyDeleted(models.DB).Where("account_id = ?", acc.ID).Order("deleted_at DESC").Find(&deleted)
 
-			totalSent, totalRecv, err = auditDB.Total(cips)
-			if err != nil {
-				fmt.Println(err)
-				return c.SendStatus(500)
-			}
+		var events []models.Event
+		models.DB.Where("account_id = ?", acc.ID).Order("id DESC").Limit(10).Find(&events)
+
+		usage, err := newUsageChart(acc.ID, 0, c.Query("usage", "day"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
 		}
 
-		return c.Render("account", fiber.Map{
-			"Account":      acc,
-			"AuditEnabled": audit,
-			"AccessLog":    al,
-			"TotalSent":    totalSent,
-			"TotalRecv":    totalRecv,
-		})
+		data["Account"] = acc
+		data["Peers"] = clientStatus(acc)
+		live, err := liveAccounts()
+		if err != nil {
+			return err
+		}
+		data["Live"] = live[acc.ID]
+		data["Usage"] = usage
+		data["Deleted"] = deleted
+		data["History"] = toHistoryEvents(events)
+		return c.Render("account", data)
 	})
 
 	// create account
-	app.Post("/account", func(c *fiber.Ctx) error {
+	app.Post("/account", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
 		var iface models.Interface
-		models.DB.Last(&iface)
+		if ret := models.DB.First(&iface, c.FormValue("interface_id")); ret.Error != nil {
+			flashError(c, "Invalid interface")
+			return c.Redirect("/")
+		}
 
 		var acc models.Account
 		acc.Name = c.FormValue("name")
@@ -118,14 +137,17 @@ func appHandler(app *fiber.App) {
 		ret := models.DB.Create(&acc)
 		if ret.Error != nil {
 			flashError(c, ret.Error.Error())
+		} else {
+			recordEvent(actor(c), "create", nil, accountSnapshot(acc))
 		}
 		return c.Redirect("/")
 	})
 
 	// update account
-	app.Post("/account/:id", func(c *fiber.Ctx) error {
+	app.Post("/account/:id", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
 		var acc models.Account
 		models.DB.First(&acc, c.Params("id"))
+		before := accountSnapshot(acc)
 
 		if bw, err := strconv.ParseFloat(c.FormValue("bandwidth_in_limit"), 64); err != nil {
 			flashError(c, "Invalid bandwidth limit")
@@ -145,186 +167,746 @@ func appHandler(app *fiber.App) {
 			flashError(c, ret.Error.Error())
 		} else {
 			flashInfo(c, "Account updated")
+			recordEvent(actor(c), "update", before, accountSnapshot(acc))
 		}
-		syncer.UpdateAccounts()
+		syncers.UpdateAccounts(acc.InterfaceID)
 		return c.Redirect("/account/" + c.Params("id"))
 	})
 
 	// delete account
-	app.Get("/account/:id/delete", func(c *fiber.Ctx) error {
-		ret := models.DB.Delete(&models.Account{}, c.Params("id"))
+	app.Post("/account/:id/delete", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		var acc models.Account
+		if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/")
+		}
+
+		ret := models.DB.Delete(&acc)
 		if ret.Error != nil {
 			flashError(c, ret.Error.Error())
 		} else {
-			flashInfo(c, "Account deleted")
+			flashInfo(c, fmt.Sprintf("Account %s deleted, it can be restored for %d minutes", acc.Name, int(UndoWindow.Minutes())))
+			recordEvent(actor(c), "delete", accountSnapshot(acc), nil)
 		}
-		syncer.UpdateAccounts()
+		syncers.UpdateAccounts(acc.InterfaceID)
 		return c.Redirect("/")
 	})
 
+	// restore deleted account
+	app.Post("/account/:id/restore", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		acc, err := restoreAccount(c.Params("id"))
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/")
+		}
+		flashInfo(c, "Account restored")
+		recordEvent(actor(c), "restore", nil, accountSnapshot(acc))
+		return c.Redirect("/account/" + strconv.Itoa(acc.ID))
+	})
+
 	// create client
-	app.Post("/account/:id/client", func(c *fiber.Ctx) error {
+	app.Post("/account/:id/client", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		var acc models.Account
+		if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/")
+		}
+
+		ka, err := parseKeepalive(c.FormValue("persistent_keepalive"))
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/account/" + c.Params("id"))
+		}
+		cli, iface, privateKey, err := newClient(acc, c.FormValue("name"), c.FormValue("public_key"), ka, c.FormValue("no_preshared_key") == "", "")
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/account/" + c.Params("id"))
+		}
+		recordEvent(actor(c), "create", nil, clientSnapshot(cli))
+		return renderClient(c, "/account/"+c.Params("id"), iface, cli, privateKey)
+	})
+
+	// rotate client key
+	app.Post("/account/:id/client/:cid/key", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		var acc models.Account
+		if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/")
+		}
 		var cli models.Client
-		cli.AccountID, _ = strconv.Atoi(c.Params("id"))
-		cli.Name = c.FormValue("name")
+		if ret := models.DB.Where("account_id = ?", acc.ID).First(&cli, c.Params("cid")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/account/" + c.Params("id"))
+		}
+		before := clientSnapshot(cli)
+		iface, privateKey, err := rotateClientKey(acc, &cli, c.FormValue("public_key"))
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/account/" + c.Params("id"))
+		}
+		recordEvent(actor(c), "rotate_key", before, clientSnapshot(cli))
+		return renderClient(c, "/account/"+c.Params("id"), iface, cli, privateKey)
+	})
 
-		key, err := wgtypes.GenerateKey()
+	// get client
+	app.Get("/account/:id/client/:cid", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		var acc models.Account
+		if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/")
+		}
+		var cli models.Client
+		if ret := models.DB.Where("account_id = ?", acc.ID).First(&cli, c.Params("cid")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/account/" + c.Params("id"))
+		}
+		privateKey, err := openPrivateKey(cli)
 		if err != nil {
 			flashError(c, err.Error())
 			return c.Redirect("/account/" + c.Params("id"))
 		}
-		pub := key.PublicKey()
-		cli.PublicKey = pub[:]
 
 		iface := models.Interface{}
-		models.DB.Last(&iface)
-
-		var newestClient models.Client
-		models.DB.Unscoped().Last(&newestClient)
+		models.DB.First(&iface, acc.InterfaceID)
+		return renderClient(c, "/account/"+c.Params("id"), iface, cli, privateKey)
+	})
 
-		{
-			ip, cidr, err := net.ParseCIDR(iface.Subnet)
-			if err != nil {
-				panic(err)
-			}
-			if newestClient.IPAddress != "" {
-				ip = net.ParseIP(newestClient.IPAddress)
-			}
-			ip, err = nextIP(ip, cidr)
-			if err != nil {
-				panic(err)
-			}
-			cli.IPAddress = ip.String()
+	// download client config
+	app.Get("/account/:id/client/:cid/config", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		var acc models.Account
+		if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+			return c.SendStatus(404)
+		}
+		var cli models.Client
+		if ret := models.DB.Where("account_id = ?", acc.ID).First(&cli, c.Params("cid")); ret.Error != nil {
+			return c.SendStatus(404)
+		}
+		privateKey, err := openPrivateKey(cli)
+		if err != nil {
+			return c.SendStatus(500)
 		}
 
-		ikey, err := wgtypes.NewKey(iface.PrivateKey)
+		iface := models.Interface{}
+		models.DB.First(&iface, acc.InterfaceID)
+		config, err := clientConfig(iface, cli, privateKey)
 		if err != nil {
-			panic(err)
+			return c.SendStatus(500)
 		}
-		var buf bytes.Buffer
-		wgTmpl.Execute(&buf, map[string]interface{}{
-			"Iface":            iface,
-			"ClientAddress":    cli.IPAddress,
-			"ClientPrivateKey": key.String(),
-			"ServerPublicKey":  ikey.PublicKey().String(),
-		})
-		ret := models.DB.Create(&cli)
-		if ret.Error != nil {
+		c.Attachment(iface.Name + ".conf")
+		return c.SendString(config)
+	})
+
+	// delete client
+	app.Post("/account/:id/client/:cid/delete", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		var acc models.Account
+		if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/")
+		}
+
+		var cli models.Client
+		if ret := models.DB.Where("account_id = ?", acc.ID).First(&cli, c.Params("cid")); ret.Error != nil {
 			flashError(c, ret.Error.Error())
 			return c.Redirect("/account/" + c.Params("id"))
 		}
+		if ret := models.DB.Delete(&cli); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+		} else {
+			flashInfo(c, fmt.Sprintf("Client deleted, it can be restored for %d minutes", int(UndoWindow.Minutes())))
+			recordEvent(actor(c), "delete", clientSnapshot(cli), nil)
+		}
+		syncers.UpdateClients(acc.InterfaceID)
+		return c.Redirect("/account/" + c.Params("id"))
+	})
 
-		config := buf.String()
-		qrc, err := qrcode.NewWith(config, qrcode.WithErrorCorrectionLevel(qrcode.ErrorCorrectionLow))
-		if err != nil {
-			panic(err)
+	// restore deleted client
+	app.Post("/account/:id/client/:cid/restore", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		var acc models.Account
+		if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/")
 		}
+		if cli, err := restoreClient(acc, c.Params("cid")); err != nil {
+			flashError(c, err.Error())
+		} else {
+			flashInfo(c, "Client restored")
+			recordEvent(actor(c), "restore", nil, clientSnapshot(cli))
+		}
+		return c.Redirect("/account/" + c.Params("id"))
+	})
 
-		buf.Reset()
-		w := standard.NewWithWriter(base64.NewEncoder(base64.StdEncoding, &buf), standard.WithQRWidth(8))
-		if err = qrc.Save(w); err != nil {
-			fmt.Printf("could not save image: %v", err)
+	// all interfaces
+	app.Get("/interfaces", requireRole(models.RoleAuditor), func(c *fiber.Ctx) error {
+		type Interface struct {
+			models.Interface
+			AccountCount int
+		}
+		var result []Interface
+		err := models.DB.Model(&models.Interface{}).
+			Select("interfaces.*, count(accounts.id) as account_count").
+			Joins("left join accounts on accounts.interface_id = interfaces.id AND accounts.deleted_at IS NULL").
+			Group("interfaces.id").
+			Order("interfaces.id").
+			Scan(&result).Error
+		if err != nil {
+			return c.SendStatus(500)
 		}
 
-		syncer.UpdateClients()
-		return c.Render("client", fiber.Map{
-			"Client":    cli,
-			"AccountID": c.Params("id"),
-			"Config":    config,
-			"QRCode":    buf.String(),
+		return c.Render("interfaces", fiber.Map{
+			"Interfaces": result,
 		})
 	})
 
-	// delete client
-	app.Get("/account/:id/client/:cid/delete", func(c *fiber.Ctx) error {
-		var cli models.Client
-		models.DB.Delete(&cli, c.Params("cid"))
-		syncer.UpdateClients()
-		return c.Redirect("/account/" + c.Params("id"))
+	// new interface
+	app.Get("/interface", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		var cnt int64
+		models.DB.Model(&models.Interface{}).Count(&cnt)
+
+		return c.Render("interface", fiber.Map{
+			"Iface": models.Interface{},
+			"Links": linkAttrs(""),
+			"First": cnt == 0,
+		})
 	})
 
 	// get settings
-	app.Get("/interface", func(c *fiber.Ctx) error {
+	app.Get("/interface/:id", requireRole(models.RoleAuditor), func(c *fiber.Ctx) error {
 		iface := models.Interface{}
-		models.DB.Last(&iface)
-
-		links, _ := netlink.LinkList()
-		var attrs []*netlink.LinkAttrs
-		for _, l := range links {
-			a := l.Attrs()
-			if a.Name == iface.Name || a.OperState == netlink.OperDown || a.Flags&net.FlagLoopback != 0 {
-				continue
-			}
-			attrs = append(attrs, a)
+		if ret := models.DB.First(&iface, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/interfaces")
 		}
 
 		return c.Render("interface", fiber.Map{
-			"Iface": iface,
-			"Links": attrs,
+			"Iface":  iface,
+			"Links":  linkAttrs(iface.Name),
+			"Status": syncers.Status(iface.ID),
 		})
 	})
 
-	// update settings
-	app.Post("/interface", func(c *fiber.Ctx) error {
+	// create interface
+	app.Post("/interface", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
 		iface := models.Interface{}
-		models.DB.Last(&iface)
-
 		iface.Name = c.FormValue("name")
-		if len(iface.PrivateKey) == 0 {
-			key, err := wgtypes.GenerateKey()
-			if err != nil {
-				flashError(c, "Failed to generate private key")
-				return c.Redirect("/interface")
-			}
-			iface.PrivateKey = key[:]
-		}
-		if p, err := strconv.Atoi(c.FormValue("listen_port")); err != nil {
-			flashError(c, "Invalid listen port")
-			return c.Redirect("/interface")
-		} else {
-			iface.ListenPort = p
-		}
-		if _, _, err := net.ParseCIDR(c.FormValue("subnet")); err != nil {
-			flashError(c, "Invalid subnet")
-			return c.Redirect("/interface")
-		}
-		iface.Subnet = c.FormValue("subnet")
-		iface.NatIface = c.FormValue("nat_iface")
-		iface.ExternalIP = c.FormValue("external_ip")
-		iface.DNS = c.FormValue("dns")
+		return saveInterface(c, &iface, "/interface")
+	})
 
-		ret := models.DB.Save(&iface)
-		if ret.Error != nil {
+	// update settings
+	app.Post("/interface/:id", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		iface := models.Interface{}
+		if ret := models.DB.First(&iface, c.Params("id")); ret.Error != nil {
 			flashError(c, ret.Error.Error())
-			return c.Redirect("/interface")
-		} else {
-			flashInfo(c, "Interface updated")
-			syncer.UpdateInterface()
-			if c.FormValue("home") != "" {
-				return c.Redirect("/")
-			} else {
-				return c.Redirect("/interface")
-			}
+			return c.Redirect("/interfaces")
 		}
+		return saveInterface(c, &iface, "/interface/"+c.Params("id"))
 	})
 
 	// delete interface
-	app.Get("/interface/:id/delete", func(c *fiber.Ctx) error {
-		ret := models.DB.Delete(&models.Interface{}, c.Params("id"))
+	app.Post("/interface/:id/delete", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		var iface models.Interface
+		if ret := models.DB.First(&iface, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/interfaces")
+		}
+
+		ret := models.DB.Delete(&iface)
 		if ret.Error != nil {
 			flashError(c, ret.Error.Error())
-			return c.Redirect("/interface")
+			return c.Redirect("/interface/" + c.Params("id"))
 		}
 
 		flashInfo(c, "Interface deleted")
+		recordEvent(actor(c), "delete", interfaceSnapshot(iface), nil)
 		c.Cookie(&fiber.Cookie{
 			Name:        "iface",
 			Expires:     time.Now().Add(-time.Hour),
 			HTTPOnly:    true,
 			SessionOnly: true,
 		})
-		syncer.DeleteInterface()
-		return c.Redirect("/interface")
+		syncers.DeleteInterface(iface.ID)
+		return c.Redirect("/interfaces")
+	})
+}
+
+func linkAttrs(self string) []*netlink.LinkAttrs {
+	links, _ := netlink.LinkList()
+	var attrs []*netlink.LinkAttrs
+	for _, l := range links {
+		a := l.Attrs()
+		if a.Name == self || a.OperState == netlink.OperDown || a.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if l.Type() == "wireguard" {
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+func saveInterface(c *fiber.Ctx, iface *models.Interface, back string) error {
+	var before *entitySnapshot
+	if iface.ID != 0 {
+		before = interfaceSnapshot(*iface)
+	}
+	if len(iface.PrivateKey) == 0 {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			flashError(c, "Failed to generate private key")
+			return c.Redirect(back)
+		}
+		iface.PrivateKey = key[:]
+	}
+	if p, err := strconv.Atoi(c.FormValue("listen_port")); err != nil {
+		flashError(c, "Invalid listen port")
+		return c.Redirect(back)
+	} else {
+		iface.ListenPort = p
+	}
+	if _, _, err := net.ParseCIDR(c.FormValue("subnet")); err != nil {
+		flashError(c, "Invalid subnet")
+		return c.Redirect(back)
+	}
+	iface.Subnet = c.FormValue("subnet")
+	iface.NatIface = c.FormValue("nat_iface")
+	iface.ExternalIP = c.FormValue("external_ip")
+	iface.DNS = c.FormValue("dns")
+	if ka, err := parseKeepalive(c.FormValue("persistent_keepalive")); err != nil {
+		flashError(c, err.Error())
+		return c.Redirect(back)
+	} else {
+		iface.PersistentKeepalive = ka
+	}
+
+	if err := checkInterface(iface); err != nil {
+		flashError(c, err.Error())
+		return c.Redirect(back)
+	}
+
+	ret := models.DB.Save(iface)
+	if ret.Error != nil {
+		flashError(c, ret.Error.Error())
+		return c.Redirect(back)
+	}
+
+	flashInfo(c, "Interface updated")
+	if before == nil {
+		recordEvent(actor(c), "create", nil, interfaceSnapshot(*iface))
+	} else {
+		recordEvent(actor(c), "update", before, interfaceSnapshot(*iface))
+	}
+	syncers.UpdateInterface(iface.ID)
+	if c.FormValue("home") != "" {
+		return c.Redirect("/")
+	}
+	return c.Redirect("/interface/" + strconv.Itoa(iface.ID))
+}
+
+// requestError is an error caused by the request rather than the server, its
+// message is shown to the user as is. conflict is set if the request clashes
+// with the existing configuration, such as a used public key, and unset if
+// the request is invalid by itself.
+type requestError struct {
+	msg      string
+	conflict bool
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func invalidf(format string, args ...any) error {
+	return &requestError{msg: fmt.Sprintf(format, args...)}
+}
+
+func conflictf(format string, args ...any) error {
+	return &requestError{msg: fmt.Sprintf(format, args...), conflict: true}
+}
+
+// checkInterface makes sure the interface does not clash with any other
+// configured interface.
+func checkInterface(iface *models.Interface) error {
+	if iface.Name == "" {
+		return invalidf("Invalid interface name")
+	}
+	_, subnet, err := net.ParseCIDR(iface.Subnet)
+	if err != nil {
+		return invalidf("Invalid subnet")
+	}
+
+	var others []models.Interface
+	models.DB.Where("id != ?", iface.ID).Find(&others)
+	for _, o := range others {
+		if o.Name == iface.Name {
+			return conflictf("Interface %s already exists", o.Name)
+		}
+		if o.ListenPort == iface.ListenPort {
+			return conflictf("Listen port %d is already used by %s", o.ListenPort, o.Name)
+		}
+		_, other, err := net.ParseCIDR(o.Subnet)
+		if err != nil {
+			continue
+		}
+		if subnet.Contains(other.IP) || other.Contains(subnet.IP) {
+			return conflictf("Subnet %s overlaps with %s of %s", iface.Subnet, o.Subnet, o.Name)
+		}
+	}
+	return nil
+}
+
+// accountUsage returns the template data showing the recent activities of
+// the account.
+func accountUsage(acc models.Account) (fiber.Map, error) {
+	var al []auditlog.AccessLog
+	var totalSent, totalRecv uint64
+	var audit bool
+	if auditDB != nil {
+		audit = true
+		cips := accountIPs(acc)
+		var err error
+		al, err = auditDB.Query(cips, time.Now().UTC().Add(-time.Hour*2), 10)
+		if err != nil {
+			return nil, err
+		}
+
+		totalSent, totalRecv, err = auditDB.Total(cips)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fiber.Map{
+		"AuditEnabled": audit,
+		"AccessLog":    al,
+		"TotalSent":    totalSent,
+		"TotalRecv":    totalRecv,
+	}, nil
+}
+
+// accountIPs returns the IP addresses of the loaded clients of acc.
+func accountIPs(acc models.Account) []net.IP {
+	var ips []net.IP
+	for _, c := range acc.Clients {
+		ips = append(ips, net.ParseIP(c.IPAddress))
+	}
+	return ips
+}
+
+// UndoWindow is how long deleted accounts and clients can be restored.
+const UndoWindow = 10 * time.Minute
+
+// recentlyDeleted limits the query to rows deleted within the undo window.
+func recentlyDeleted(db *gorm.DB) *gorm.DB {
+	return db.Unscoped().Where("deleted_at > ?", time.Now().Add(-UndoWindow))
+}
+
+// restoreAccount undoes the deletion of an account. Its clients are not
+// deleted with it and are applied again, clients deleted on their own stay
+// deleted. Another account might have taken the name by now.
+func restoreAccount(id string) (acc models.Account, err error) {
+	if ret := recentlyDeleted(models.DB).First(&acc, id); ret.Error != nil {
+		return acc, fmt.Errorf("Account not found or deleted more than %d minutes ago", int(UndoWindow.Minutes()))
+	}
+	var iface models.Interface
+	if ret := models.DB.First(&iface, acc.InterfaceID); ret.Error != nil {
+		return acc, fmt.Errorf("Interface of the account was deleted")
+	}
+	var cnt int64
+	models.DB.Model(&models.Account{}).Where("interface_id = ? AND name = ?", acc.InterfaceID, acc.Name).Count(&cnt)
+	if cnt > 0 {
+		return acc, conflictf("Account %s already exists", acc.Name)
+	}
+	if ret := models.DB.Unscoped().Model(&acc).Update("deleted_at", nil); ret.Error != nil {
+		return acc, ret.Error
+	}
+	syncers.UpdateAccounts(acc.InterfaceID)
+	return acc, nil
+}
+
+// restoreClient undoes the deletion of a client of the account. Its IP
+// address is never handed out again, but the key might be in use by now and
+// the account holder might have used up the device limit.
+func restoreClient(acc models.Account, cid string) (cli models.Client, err error) {
+	if ret := recentlyDeleted(models.DB).Where("account_id = ?", acc.ID).First(&cli, cid); ret.Error != nil {
+		return cli, fmt.Errorf("Client not found or deleted more than %d minutes ago", int(UndoWindow.Minutes()))
+	}
+	var cnt int64
+	models.DB.Model(&models.Client{}).Where("account_id = ?", acc.ID).Count(&cnt)
+	if acc.DeviceLimit > 0 && cnt >= int64(acc.DeviceLimit) {
+		return cli, conflictf("Device limit of %d reached", acc.DeviceLimit)
+	}
+	models.DB.Model(&models.Client{}).Where("public_key = ?", cli.PublicKey).Count(&cnt)
+	if cnt > 0 {
+		return cli, conflictf("Public key is used by another client")
+	}
+	if ret := models.DB.Unscoped().Model(&cli).Update("deleted_at", nil); ret.Error != nil {
+		return cli, ret.Error
+	}
+	syncers.UpdateClients(acc.InterfaceID)
+	return cli, nil
+}
+
+// newClient creates a client for the account with the given IP address, or
+// the next free IP address of its interface if empty. privateKey is empty if
+// the public key was supplied.
+func newClient(acc models.Account, name, publicKey string, keepalive int, presharedKey bool, ip string) (cli models.Client, iface models.Interface, privateKey string, err error) {
+	cli.AccountID = acc.ID
+	cli.Name = name
+	cli.PersistentKeepalive = keepalive
+
+	pub, privateKey, err := clientKey(publicKey, 0)
+	if err != nil {
+		return cli, iface, "", err
+	}
+	cli.PublicKey = pub[:]
+	cli.PrivateKey, err = sealPrivateKey(privateKey)
+	if err != nil {
+		return cli, iface, "", err
+	}
+
+	if presharedKey {
+		psk, err := wgtypes.GenerateKey()
+		if err != nil {
+			return cli, iface, "", err
+		}
+		cli.PresharedKey, err = secrets.Seal(psk[:])
+		if err != nil {
+			return cli, iface, "", err
+		}
+	}
+
+	if ret := models.DB.First(&iface, acc.InterfaceID); ret.Error != nil {
+		return cli, iface, "", ret.Error
+	}
+
+	if ip != "" {
+		if err := checkClientIP(iface, ip); err != nil {
+			return cli, iface, "", err
+		}
+		cli.IPAddress = net.ParseIP(ip).String()
+	} else {
+		free, err := nextFreeIP(iface)
+		if err != nil {
+			return cli, iface, "", err
+		}
+		cli.IPAddress = free.String()
+	}
+
+	if ret := models.DB.Create(&cli); ret.Error != nil {
+		return cli, iface, "", ret.Error
+	}
+
+	syncers.UpdateClients(iface.ID)
+	return cli, iface, privateKey, nil
+}
+
+// nextFreeIP returns the lowest unused host address of the subnet of the
+// interface, skipping the address of the interface. Addresses of deleted
+// clients are not reused.
+func nextFreeIP(iface models.Interface) (net.IP, error) {
+	ifaceIP, cidr, err := net.ParseCIDR(iface.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	if ret := models.DB.Unscoped().Model(&models.Client{}).Pluck("ip_address", &addrs); ret.Error != nil {
+		return nil, ret.Error
+	}
+	used := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		used[a] = true
+	}
+
+	broadcast := broadcastIP(cidr)
+	ip := append(net.IP(nil), cidr.IP...)
+	for {
+		ip, err = nextIP(ip, cidr)
+		if err != nil {
+			return nil, err
+		}
+		if ip.Equal(broadcast) {
+			return nil, conflictf("no more IPs in %s", cidr)
+		}
+		if !ip.Equal(ifaceIP) && !used[ip.String()] {
+			return ip, nil
+		}
+	}
+}
+
+// broadcastIP returns the last address of the subnet.
+func broadcastIP(cidr *net.IPNet) net.IP {
+	broadcast := make(net.IP, len(cidr.IP))
+	for i := range cidr.IP {
+		broadcast[i] = cidr.IP[i] | ^cidr.Mask[i]
+	}
+	return broadcast
+}
+
+func ipUsed(ip string) bool {
+	var cnt int64
+	models.DB.Unscoped().Model(&models.Client{}).Where("ip_address = ?", ip).Count(&cnt)
+	return cnt > 0
+}
+
+// checkClientIP makes sure a fixed client address is in the subnet of the
+// interface and not used.
+func checkClientIP(iface models.Interface, ip string) error {
+	addr := net.ParseIP(ip).To4()
+	ifaceIP, cidr, err := net.ParseCIDR(iface.Subnet)
+	if err != nil {
+		return err
+	}
+	broadcast := broadcastIP(cidr)
+	switch {
+	case addr == nil:
+		return invalidf("Invalid IP address %s", ip)
+	case !cidr.Contains(addr):
+		return invalidf("IP address %s is not in %s", ip, cidr)
+	case addr.Equal(ifaceIP) || addr.Equal(cidr.IP) || addr.Equal(broadcast):
+		return invalidf("IP address %s is reserved", ip)
+	case ipUsed(addr.String()):
+		return conflictf("IP address %s is already used", ip)
+	}
+	return nil
+}
+
+// rotateClientKey replaces the key of the client, keeping its IP address.
+// privateKey is empty if the public key was supplied.
+func rotateClientKey(acc models.Account, cli *models.Client, publicKey string) (iface models.Interface, privateKey string, err error) {
+	pub, privateKey, err := clientKey(publicKey, cli.ID)
+	if err != nil {
+		return iface, "", err
+	}
+	cli.PublicKey = pub[:]
+	cli.PrivateKey, err = sealPrivateKey(privateKey)
+	if err != nil {
+		return iface, "", err
+	}
+	if ret := models.DB.Save(cli); ret.Error != nil {
+		return iface, "", ret.Error
+	}
+
+	models.DB.First(&iface, acc.InterfaceID)
+	syncers.UpdateClients(iface.ID)
+	return iface, privateKey, nil
+}
+
+// clientKey returns the public key of a client. If pubKey is empty a new key
+// pair is generated and the private key is returned as well, otherwise the
+// public key supplied by the user is validated and privateKey is empty.
+func clientKey(pubKey string, clientID int) (pub wgtypes.Key, privateKey string, err error) {
+	if pubKey == "" {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			return wgtypes.Key{}, "", err
+		}
+		return key.PublicKey(), key.String(), nil
+	}
+
+	pub, err = wgtypes.ParseKey(strings.TrimSpace(pubKey))
+	if err != nil {
+		return wgtypes.Key{}, "", invalidf("Invalid public key: %v", err)
+	}
+	var cnt int64
+	models.DB.Model(&models.Client{}).Where("public_key = ? AND id != ?", pub[:], clientID).Count(&cnt)
+	if cnt > 0 {
+		return wgtypes.Key{}, "", conflictf("Public key is already used by another client")
+	}
+	return pub, "", nil
+}
+
+// sealPrivateKey encrypts a generated private key for storage if storing
+// client keys is enabled.
+func sealPrivateKey(privateKey string) ([]byte, error) {
+	if !*flagStoreClientKeys || privateKey == "" {
+		return nil, nil
+	}
+	return secrets.Seal([]byte(privateKey))
+}
+
+// openPrivateKey returns the stored private key of the client, or an empty
+// string if it is not stored.
+func openPrivateKey(cli models.Client) (string, error) {
+	if len(cli.PrivateKey) == 0 {
+		return "", nil
+	}
+	b, err := secrets.Open(cli.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decrypt private key: %w", err)
+	}
+	return string(b), nil
+}
+
+// clientConfig returns the wireguard configuration of a client. If
+// privateKey is empty the configuration contains a placeholder for the
+// private key.
+func clientConfig(iface models.Interface, cli models.Client, privateKey string) (string, error) {
+	ikey, err := wgtypes.NewKey(iface.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	keepalive := cli.PersistentKeepalive
+	if keepalive == 0 {
+		keepalive = iface.PersistentKeepalive
+	}
+	var psk string
+	if len(cli.PresharedKey) > 0 {
+		b, err := secrets.Open(cli.PresharedKey)
+		if err != nil {
+			return "", err
+		}
+		k, err := wgtypes.NewKey(b)
+		if err != nil {
+			return "", err
+		}
+		psk = k.String()
+	}
+
+	var buf bytes.Buffer
+	err = wgTmpl.Execute(&buf, map[string]interface{}{
+		"Iface":               iface,
+		"ClientAddress":       cli.IPAddress,
+		"ClientPrivateKey":    privateKey,
+		"ServerPublicKey":     ikey.PublicKey().String(),
+		"PresharedKey":        psk,
+		"PersistentKeepalive": keepalive,
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renderClient shows the configuration of a client, base is the URL of the
+// page managing the client's account.
+func renderClient(c *fiber.Ctx, base string, iface models.Interface, cli models.Client, privateKey string) error {
+	config, err := clientConfig(iface, cli, privateKey)
+	if err != nil {
+		return err
+	}
+
+	// a configuration without private key cannot be imported as is
+	var qr string
+	if privateKey != "" {
+		qrc, err := qrcode.NewWith(config, qrcode.WithErrorCorrectionLevel(qrcode.ErrorCorrectionLow))
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		w := standard.NewWithWriter(base64.NewEncoder(base64.StdEncoding, &buf), standard.WithQRWidth(8))
+		if err = qrc.Save(w); err != nil {
+			fmt.Printf("could not save image: %v", err)
+		}
+		qr = buf.String()
+	}
+
+	return c.Render("client", fiber.Map{
+		"Client": cli,
+		"Base":   base,
+		"Iface":  iface,
+		"Config": config,
+		"QRCode": qr,
 	})
 }
 
@@ -348,6 +930,17 @@ func flashInfo(c *fiber.Ctx, msg string) {
 	})
 }
 
+func parseKeepalive(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	ka, err := strconv.Atoi(v)
+	if err != nil || ka < 0 || ka > 65535 {
+		return 0, invalidf("Invalid persistent keepalive")
+	}
+	return ka, nil
+}
+
 func nextIP(ip net.IP, cidr *net.IPNet) (net.IP, error) {
 	for j := len(ip) - 1; j >= 0; j-- {
 		ip[j]++
@@ -356,7 +949,7 @@ func nextIP(ip net.IP, cidr *net.IPNet) (net.IP, error) {
 		}
 	}
 	if !cidr.Contains(ip) {
-		return net.IPv4zero, fmt.Errorf("no more IPs in %s", cidr)
+		return net.IPv4zero, conflictf("no more IPs in %s", cidr)
 	}
 	return ip, nil
 }
@@ -364,10 +957,12 @@ func nextIP(ip net.IP, cidr *net.IPNet) (net.IP, error) {
 var (
 	wgTmpl = template.Must(template.New("index").Parse(`[Interface]
 Address = {{ .ClientAddress }}
-PrivateKey = {{ .ClientPrivateKey }}
+PrivateKey = {{ or .ClientPrivateKey "<insert your private key>" }}
 {{ if .Iface.DNS }}DNS = {{ .Iface.DNS }}{{ end }}
 [Peer]
 PublicKey = {{ .ServerPublicKey }}
-Endpoint = {{ .Iface.ExternalIP }}:{{ .Iface.ListenPort }}
+{{ if .PresharedKey }}PresharedKey = {{ .PresharedKey }}
+{{ end }}{{ if .PersistentKeepalive }}PersistentKeepalive = {{ .PersistentKeepalive }}
+{{ end }}Endpoint = {{ .Iface.ExternalIP }}:{{ .Iface.ListenPort }}
 AllowedIPs = 0.0.0.0/0`))
 )
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/brian14708/wg-gatekeeper/mgmtpb"
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+func TestCSRF(t *testing.T) {
+	app, iface := testApp(t)
+	testUser(t, "alice", models.RoleOperator)
+	acc := models.Account{Name: "bob", InterfaceID: iface.ID}
+	assert.NoError(t, models.DB.Create(&acc).Error)
+	path := "/account/" + strconv.Itoa(acc.ID) + "/delete"
+
+	s := newTestSession(t, app)
+	s.do("GET", "/login", nil)
+	resp, _ := s.do("POST", "/login", url.Values{"username": {"alice"}, "password": {"password"}})
+	assert.Equal(t, 403, resp.StatusCode, "login without token")
+	s.login("alice")
+
+	resp, _ = s.do("POST", path, url.Values{})
+	assert.Equal(t, 403, resp.StatusCode, "missing token")
+	resp, _ = s.do("POST", path, url.Values{csrfField: {"invalid"}})
+	assert.Equal(t, 403, resp.StatusCode, "invalid token")
+	resp, _ = s.do("GET", path, nil)
+	assert.NotEqual(t, 302, resp.StatusCode, "delete with GET")
+	assert.NoError(t, models.DB.First(&acc, acc.ID).Error)
+
+	resp = s.post(path, nil)
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Error(t, models.DB.First(&acc, acc.ID).Error)
+}
+
+func TestRestoreClient(t *testing.T) {
+	app, iface := testApp(t)
+	testUser(t, "alice", models.RoleOperator)
+	acc := models.Account{Name: "bob", InterfaceID: iface.ID, DeviceLimit: 1}
+	assert.NoError(t, models.DB.Create(&acc).Error)
+	newClient := func(ip string, key wgtypes.Key) models.Client {
+		cli := models.Client{AccountID: acc.ID, Name: ip, IPAddress: ip, PublicKey: key[:]}
+		assert.NoError(t, models.DB.Create(&cli).Error)
+		return cli
+	}
+	key, err := wgtypes.GenerateKey()
+	assert.NoError(t, err)
+	deleted := newClient("10.0.0.2", key)
+	assert.NoError(t, models.DB.Delete(&deleted).Error)
+	other := newClient("10.0.0.3", key)
+	path := "/account/" + strconv.Itoa(acc.ID) + "/client/" + strconv.Itoa(deleted.ID) + "/restore"
+
+	s := newTestSession(t, app)
+	s.login("alice")
+	restore := func() string {
+		resp := s.post(path, nil)
+		assert.Equal(t, "/account/"+strconv.Itoa(acc.ID), resp.Header.Get("Location"))
+		if msg := s.cookies["flash_error"]; msg != "" {
+			// the next page shows and clears the message
+			s.do("GET", "/", nil)
+			return msg
+		}
+		return ""
+	}
+
+	assert.Equal(t, "Device limit of 1 reached", restore())
+	assert.Error(t, models.DB.First(&models.Client{}, deleted.ID).Error)
+
+	assert.NoError(t, models.DB.Model(&acc).Update("device_limit", 2).Error)
+	assert.Equal(t, "Public key is used by another client", restore())
+	assert.Error(t, models.DB.First(&models.Client{}, deleted.ID).Error)
+
+	assert.NoError(t, models.DB.Delete(&other).Error)
+	assert.Equal(t, "", restore())
+	assert.NoError(t, models.DB.First(&models.Client{}, deleted.ID).Error)
+}
+
+func TestNextFreeIP(t *testing.T) {
+	iface := testDB(t)
+	acc := models.Account{Name: "bob", InterfaceID: iface.ID}
+	assert.NoError(t, models.DB.Create(&acc).Error)
+	add := func(ip string) {
+		assert.NoError(t, models.DB.Create(&models.Client{AccountID: acc.ID, Name: ip, IPAddress: ip}).Error)
+	}
+	next := func() string {
+		ip, err := nextFreeIP(iface)
+		assert.NoError(t, err)
+		return ip.String()
+	}
+
+	assert.Equal(t, "10.0.0.2", next(), "skips the interface address")
+	add("10.0.0.254")
+	assert.Equal(t, "10.0.0.2", next(), "after the newest client")
+	add("10.0.0.2")
+	add("10.0.0.4")
+	assert.Equal(t, "10.0.0.3", next(), "lowest free address")
+
+	// deleted clients keep their address
+	cli := models.Client{AccountID: acc.ID, Name: "deleted", IPAddress: "10.0.0.3"}
+	assert.NoError(t, models.DB.Create(&cli).Error)
+	assert.NoError(t, models.DB.Delete(&cli).Error)
+	assert.Equal(t, "10.0.0.5", next())
+
+	for i := 5; i < 254; i++ {
+		add("10.0.0." + strconv.Itoa(i))
+	}
+	_, err := nextFreeIP(iface)
+	assert.EqualError(t, err, "no more IPs in 10.0.0.0/24", "broadcast address is not used")
+}
+
+func TestPresharedKeyDefault(t *testing.T) {
+	app, iface := testApp(t)
+	testUser(t, "alice", models.RoleOperator)
+	token := testToken(t, models.RoleOperator)
+	acc := models.Account{Name: "bob", InterfaceID: iface.ID}
+	assert.NoError(t, models.DB.Create(&acc).Error)
+	id := strconv.Itoa(acc.ID)
+	hasPSK := func(name string) bool {
+		var cli models.Client
+		assert.NoError(t, models.DB.Where("name = ?", name).First(&cli).Error)
+		return len(cli.PresharedKey) > 0
+	}
+
+	s := newTestSession(t, app)
+	s.login("alice")
+	s.do("GET", "/account/"+id, nil)
+	s.post("/account/"+id+"/client", url.Values{"name": {"ui"}})
+	assert.True(t, hasPSK("ui"))
+	s.do("GET", "/account/"+id, nil)
+	s.post("/account/"+id+"/client", url.Values{"name": {"ui-no-psk"}, "no_preshared_key": {"1"}})
+	assert.False(t, hasPSK("ui-no-psk"))
+
+	status, ae := apiCall(t, app, token, "POST", "/accounts/"+id+"/clients", apiClientRequest{Name: "api"})
+	assert.Equal(t, 201, status, ae.Message)
+	assert.True(t, hasPSK("api"))
+	no := false
+	status, ae = apiCall(t, app, token, "POST", "/accounts/"+id+"/clients", apiClientRequest{Name: "api-no-psk", PresharedKey: &no})
+	assert.Equal(t, 201, status, ae.Message)
+	assert.False(t, hasPSK("api-no-psk"))
+
+	mc := testManagement(t)
+	_, err := mc.CreateClient(withToken(context.Background(), token), &mgmtpb.CreateClientRequest{AccountId: int64(acc.ID), Name: "grpc"})
+	assert.NoError(t, err)
+	assert.True(t, hasPSK("grpc"))
+}
+
+func TestRestoreAccount(t *testing.T) {
+	app, iface := testApp(t)
+	testUser(t, "alice", models.RoleOperator)
+	acc := models.Account{Name: "bob", InterfaceID: iface.ID}
+	assert.NoError(t, models.DB.Create(&acc).Error)
+	assert.NoError(t, models.DB.Delete(&acc).Error)
+	other := models.Account{Name: "bob", InterfaceID: iface.ID}
+	assert.NoError(t, models.DB.Create(&other).Error)
+	path := "/account/" + strconv.Itoa(acc.ID) + "/restore"
+
+	s := newTestSession(t, app)
+	s.login("alice")
+	resp := s.post(path, nil)
+	assert.Equal(t, "/", resp.Header.Get("Location"))
+	assert.Equal(t, "Account bob already exists", s.cookies["flash_error"])
+	assert.Error(t, models.DB.First(&models.Account{}, acc.ID).Error)
+	s.do("GET", "/", nil)
+
+	assert.NoError(t, models.DB.Delete(&other).Error)
+	resp = s.post(path, nil)
+	assert.Equal(t, "/account/"+strconv.Itoa(acc.ID), resp.Header.Get("Location"))
+	assert.NoError(t, models.DB.First(&models.Account{}, acc.ID).Error)
+}
@@ -0,0 +1,41 @@
+// Helpers of the pages updated in place by server-sent events from /events.
+
+function formatMB(bytes) {
+    return String(Math.round(bytes / 1048576 * 100) / 100);
+}
+
+// formatRate renders the download and upload rate of an account or client in
+// KB/s.
+function formatRate(r) {
+    const kb = bytes => String(Math.round(bytes / 1024 * 10) / 10);
+    return '↓ ' + kb(r.download_rate) + ' ↑ ' + kb(r.upload_rate);
+}
+
+// addBytes adds delta to the byte count of a cell showing megabytes.
+function addBytes(cell, delta) {
+    if (!cell) {
+        return;
+    }
+    const bytes = Number(cell.dataset.bytes) + delta;
+    cell.dataset.bytes = bytes;
+    cell.textContent = formatMB(bytes);
+}
+
+// peerStatus renders the status of a client, p is undefined if the client is
+// not on the interface.
+function peerStatus(p) {
+    const status = document.createElement('span');
+    status.className = 'offline';
+    if (!p) {
+        status.title = 'the interface is not up';
+        status.textContent = 'unknown';
+    } else if (p.online) {
+        status.className = 'online';
+        status.textContent = 'online';
+    } else if (p.last_handshake) {
+        status.textContent = 'last seen ' + new Date(p.last_handshake).toLocaleString();
+    } else {
+        status.textContent = 'never connected';
+    }
+    return status;
+}
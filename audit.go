@@ -0,0 +1,278 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/brian14708/wg-gatekeeper/auditlog"
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+var (
+	auditGroupings = []auditlog.Grouping{auditlog.GroupNone, auditlog.GroupDestination, auditlog.GroupClient, auditlog.GroupHour, auditlog.GroupDay}
+	auditSortKeys  = []auditlog.SortKey{auditlog.SortRecv, auditlog.SortSent, auditlog.SortConnections, auditlog.SortGroup}
+	auditProtocols = []auditlog.Protocol{auditlog.ProtocolTCP, auditlog.ProtocolHTTP, auditlog.ProtocolTLS}
+)
+
+// parseAuditTime accepts RFC 3339 timestamps and the local time of
+// datetime-local inputs.
+func parseAuditTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02T15:04", s, time.Local)
+}
+
+// auditClientsQuery returns the addresses of the client or of the clients of
+// the account given by the client or account query parameter, nil for all
+// clients. ok is false if the client or account has no addresses and a
+// search would match nothing.
+func auditClientsQuery(c *fiber.Ctx) (ips []net.IP, ok bool) {
+	var clients []models.Client
+	if id := c.QueryInt("client"); id != 0 {
+		models.DB.Unscoped().Where("id = ?", id).Find(&clients)
+	} else if id := c.QueryInt("account"); id != 0 {
+		// addresses of deleted clients are never handed out again
+		models.DB.Unscoped().Where("account_id = ?", id).Find(&clients)
+	} else {
+		return nil, true
+	}
+	for _, cli := range clients {
+		ips = append(ips, net.ParseIP(cli.IPAddress))
+	}
+	return ips, len(ips) > 0
+}
+
+// auditRangeQuery returns the time range given by the from and to query
+// parameters, zero times if missing.
+func auditRangeQuery(c *fiber.Ctx, v validation) (begin, end time.Time) {
+	var err error
+	if from := c.Query("from"); from != "" {
+		begin, err = parseAuditTime(from)
+		v.check(err == nil, "from", "must be a RFC 3339 timestamp")
+	}
+	if to := c.Query("to"); to != "" {
+		end, err = parseAuditTime(to)
+		v.check(err == nil, "to", "must be a RFC 3339 timestamp")
+	}
+	return begin, end
+}
+
+// auditSearch builds a search of the audit log from the account, client,
+// from, to, protocol, destination, suffix, port, group, sort, order, limit
+// and cursor query parameters. ok is false if the account or client has no
+// addresses and the search would match nothing.
+func auditSearch(c *fiber.Ctx) (s auditlog.Search, ok bool, err error) {
+	v := validation{}
+	s.Clients, ok = auditClientsQuery(c)
+	s.Begin, s.End = auditRangeQuery(c, v)
+	for _, p := range c.Context().QueryArgs().PeekMulti("protocol") {
+		proto := auditlog.Protocol(p)
+		v.check(contains(auditProtocols, proto), "protocol", "must be one of tcp, http or tls")
+		s.Protocols = append(s.Protocols, proto)
+	}
+	s.Destination = c.Query("destination")
+	s.DestinationSuffix = c.Query("suffix")
+	if port := c.Query("port"); port != "" {
+		p, err := strconv.ParseUint(port, 10, 16)
+		v.check(err == nil && p > 0, "port", "must be between 1 and 65535")
+		s.Port = uint16(p)
+	}
+	s.GroupBy = auditlog.Grouping(c.Query("group"))
+	v.check(contains(auditGroupings, s.GroupBy), "group", "must be empty, destination, client, hour or day")
+	s.SortBy = auditlog.SortKey(c.Query("sort"))
+	v.check(s.SortBy == "" || contains(auditSortKeys, s.SortBy), "sort", "must be recv, sent, connections or group")
+	s.Ascending = c.Query("order") == "asc"
+	s.Limit = c.QueryInt("limit", 100)
+	v.check(s.Limit > 0 && s.Limit <= auditlog.MaxSearchLimit, "limit", "must be between 1 and %d", auditlog.MaxSearchLimit)
+	s.Cursor = c.Query("cursor")
+	return s, ok, v.err()
+}
+
+// auditExport builds an export of the audit log from the account, client,
+// from, to and format query parameters.
+func auditExport(c *fiber.Ctx) (auditlog.Export, error) {
+	v := validation{}
+	var e auditlog.Export
+	var ok bool
+	e.Clients, ok = auditClientsQuery(c)
+	v.check(ok, "account", "has no clients")
+	e.Begin, e.End = auditRangeQuery(c, v)
+	e.Format = auditlog.Format(c.Query("format", string(auditlog.FormatCSV)))
+	v.check(e.Format == auditlog.FormatCSV || e.Format == auditlog.FormatParquet, "format", "must be csv or parquet")
+	return e, v.err()
+}
+
+// sendAuditExport writes the export to a temporary file first, so errors
+// are reported instead of sending a truncated file.
+func sendAuditExport(c *fiber.Ctx, e auditlog.Export) error {
+	f, err := os.CreateTemp("", "audit-export-*")
+	if err != nil {
+		return err
+	}
+	// the open file is read until the response is sent
+	os.Remove(f.Name())
+	if err := auditDB.Export(e, f); err != nil {
+		f.Close()
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.Attachment("audit-" + time.Now().Format("20060102-150405") + "." + string(e.Format))
+	if e.Format == auditlog.FormatCSV {
+		c.Set(fiber.HeaderContentType, "text/csv")
+	}
+	return c.SendStream(f, int(size))
+}
+
+func contains[T comparable](s []T, v T) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// auditClient names the client an address of the audit log belongs to.
+type auditClient struct {
+	ID          int
+	Name        string
+	AccountID   int
+	AccountName string
+}
+
+// auditClients returns all clients ever created by address.
+func auditClients() (map[string]auditClient, error) {
+	var clients []struct {
+		ID          int
+		Name        string
+		AccountID   int
+		AccountName string
+		IPAddress   string
+	}
+	ret := models.DB.Table("clients").
+		Select("clients.id, clients.name, clients.account_id, accounts.name AS account_name, clients.ip_address").
+		Joins("JOIN accounts ON accounts.id = clients.account_id").
+		Scan(&clients)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+	m := make(map[string]auditClient, len(clients))
+	for _, cli := range clients {
+		m[cli.IPAddress] = auditClient{cli.ID, cli.Name, cli.AccountID, cli.AccountName}
+	}
+	return m, nil
+}
+
+// validationMessage joins the field errors of a validation error for the
+// views.
+func validationMessage(err error) string {
+	ae, ok := err.(*apiError)
+	if !ok || len(ae.Fields) == 0 {
+		return err.Error()
+	}
+	var msgs []string
+	for f, m := range ae.Fields {
+		msgs = append(msgs, f+" "+m)
+	}
+	sort.Strings(msgs)
+	return strings.Join(msgs, ", ")
+}
+
+// auditRow is a row of the audit search page.
+type auditRow struct {
+	auditlog.SearchRow
+	// Owner is the client of the address, the zero value if unknown
+	Owner auditClient
+}
+
+func auditHandler(app *fiber.App) {
+	// search of the audit log
+	app.Get("/audit", requireRole(models.RoleAuditor), func(c *fiber.Ctx) error {
+		// the form is filled in with the query parameters
+		query := map[string]string{}
+		protocols := map[string]bool{}
+		c.Context().QueryArgs().VisitAll(func(k, v []byte) {
+			query[string(k)] = string(v)
+			if string(k) == "protocol" {
+				protocols[string(v)] = true
+			}
+		})
+		var accounts []models.Account
+		models.DB.Order("name").Find(&accounts)
+		data := fiber.Map{
+			"AuditEnabled": auditDB != nil,
+			"Accounts":     accounts,
+			"Groupings":    auditGroupings,
+			"SortKeys":     auditSortKeys,
+			"Protocols":    auditProtocols,
+			"Query":        query,
+			"Selected":     protocols,
+		}
+		if auditDB == nil {
+			return c.Render("audit", data)
+		}
+
+		s, ok, err := auditSearch(c)
+		if err != nil {
+			data["FlashError"] = validationMessage(err)
+			return c.Render("audit", data)
+		}
+		var result auditlog.SearchResult
+		if ok {
+			result, err = auditDB.Search(s)
+			if err != nil {
+				data["FlashError"] = err.Error()
+				return c.Render("audit", data)
+			}
+		}
+		clients, err := auditClients()
+		if err != nil {
+			return err
+		}
+		var rows []auditRow
+		for _, r := range result.Rows {
+			row := auditRow{SearchRow: r}
+			if r.Client != nil {
+				row.Owner = clients[r.Client.String()]
+			}
+			rows = append(rows, row)
+		}
+		data["Search"] = s
+		data["Rows"] = rows
+		if result.NextCursor != "" {
+			q, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+			q.Set("cursor", result.NextCursor)
+			data["Next"] = "/audit?" + q.Encode()
+		}
+		return c.Render("audit", data)
+	})
+
+	// download of the raw connections
+	app.Get("/audit/export", requireRole(models.RoleAuditor), func(c *fiber.Ctx) error {
+		if auditDB == nil {
+			return c.Redirect("/audit")
+		}
+		e, err := auditExport(c)
+		if err != nil {
+			flashError(c, validationMessage(err))
+			return c.Redirect("/audit?" + string(c.Request().URI().QueryString()))
+		}
+		return sendAuditExport(c, e)
+	})
+}
@@ -3,12 +3,10 @@ package auditlog
 import (
 	"context"
 	"database/sql"
-	"database/sql/driver"
-	"encoding/binary"
 	"errors"
-	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,48 +16,37 @@ import (
 
 var errFlush = errors.New("flush")
 
+// batchInterval is how often inserted entries are committed.
+var batchInterval = 30 * time.Second
+
+// ErrClosed is returned when inserting into a closed log.
+var ErrClosed = errors.New("audit log closed")
+
 type DB struct {
 	db            *sql.DB
 	prepareInsert *sql.Stmt
-	batch         chan<- func(*sql.Tx) error
-
-	mu           sync.Mutex
-	prepareQuery map[int]*sql.Stmt
-	prepareTotal map[int]*sql.Stmt
+	// batch is sent to with mu read locked and closed with mu locked, so
+	// it is never sent to after it is closed
+	mu     sync.RWMutex
+	closed bool
+	batch  chan<- func(*sql.Tx) error
+	// batcherDone is closed when the last batch is committed
+	batcherDone chan struct{}
+
+	done chan struct{}
 }
 
 func New(path string) (_ *DB, outErr error) {
-	connector, err := duckdb.NewConnector(path, func(db driver.ExecerContext) error {
-		// ignore error
-		_, _ = db.ExecContext(context.Background(), `CREATE TYPE PROTOCOL AS ENUM ('tcp', 'http', 'tls');`, nil)
-
-		_, err := db.ExecContext(context.Background(), `CREATE SEQUENCE IF NOT EXISTS seq_log_id;`, nil)
-		if err != nil {
-			return err
-		}
-
-		_, err = db.ExecContext(context.Background(), `CREATE TABLE IF NOT EXISTS log (
-			id INTEGER PRIMARY KEY,
-			local_addr UINTEGER,
-			local_port USMALLINT,
-			remote_addr UINTEGER,
-			remote_port USMALLINT,
-			sent_bytes LONG,
-			received_bytes LONG,
-			protocol PROTOCOL,
-			server_name TEXT,
-			created_at TIMESTAMP
-		)`, nil)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
+	connector, err := duckdb.NewConnector(path, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	db := sql.OpenDB(connector)
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 	prepareInsert, err := db.Prepare(
 		`INSERT INTO log (
 			id, local_addr, local_port, remote_addr, remote_port,
@@ -78,15 +65,67 @@ func New(path string) (_ *DB, outErr error) {
 		db:            db,
 		prepareInsert: prepareInsert,
 		batch:         ch,
+		batcherDone:   make(chan struct{}),
+		done:          make(chan struct{}),
 	}
 	go d.batcher(ch)
 	return d, nil
 }
 
+// Close commits the pending entries and closes the database. Entries inserted
+// concurrently are either committed or rejected with ErrClosed.
 func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	db.closed = true
+	close(db.done)
+	close(db.batch)
+	db.mu.Unlock()
+
+	<-db.batcherDone
 	return db.db.Close()
 }
 
+// send queues f to run in the current batch.
+func (db *DB) send(f func(*sql.Tx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.batch <- f
+	return nil
+}
+
+// addr returns an address as stored in the log, 16 bytes with IPv4
+// addresses mapped to IPv6. Invalid addresses are stored as 0.0.0.0.
+func addr(ip net.IP) []byte {
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16
+	}
+	return net.IPv4zero.To16()
+}
+
+// toIP returns a stored address, IPv4 addresses in their 4 byte form.
+func toIP(b []byte) net.IP {
+	ip := net.IP(b)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func addrArgs(ips []net.IP) []interface{} {
+	args := make([]interface{}, 0, len(ips))
+	for _, ip := range ips {
+		args = append(args, addr(ip))
+	}
+	return args
+}
+
 type Protocol string
 
 const (
@@ -106,29 +145,16 @@ func (db *DB) Insert(
 		return nil
 	}
 	if serverName == "" {
-		serverName = fmt.Sprintf("%s:%d", dst, dstPort)
-	}
-
-	tmp := src.To4()
-	if len(tmp) == 0 {
-		tmp = net.IPv4zero
+		serverName = net.JoinHostPort(dst.String(), strconv.Itoa(int(dstPort)))
 	}
-	srcIP := binary.BigEndian.Uint32(tmp)
 
-	tmp = dst.To4()
-	if len(tmp) == 0 {
-		tmp = net.IPv4zero
-	}
-	dstIP := binary.BigEndian.Uint32(tmp)
-
-	db.batch <- func(tx *sql.Tx) error {
+	return db.send(func(tx *sql.Tx) error {
 		_, err := tx.Stmt(db.prepareInsert).Exec(
-			srcIP, srcPort, dstIP, dstPort,
+			addr(src), srcPort, addr(dst), dstPort,
 			sentBytes, receivedBytes, protocol, serverName, startTime,
 		)
 		return err
-	}
-	return nil
+	})
 }
 
 type AccessLog struct {
@@ -137,41 +163,21 @@ type AccessLog struct {
 	Recv       uint64
 }
 
-func (db *DB) doPrepareQuery(cnt int, args []interface{}) (*sql.Rows, error) {
-	if cnt < 10 {
-		db.mu.Lock()
-		defer db.mu.Unlock()
-
-		if db.prepareQuery == nil {
-			db.prepareQuery = make(map[int]*sql.Stmt)
-		}
-
-		if s, ok := db.prepareQuery[cnt]; !ok {
-			stmt, err := db.db.Prepare(
-				`SELECT server_name, SUM(sent_bytes) as sent, SUM(received_bytes) as recv FROM log
-				WHERE local_addr IN ( ?` + strings.Repeat(",?", cnt-1) + ` ) AND created_at >= ?
-				GROUP BY (server_name)
-				ORDER BY recv DESC
-				LIMIT ?`,
-			)
-			if err != nil {
-				log.Fatalln("fail to prepare query", err)
-			}
-			db.prepareQuery[cnt] = stmt
-			return stmt.Query(args...)
-		} else {
-			return s.Query(args...)
-		}
-	}
-
-	return db.db.Query(
-		`SELECT server_name, SUM(sent_bytes) as sent, SUM(received_bytes) as recv FROM log
-		WHERE local_addr IN ( ?`+strings.Repeat(",?", cnt-1)+` ) AND created_at >= ?
+// querySQL returns the top destinations of cnt clients from the raw log and
+// the daily summaries. Summaries are included for every day overlapping the
+// time range.
+func querySQL(cnt int) string {
+	in := `local_addr IN ( ?` + strings.Repeat(",?", cnt-1) + ` )`
+	return `SELECT server_name, SUM(sent) as sent, SUM(recv) as recv FROM (
+			SELECT server_name, sent_bytes AS sent, received_bytes AS recv FROM log
+			WHERE ` + in + ` AND created_at >= ?
+			UNION ALL
+			SELECT server_name, sent_bytes AS sent, received_bytes AS recv FROM log_daily
+			WHERE ` + in + ` AND day >= CAST(? AS DATE)
+		)
 		GROUP BY (server_name)
 		ORDER BY recv DESC
-		LIMIT ?`,
-		args...,
-	)
+		LIMIT ?`
 }
 
 func (db *DB) Query(client []net.IP, begin time.Time, count int) ([]AccessLog, error) {
@@ -179,11 +185,11 @@ func (db *DB) Query(client []net.IP, begin time.Time, count int) ([]AccessLog, e
 		return nil, nil
 	}
 
-	args := make([]interface{}, 0, len(client)+2)
-	for _, c := range client {
-		args = append(args, binary.BigEndian.Uint32(c.To4()))
-	}
-	rows, err := db.doPrepareQuery(len(client), append(args, begin, count))
+	addrs := addrArgs(client)
+	args := make([]interface{}, 0, 2*len(client)+3)
+	args = append(append(args, addrs...), begin)
+	args = append(append(args, addrs...), begin, count)
+	rows, err := db.db.Query(querySQL(len(client)), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -201,35 +207,15 @@ func (db *DB) Query(client []net.IP, begin time.Time, count int) ([]AccessLog, e
 	return logs, rows.Err()
 }
 
-func (db *DB) doPrepareTotal(cnt int, args []interface{}) *sql.Row {
-	if cnt < 10 {
-		db.mu.Lock()
-		defer db.mu.Unlock()
-
-		if db.prepareTotal == nil {
-			db.prepareTotal = make(map[int]*sql.Stmt)
-		}
-
-		if s, ok := db.prepareTotal[cnt]; !ok {
-			stmt, err := db.db.Prepare(`
-				SELECT IFNULL(SUM(sent_bytes), 0) as sent, IFNULL(SUM(received_bytes), 0) as recv FROM log
-				WHERE local_addr IN ( ?` + strings.Repeat(",?", cnt-1) + ` )
-			`)
-			if err != nil {
-				log.Fatalln("fail to prepare total query", err)
-			}
-
-			db.prepareTotal[cnt] = stmt
-			return stmt.QueryRow(args...)
-		} else {
-			return s.QueryRow(args...)
-		}
-	}
-
-	return db.db.QueryRow(`
-		SELECT IFNULL(SUM(sent_bytes), 0) as sent, IFNULL(SUM(received_bytes), 0) as recv FROM log
-		WHERE local_addr IN ( ?`+strings.Repeat(",?", cnt-1)+` )
-	`, args...)
+// totalSQL returns the total traffic of cnt clients from the raw log and
+// the daily summaries.
+func totalSQL(cnt int) string {
+	in := `local_addr IN ( ?` + strings.Repeat(",?", cnt-1) + ` )`
+	return `SELECT IFNULL(SUM(sent), 0) as sent, IFNULL(SUM(recv), 0) as recv FROM (
+			SELECT sent_bytes AS sent, received_bytes AS recv FROM log WHERE ` + in + `
+			UNION ALL
+			SELECT sent_bytes AS sent, received_bytes AS recv FROM log_daily WHERE ` + in + `
+		)`
 }
 
 func (db *DB) Total(client []net.IP) (uint64, uint64, error) {
@@ -237,12 +223,10 @@ func (db *DB) Total(client []net.IP) (uint64, uint64, error) {
 		return 0, 0, nil
 	}
 
-	args := make([]interface{}, 0, len(client))
-	for _, c := range client {
-		args = append(args, binary.BigEndian.Uint32(c.To4()))
-	}
+	args := addrArgs(client)
+	args = append(args, args...)
 
-	row := db.doPrepareTotal(len(client), args)
+	row := db.db.QueryRow(totalSQL(len(client)), args...)
 
 	var sent, recv uint64
 	err := row.Scan(&sent, &recv)
@@ -261,15 +245,17 @@ func (db *DB) batcher(b <-chan func(*sql.Tx) error) {
 		if err := tx.Commit(); err != nil {
 			log.Println("fail to commit audit log", err)
 		}
+		close(db.batcherDone)
 	}()
 
-	const Tick = 30 * time.Second
-	timer := time.NewTimer(Tick)
+	timer := time.NewTimer(batchInterval)
 	for {
+		fired := false
 	batch:
 		for {
 			select {
 			case <-timer.C:
+				fired = true
 				break batch
 			case r, ok := <-b:
 				if !ok {
@@ -290,21 +276,26 @@ func (db *DB) batcher(b <-chan func(*sql.Tx) error) {
 		if err != nil {
 			log.Fatalln("fail to start transation", err)
 		}
-		if !timer.Stop() {
+		// the channel is already drained if the timer fired
+		if !fired && !timer.Stop() {
 			<-timer.C
 		}
-		timer.Reset(Tick)
+		timer.Reset(batchInterval)
 	}
 }
 
+// Flush commits the pending entries, it does nothing once the log is
+// closed.
 func (db *DB) Flush() {
-	db.batch <- func(tx *sql.Tx) error {
-		return errFlush
+	if db.send(func(tx *sql.Tx) error { return errFlush }) != nil {
+		return
 	}
 	done := make(chan struct{})
-	db.batch <- func(tx *sql.Tx) error {
+	if db.send(func(tx *sql.Tx) error {
 		close(done)
 		return nil
+	}) != nil {
+		return
 	}
 	<-done
 }
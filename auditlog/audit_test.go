@@ -1,11 +1,17 @@
 package auditlog
 
 import (
+	"bytes"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
 )
 
 func TestAuditLog(t *testing.T) {
@@ -36,6 +42,104 @@ func TestAuditLog(t *testing.T) {
 	assert.Equal(t, uint64(4950*2), r)
 }
 
+func TestClose(t *testing.T) {
+	db, err := New("")
+	assert.NoError(t, err)
+
+	insert := func() error {
+		return db.Insert(
+			net.ParseIP("127.0.0.1"), 48888,
+			net.ParseIP("1.2.3.4"), 80,
+			1, 2,
+			ProtocolTCP, "a",
+			time.Now(),
+		)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for insert() == nil {
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, db.Close())
+	wg.Wait()
+
+	assert.ErrorIs(t, insert(), ErrClosed)
+	assert.ErrorIs(t, db.Close(), ErrClosed)
+	db.Flush()
+}
+
+func TestCloseAfterTick(t *testing.T) {
+	defer func(d time.Duration) { batchInterval = d }(batchInterval)
+	batchInterval = 10 * time.Millisecond
+	db, err := New("")
+	assert.NoError(t, err)
+
+	// the batcher keeps running after committing on a tick
+	time.Sleep(5 * batchInterval)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, db.Insert(net.ParseIP("127.0.0.1"), 48888, net.ParseIP("1.2.3.4"), 80, 1, 2, ProtocolTCP, "a", time.Now()))
+		db.Flush()
+		assert.NoError(t, db.Close())
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("audit log hangs after a tick")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	db, err := New("")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	now := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+	client := []net.IP{net.ParseIP("127.0.0.1")}
+	for _, age := range []time.Duration{0, 10 * 24 * time.Hour, 10*24*time.Hour + time.Minute, 100 * 24 * time.Hour} {
+		err = db.Insert(
+			client[0], 48888,
+			net.ParseIP("1.2.3.4"), 80,
+			1, 2,
+			ProtocolTCP, "a",
+			now.Add(-age),
+		)
+		assert.NoError(t, err)
+	}
+	db.Flush()
+
+	assert.NoError(t, db.Compact(Retention{RawDays: 7, SummaryMonths: 12}, now))
+
+	var raw, daily int
+	assert.NoError(t, db.db.QueryRow(`SELECT COUNT(*) FROM log`).Scan(&raw))
+	assert.NoError(t, db.db.QueryRow(`SELECT COUNT(*) FROM log_daily`).Scan(&daily))
+	assert.Equal(t, 1, raw)
+	assert.Equal(t, 2, daily)
+
+	// both tiers are read
+	s, r, err := db.Total(client)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), s)
+	assert.Equal(t, uint64(8), r)
+
+	l, err := db.Query(client, now.Add(-11*24*time.Hour), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []AccessLog{{"a", 3, 6}}, l)
+
+	// summaries expire
+	assert.NoError(t, db.Compact(Retention{RawDays: 7, SummaryMonths: 2}, now))
+	s, r, err = db.Total(client)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), s)
+	assert.Equal(t, uint64(6), r)
+}
+
 func BenchmarkAuditLog(b *testing.B) {
 	db, err := New("")
 	if err != nil {
@@ -77,3 +181,240 @@ func BenchmarkQuery(b *testing.B) {
 		db.Query([]net.IP{net.ParseIP("127.0.0.1")}, time.Now().Add(-time.Hour), 1000)
 	}
 }
+
+func TestSearch(t *testing.T) {
+	db, err := New("")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	now := time.Date(2023, 6, 15, 12, 30, 0, 0, time.UTC)
+	a, b := net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4()
+	for i, e := range []struct {
+		client net.IP
+		port   uint16
+		proto  Protocol
+		server string
+		age    time.Duration
+	}{
+		{a, 443, ProtocolTLS, "www.example.com", 0},
+		{a, 443, ProtocolTLS, "api.example.com", time.Hour},
+		{a, 80, ProtocolHTTP, "example.org", 2 * time.Hour},
+		{b, 443, ProtocolTLS, "www.example.com", 3 * time.Hour},
+		{b, 22, ProtocolTCP, "", 20 * 24 * time.Hour},
+	} {
+		err = db.Insert(e.client, 40000, net.ParseIP("1.2.3.4"), e.port, uint64(i+1), uint64(10*(i+1)), e.proto, e.server, now.Add(-e.age))
+		assert.NoError(t, err)
+	}
+	db.Flush()
+	assert.NoError(t, db.Compact(Retention{RawDays: 7}, now))
+
+	// connections, newest first
+	r, err := db.Search(Search{})
+	assert.NoError(t, err)
+	assert.Len(t, r.Rows, 4)
+	assert.Equal(t, SearchRow{now, a, "www.example.com", ProtocolTLS, 443, 1, 1, 10}, r.Rows[0])
+	assert.Empty(t, r.NextCursor)
+
+	// filters
+	r, err = db.Search(Search{Clients: []net.IP{a}, DestinationSuffix: ".example.com", Protocols: []Protocol{ProtocolTLS}})
+	assert.NoError(t, err)
+	assert.Len(t, r.Rows, 2)
+	r, err = db.Search(Search{Destination: "EXAMPLE", Port: 80})
+	assert.NoError(t, err)
+	assert.Len(t, r.Rows, 1)
+	assert.Equal(t, "example.org", r.Rows[0].ServerName)
+	r, err = db.Search(Search{Begin: now.Add(-90 * time.Minute), End: now})
+	assert.NoError(t, err)
+	assert.Len(t, r.Rows, 1)
+
+	// groups include the summaries
+	r, err = db.Search(Search{GroupBy: GroupDestination})
+	assert.NoError(t, err)
+	assert.Equal(t, []SearchRow{
+		{ServerName: "1.2.3.4:22", Connections: 1, Sent: 5, Recv: 50},
+		{ServerName: "www.example.com", Connections: 2, Sent: 5, Recv: 50},
+		{ServerName: "example.org", Connections: 1, Sent: 3, Recv: 30},
+		{ServerName: "api.example.com", Connections: 1, Sent: 2, Recv: 20},
+	}, r.Rows)
+	r, err = db.Search(Search{GroupBy: GroupClient, SortBy: SortConnections, Ascending: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []SearchRow{
+		{Client: b, Connections: 2, Sent: 9, Recv: 90},
+		{Client: a, Connections: 3, Sent: 6, Recv: 60},
+	}, r.Rows)
+	r, err = db.Search(Search{GroupBy: GroupHour})
+	assert.NoError(t, err)
+	assert.Len(t, r.Rows, 4)
+	assert.Equal(t, now.Truncate(time.Hour), r.Rows[0].Time)
+	r, err = db.Search(Search{GroupBy: GroupDay, Ascending: true})
+	assert.NoError(t, err)
+	assert.Len(t, r.Rows, 2)
+	assert.Equal(t, uint64(1), r.Rows[0].Connections)
+
+	// pages continue after ties
+	var pages [][]SearchRow
+	s := Search{GroupBy: GroupDestination, Limit: 1}
+	for {
+		r, err = db.Search(s)
+		assert.NoError(t, err)
+		pages = append(pages, r.Rows)
+		if r.NextCursor == "" {
+			break
+		}
+		s.Cursor = r.NextCursor
+	}
+	assert.Len(t, pages, 4)
+	assert.Equal(t, "www.example.com", pages[1][0].ServerName)
+
+	_, err = db.Search(Search{Cursor: "x"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestExport(t *testing.T) {
+	db, err := New("")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	now := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+	for i, e := range []struct {
+		client net.IP
+		age    time.Duration
+	}{
+		{net.ParseIP("10.0.0.1"), time.Hour},
+		{net.ParseIP("10.0.0.2"), 2 * time.Hour},
+		{net.ParseIP("10.0.0.1"), 3 * time.Hour},
+		{net.ParseIP("10.0.0.1"), 48 * time.Hour},
+	} {
+		err = db.Insert(e.client, 40000, net.ParseIP("1.2.3.4"), 443, uint64(i+1), uint64(10*(i+1)), ProtocolTLS, "example.com", now.Add(-e.age))
+		assert.NoError(t, err)
+	}
+	db.Flush()
+
+	var buf bytes.Buffer
+	err = db.Export(Export{
+		Clients: []net.IP{net.ParseIP("10.0.0.1")},
+		Begin:   now.Add(-24 * time.Hour),
+		End:     now,
+		Format:  FormatCSV,
+	}, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"time,client_addr,client_port,remote_addr,remote_port,protocol,server_name,sent_bytes,received_bytes",
+		"2023-06-15T09:00:00Z,10.0.0.1,40000,1.2.3.4,443,tls,example.com,3,30",
+		"2023-06-15T11:00:00Z,10.0.0.1,40000,1.2.3.4,443,tls,example.com,1,10",
+	}, strings.Split(strings.TrimSpace(buf.String()), "\n"))
+
+	buf.Reset()
+	assert.NoError(t, db.Export(Export{Format: FormatParquet}, &buf))
+	pf, err := buffer.NewBufferFile(buf.Bytes())
+	assert.NoError(t, err)
+	pr, err := reader.NewParquetReader(pf, new(exportRow), 1)
+	assert.NoError(t, err)
+	rows := make([]exportRow, pr.GetNumRows())
+	assert.NoError(t, pr.Read(&rows))
+	pr.ReadStop()
+	assert.Len(t, rows, 4)
+	assert.Equal(t, exportRow{
+		Time:          now.Add(-48 * time.Hour).UnixMicro(),
+		ClientAddr:    "10.0.0.1",
+		ClientPort:    40000,
+		RemoteAddr:    "1.2.3.4",
+		RemotePort:    443,
+		Protocol:      "tls",
+		ServerName:    "example.com",
+		SentBytes:     4,
+		ReceivedBytes: 40,
+	}, rows[0])
+
+	assert.Error(t, db.Export(Export{Format: "xml"}, &buf))
+}
+
+func TestExportDaily(t *testing.T) {
+	db, err := New("")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	now := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+	// the connection ten days ago is beyond Keep and not caught up
+	for _, age := range []time.Duration{0, 24 * time.Hour, 36 * time.Hour, 48 * time.Hour, 240 * time.Hour} {
+		err = db.Insert(net.ParseIP("10.0.0.1"), 40000, net.ParseIP("1.2.3.4"), 443, 1, 2, ProtocolTCP, "a", now.Add(-age))
+		assert.NoError(t, err)
+	}
+	db.Flush()
+
+	dir := t.TempDir()
+	for _, name := range []string{"audit-2023-06-10.csv", "audit-2023-06-11.csv", "audit-2023-06-12.csv", "audit-2023-06-01.parquet"} {
+		assert.NoError(t, os.WriteFile(dir+"/"+name, nil, 0o644))
+	}
+	s := ExportSchedule{Dir: dir, Format: FormatCSV, Keep: 3}
+	assert.NoError(t, db.ExportDaily(s, now))
+
+	b, err := os.ReadFile(dir + "/audit-2023-06-14.csv")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(b), "\n"), "header and two connections")
+	// missed days are caught up
+	b, err = os.ReadFile(dir + "/audit-2023-06-13.csv")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(b), "\n"), "header and one connection")
+
+	var names []string
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"audit-2023-06-01.parquet", "audit-2023-06-12.csv", "audit-2023-06-13.csv", "audit-2023-06-14.csv"}, names)
+
+	// an existing export is not replaced
+	assert.NoError(t, os.WriteFile(dir+"/audit-2023-06-14.csv", nil, 0o644))
+	assert.NoError(t, db.ExportDaily(s, now.Add(time.Hour)))
+	b, err = os.ReadFile(dir + "/audit-2023-06-14.csv")
+	assert.NoError(t, err)
+	assert.Empty(t, b)
+}
+
+func TestIPv6(t *testing.T) {
+	db, err := New("")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	now := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+	v4, v6 := net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")
+	assert.NoError(t, db.Insert(v6, 40000, net.ParseIP("2001:db8::1"), 443, 1, 10, ProtocolTLS, "", now))
+	assert.NoError(t, db.Insert(v6, 40000, net.ParseIP("1.2.3.4"), 443, 2, 20, ProtocolTLS, "a", now))
+	assert.NoError(t, db.Insert(v4, 40000, net.ParseIP("1.2.3.4"), 443, 4, 40, ProtocolTLS, "a", now))
+	db.Flush()
+
+	l, err := db.Query([]net.IP{v6}, now.Add(-time.Hour), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []AccessLog{{"a", 2, 20}, {"[2001:db8::1]:443", 1, 10}}, l)
+
+	s, r, err := db.Total([]net.IP{v4, v6})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), s)
+	assert.Equal(t, uint64(70), r)
+
+	// pages of one client each, the cursor holds the address
+	var clients []string
+	search := Search{GroupBy: GroupClient, SortBy: SortGroup, Ascending: true, Limit: 1}
+	for {
+		res, err := db.Search(search)
+		assert.NoError(t, err)
+		for _, row := range res.Rows {
+			clients = append(clients, row.Client.String())
+		}
+		if res.NextCursor == "" {
+			break
+		}
+		search.Cursor = res.NextCursor
+	}
+	assert.Equal(t, []string{"10.0.0.1", "fd00::1"}, clients, "IPv4 addresses are mapped to ::ffff:0:0/96")
+
+	var buf bytes.Buffer
+	assert.NoError(t, db.Export(Export{Clients: []net.IP{v6}, Format: FormatCSV}, &buf))
+	assert.Equal(t, []string{
+		"time,client_addr,client_port,remote_addr,remote_port,protocol,server_name,sent_bytes,received_bytes",
+		"2023-06-15T12:00:00Z,fd00::1,40000,2001:db8::1,443,tls,[2001:db8::1]:443,1,10",
+		"2023-06-15T12:00:00Z,fd00::1,40000,1.2.3.4,443,tls,a,2,20",
+	}, strings.Split(strings.TrimSpace(buf.String()), "\n"))
+}
@@ -0,0 +1,234 @@
+package auditlog
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Format is the file format of an export.
+type Format string
+
+const (
+	FormatParquet Format = "parquet"
+	FormatCSV     Format = "csv"
+)
+
+// Export selects the connections of the raw log to export, connections
+// already rolled up into daily summaries are not exported.
+type Export struct {
+	// Clients limits the export to connections from these addresses, all
+	// clients if empty.
+	Clients []net.IP
+	// Begin and End limit the start time of the connections, End is
+	// exclusive. Zero times are unbounded.
+	Begin  time.Time
+	End    time.Time
+	Format Format
+}
+
+// exportRow is a connection in an export, the CSV header has the names of
+// the parquet columns.
+type exportRow struct {
+	Time          int64  `parquet:"name=time, type=INT64, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MICROS"`
+	ClientAddr    string `parquet:"name=client_addr, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ClientPort    int32  `parquet:"name=client_port, type=INT32, convertedtype=UINT_16"`
+	RemoteAddr    string `parquet:"name=remote_addr, type=BYTE_ARRAY, convertedtype=UTF8"`
+	RemotePort    int32  `parquet:"name=remote_port, type=INT32, convertedtype=UINT_16"`
+	Protocol      string `parquet:"name=protocol, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ServerName    string `parquet:"name=server_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SentBytes     int64  `parquet:"name=sent_bytes, type=INT64"`
+	ReceivedBytes int64  `parquet:"name=received_bytes, type=INT64"`
+}
+
+var exportHeader = []string{"time", "client_addr", "client_port", "remote_addr", "remote_port", "protocol", "server_name", "sent_bytes", "received_bytes"}
+
+// Export writes the connections selected by e to w, oldest first.
+func (db *DB) Export(e Export, w io.Writer) error {
+	var write func(*exportRow) error
+	var flush func() error
+	switch e.Format {
+	case FormatParquet:
+		pw, err := writer.NewParquetWriterFromWriter(w, new(exportRow), 1)
+		if err != nil {
+			return err
+		}
+		write = func(r *exportRow) error { return pw.Write(r) }
+		flush = pw.WriteStop
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportHeader); err != nil {
+			return err
+		}
+		write = func(r *exportRow) error {
+			return cw.Write([]string{
+				time.UnixMicro(r.Time).UTC().Format(time.RFC3339Nano),
+				r.ClientAddr, strconv.Itoa(int(r.ClientPort)),
+				r.RemoteAddr, strconv.Itoa(int(r.RemotePort)),
+				r.Protocol, r.ServerName,
+				strconv.FormatInt(r.SentBytes, 10), strconv.FormatInt(r.ReceivedBytes, 10),
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return fmt.Errorf("unknown export format %q", e.Format)
+	}
+
+	var conds []string
+	var args []interface{}
+	if len(e.Clients) > 0 {
+		args = addrArgs(e.Clients)
+		conds = append(conds, "local_addr IN ( ?"+strings.Repeat(",?", len(e.Clients)-1)+" )")
+	}
+	if !e.Begin.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, e.Begin.UTC())
+	}
+	if !e.End.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, e.End.UTC())
+	}
+	r, err := db.db.Query(`SELECT created_at, local_addr, local_port, remote_addr, remote_port,
+			CAST(protocol AS VARCHAR), server_name, sent_bytes, received_bytes
+		FROM log`+whereClause(conds)+` ORDER BY created_at, id`, args...)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var (
+			row           exportRow
+			t             time.Time
+			local, remote []byte
+		)
+		if err := r.Scan(&t, &local, &row.ClientPort, &remote, &row.RemotePort,
+			&row.Protocol, &row.ServerName, &row.SentBytes, &row.ReceivedBytes); err != nil {
+			return err
+		}
+		row.Time = t.UnixMicro()
+		row.ClientAddr = toIP(local).String()
+		row.RemoteAddr = toIP(remote).String()
+		if err := write(&row); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// ExportSchedule configures the daily export of the log to Dir, one file
+// per day in UTC named audit-YYYY-MM-DD.<format>. The newest Keep files are
+// kept, all if zero.
+type ExportSchedule struct {
+	Dir    string
+	Format Format
+	Keep   int
+}
+
+// StartExport exports the previous days according to s now and then every
+// CompactInterval until the database is closed. Days already exported are
+// skipped, so a day is exported once in the first run after midnight.
+func (db *DB) StartExport(s ExportSchedule) {
+	go func() {
+		t := time.NewTicker(CompactInterval)
+		defer t.Stop()
+		for {
+			if err := db.ExportDaily(s, time.Now()); err != nil {
+				log.Println("fail to export audit log", err)
+			}
+			select {
+			case <-db.done:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// ExportDaily exports the days before now that have not been exported yet
+// and removes the oldest exports beyond s.Keep. Days missed while the server
+// was down are caught up, starting at the oldest connection of the raw log
+// but at most s.Keep days back; the day before now is always exported.
+func (db *DB) ExportDaily(s ExportSchedule, now time.Time) error {
+	if err := os.MkdirAll(s.Dir, 0o750); err != nil {
+		return err
+	}
+	today := now.UTC().Truncate(24 * time.Hour)
+	start := today.AddDate(0, 0, -1)
+	var oldest sql.NullTime
+	if err := db.db.QueryRow(`SELECT MIN(created_at) FROM log`).Scan(&oldest); err != nil {
+		return err
+	}
+	if oldest.Valid && oldest.Time.Before(start) {
+		start = oldest.Time.UTC().Truncate(24 * time.Hour)
+	}
+	if s.Keep > 0 && start.Before(today.AddDate(0, 0, -s.Keep)) {
+		start = today.AddDate(0, 0, -s.Keep)
+	}
+	for day := start; day.Before(today); day = day.AddDate(0, 0, 1) {
+		if err := db.exportDay(s, day); err != nil {
+			return err
+		}
+	}
+
+	if s.Keep <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(s.Dir, "audit-*."+string(s.Format)))
+	if err != nil {
+		return err
+	}
+	// the dates in the names sort chronologically
+	sort.Strings(files)
+	for len(files) > s.Keep {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// exportDay exports day to s.Dir unless it has been exported already.
+func (db *DB) exportDay(s ExportSchedule, day time.Time) error {
+	path := filepath.Join(s.Dir, "audit-"+day.Format("2006-01-02")+"."+string(s.Format))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return err
+	}
+	// exported under a temporary name so a partial file is never picked up
+	tmp := filepath.Join(s.Dir, ".audit-"+day.Format("2006-01-02")+".tmp")
+	if err := db.exportFile(Export{Begin: day, End: day.AddDate(0, 0, 1), Format: s.Format}, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (db *DB) exportFile(e Export, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := db.Export(e, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,170 @@
+package auditlog
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations upgrade the schema one version at a time, migrations[i]
+// upgrading version i to i+1. Released migrations must never change, new
+// ones are appended.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: connections with IPv4 addresses
+	execAll(
+		`CREATE TYPE PROTOCOL AS ENUM ('tcp', 'http', 'tls')`,
+		`CREATE SEQUENCE seq_log_id`,
+		`CREATE TABLE log (
+			id INTEGER PRIMARY KEY,
+			local_addr UINTEGER,
+			local_port USMALLINT,
+			remote_addr UINTEGER,
+			remote_port USMALLINT,
+			sent_bytes LONG,
+			received_bytes LONG,
+			protocol PROTOCOL,
+			server_name TEXT,
+			created_at TIMESTAMP
+		)`,
+	),
+	// 2: rows of log past the raw retention rolled up by day, a day may
+	// have several rows for the same client and destination if late
+	// entries were compacted separately
+	execAll(
+		`CREATE TABLE log_daily (
+			day DATE,
+			local_addr UINTEGER,
+			server_name TEXT,
+			protocol PROTOCOL,
+			connections LONG,
+			sent_bytes LONG,
+			received_bytes LONG
+		)`,
+	),
+	// 3: addresses of both families as 16 bytes, IPv4 mapped to IPv6
+	execAll(
+		`CREATE TABLE log_v6 (
+			id INTEGER PRIMARY KEY,
+			local_addr BLOB,
+			local_port USMALLINT,
+			remote_addr BLOB,
+			remote_port USMALLINT,
+			sent_bytes LONG,
+			received_bytes LONG,
+			protocol PROTOCOL,
+			server_name TEXT,
+			created_at TIMESTAMP
+		)`,
+		`INSERT INTO log_v6 SELECT id, `+ipv4ToAddr("local_addr")+`, local_port, `+ipv4ToAddr("remote_addr")+`, remote_port,
+			sent_bytes, received_bytes, protocol, server_name, created_at
+		FROM log`,
+		`DROP TABLE log`,
+		`ALTER TABLE log_v6 RENAME TO log`,
+		`CREATE TABLE log_daily_v6 (
+			day DATE,
+			local_addr BLOB,
+			server_name TEXT,
+			protocol PROTOCOL,
+			connections LONG,
+			sent_bytes LONG,
+			received_bytes LONG
+		)`,
+		`INSERT INTO log_daily_v6 SELECT day, `+ipv4ToAddr("local_addr")+`, server_name, protocol,
+			connections, sent_bytes, received_bytes
+		FROM log_daily`,
+		`DROP TABLE log_daily`,
+		`ALTER TABLE log_daily_v6 RENAME TO log_daily`,
+	),
+}
+
+func execAll(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ipv4ToAddr returns the SQL converting a UINTEGER IPv4 address column to
+// the 16 byte form, using the escapes of BLOB literals.
+func ipv4ToAddr(col string) string {
+	return fmt.Sprintf(`CAST('\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xFF\xFF' ||
+		printf('\x%%02X\x%%02X\x%%02X\x%%02X', %[1]s >> 24, (%[1]s >> 16) & 255, (%[1]s >> 8) & 255, %[1]s & 255) AS BLOB)`, col)
+}
+
+// migrate upgrades the schema to the latest version, each migration in its
+// own transaction.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	var version int
+	err = db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		if version, err = legacyVersion(db); err != nil {
+			return err
+		}
+		_, err = db.Exec(`INSERT INTO schema_version VALUES (?)`, version)
+	}
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("audit log schema version %d is newer than the supported version %d", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := migrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating audit log to schema version %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(`UPDATE schema_version SET version = ?`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyVersion returns the schema version of a database created before
+// versions were recorded, from the tables and columns it has.
+func legacyVersion(db *sql.DB) (int, error) {
+	columns := make(map[string]string)
+	r, err := db.Query(`SELECT table_name || '.' || column_name, data_type FROM information_schema.columns
+		WHERE table_name IN ('log', 'log_daily')`)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	for r.Next() {
+		var column, dataType string
+		if err := r.Scan(&column, &dataType); err != nil {
+			return 0, err
+		}
+		columns[column] = dataType
+	}
+	if err := r.Err(); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case columns["log.local_addr"] == "":
+		return 0, nil
+	case columns["log_daily.local_addr"] == "":
+		return 1, nil
+	case columns["log.local_addr"] == "UINTEGER":
+		return 2, nil
+	default:
+		return 3, nil
+	}
+}
@@ -0,0 +1,103 @@
+package auditlog
+
+import (
+	"bytes"
+	"database/sql"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// legacy schemas created before versions were recorded
+var (
+	legacyLog = []string{
+		`CREATE TYPE PROTOCOL AS ENUM ('tcp', 'http', 'tls')`,
+		`CREATE SEQUENCE IF NOT EXISTS seq_log_id`,
+		`CREATE TABLE IF NOT EXISTS log (id INTEGER PRIMARY KEY, local_addr UINTEGER, local_port USMALLINT,
+			remote_addr UINTEGER, remote_port USMALLINT, sent_bytes LONG, received_bytes LONG,
+			protocol PROTOCOL, server_name TEXT, created_at TIMESTAMP)`,
+		// 10.0.0.1 to 1.2.3.4 and 255.255.255.254
+		`INSERT INTO log VALUES (nextval('seq_log_id'), 167772161, 40000, 16909060, 443, 1, 10, 'tls', 'a', TIMESTAMP '2023-06-15 12:00:00')`,
+		`INSERT INTO log VALUES (nextval('seq_log_id'), 167772161, 40000, 4294967294, 80, 2, 20, 'http', 'b', TIMESTAMP '2023-06-15 13:00:00')`,
+	}
+	legacyDaily = []string{
+		`CREATE TABLE IF NOT EXISTS log_daily (day DATE, local_addr UINTEGER, server_name TEXT, protocol PROTOCOL,
+			connections LONG, sent_bytes LONG, received_bytes LONG)`,
+		`INSERT INTO log_daily VALUES (DATE '2023-06-01', 167772161, 'a', 'tls', 3, 4, 40)`,
+	}
+)
+
+func execFile(t *testing.T, path string, stmts ...string) {
+	db, err := sql.Open("duckdb", path)
+	assert.NoError(t, err)
+	defer db.Close()
+	for _, stmt := range stmts {
+		_, err := db.Exec(stmt)
+		assert.NoError(t, err, stmt)
+	}
+}
+
+func schemaVersion(t *testing.T, db *DB) int {
+	var version int
+	assert.NoError(t, db.db.QueryRow(`SELECT version FROM schema_version`).Scan(&version))
+	return version
+}
+
+func TestMigrate(t *testing.T) {
+	path := t.TempDir() + "/audit.db"
+	db, err := New(path)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), schemaVersion(t, db))
+	assert.NoError(t, db.Close())
+
+	db, err = New(path)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), schemaVersion(t, db))
+	assert.NoError(t, db.Close())
+
+	execFile(t, path, `UPDATE schema_version SET version = 99`)
+	_, err = New(path)
+	assert.ErrorContains(t, err, "schema version 99 is newer")
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		stmts []string
+		sent  uint64
+	}{
+		{"log", legacyLog, 3},
+		{"daily summaries", append(append([]string{}, legacyLog...), legacyDaily...), 7},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir() + "/audit.db"
+			execFile(t, path, tt.stmts...)
+
+			db, err := New(path)
+			assert.NoError(t, err)
+			defer db.Close()
+			assert.Equal(t, len(migrations), schemaVersion(t, db))
+
+			client := []net.IP{net.ParseIP("10.0.0.1")}
+			s, _, err := db.Total(client)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.sent, s)
+
+			// the sequence continues after the migrated rows
+			err = db.Insert(client[0], 40000, net.ParseIP("2001:db8::1"), 443, 8, 80, ProtocolTLS, "c", time.Date(2023, 6, 15, 14, 0, 0, 0, time.UTC))
+			assert.NoError(t, err)
+			db.Flush()
+			var buf bytes.Buffer
+			assert.NoError(t, db.Export(Export{Format: FormatCSV}, &buf))
+			assert.Equal(t, []string{
+				"time,client_addr,client_port,remote_addr,remote_port,protocol,server_name,sent_bytes,received_bytes",
+				"2023-06-15T12:00:00Z,10.0.0.1,40000,1.2.3.4,443,tls,a,1,10",
+				"2023-06-15T13:00:00Z,10.0.0.1,40000,255.255.255.254,80,http,b,2,20",
+				"2023-06-15T14:00:00Z,10.0.0.1,40000,2001:db8::1,443,tls,c,8,80",
+			}, strings.Split(strings.TrimSpace(buf.String()), "\n"))
+		})
+	}
+}
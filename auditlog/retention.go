@@ -0,0 +1,74 @@
+package auditlog
+
+import (
+	"log"
+	"time"
+)
+
+// Retention configures how long the audit log is kept. Connections are kept
+// as logged for RawDays, then rolled up into daily summaries per client and
+// destination which are kept for SummaryMonths. Zero keeps the tier forever.
+type Retention struct {
+	RawDays       int
+	SummaryMonths int
+}
+
+// CompactInterval is how often the retention job runs.
+const CompactInterval = time.Hour
+
+// StartRetention compacts the log according to r now and then every
+// CompactInterval until the database is closed.
+func (db *DB) StartRetention(r Retention) {
+	go func() {
+		t := time.NewTicker(CompactInterval)
+		defer t.Stop()
+		for {
+			if err := db.Compact(r, time.Now()); err != nil {
+				log.Println("fail to compact audit log", err)
+			}
+			select {
+			case <-db.done:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// Compact rolls up the connections older than the raw retention into daily
+// summaries and deletes the summaries older than the summary retention.
+// Retention is counted in whole days in UTC.
+func (db *DB) Compact(r Retention, now time.Time) error {
+	today := now.UTC().Truncate(24 * time.Hour)
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if r.RawDays > 0 {
+		cutoff := today.AddDate(0, 0, -r.RawDays)
+		_, err = tx.Exec(`INSERT INTO log_daily
+			SELECT CAST(created_at AS DATE), local_addr, server_name, protocol,
+				COUNT(*), SUM(sent_bytes), SUM(received_bytes)
+			FROM log
+			WHERE created_at < ?
+			GROUP BY ALL`, cutoff)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`DELETE FROM log WHERE created_at < ?`, cutoff); err != nil {
+			return err
+		}
+	}
+
+	if r.SummaryMonths > 0 {
+		cutoff := today.AddDate(0, -r.SummaryMonths, 0)
+		if _, err = tx.Exec(`DELETE FROM log_daily WHERE day < CAST(? AS DATE)`, cutoff); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,343 @@
+package auditlog
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Grouping is how Search aggregates connections.
+type Grouping string
+
+const (
+	// GroupNone lists the individual connections.
+	GroupNone        Grouping = ""
+	GroupDestination Grouping = "destination"
+	GroupClient      Grouping = "client"
+	GroupHour        Grouping = "hour"
+	GroupDay         Grouping = "day"
+)
+
+// SortKey is the column Search orders results by.
+type SortKey string
+
+const (
+	SortRecv        SortKey = "recv"
+	SortSent        SortKey = "sent"
+	SortConnections SortKey = "connections"
+	// SortGroup orders by the grouping: the destination name, the client
+	// address or the time.
+	SortGroup SortKey = "group"
+)
+
+// MaxSearchLimit is the largest page Search returns.
+const MaxSearchLimit = 1000
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Search selects and aggregates connections of the audit log. The zero
+// value lists the most recent connections of all clients.
+//
+// The daily summaries have neither ports nor connection times, searches
+// filtering by port or listing connections or hours read the raw log only.
+type Search struct {
+	// Clients limits the search to connections from these addresses, all
+	// clients if empty.
+	Clients []net.IP
+	// Begin and End limit the start time of the connections, End is
+	// exclusive. Summaries are included for every day overlapping the
+	// range. Zero times are unbounded.
+	Begin time.Time
+	End   time.Time
+	// Protocols limits the search to these protocols, all if empty.
+	Protocols []Protocol
+	// Destination matches server names containing it, ignoring case.
+	Destination string
+	// DestinationSuffix matches server names ending with it.
+	DestinationSuffix string
+	// Port is the destination port, any port if 0.
+	Port uint16
+
+	GroupBy Grouping
+	// SortBy defaults to SortRecv for groups and SortGroup for
+	// connections. Descending unless Ascending.
+	SortBy    SortKey
+	Ascending bool
+	// Limit defaults to 100 and is capped at MaxSearchLimit.
+	Limit int
+	// Cursor continues the search after the last row of a previous page.
+	Cursor string
+}
+
+// SearchRow is a connection or a group of connections. The fields not
+// applicable to the grouping are zero.
+type SearchRow struct {
+	// Time is the start of the connection, hour or day.
+	Time       time.Time
+	Client     net.IP
+	ServerName string
+	Protocol   Protocol
+	Port       uint16
+
+	Connections uint64
+	Sent        uint64
+	Recv        uint64
+}
+
+type SearchResult struct {
+	Rows []SearchRow
+	// NextCursor continues the search, empty on the last page.
+	NextCursor string
+}
+
+// grouping describes the SQL of a grouping. Results are ordered by the sort
+// expression and then by tie, which is unique within the results.
+type grouping struct {
+	selects string
+	// columns are the searchColumns in the results
+	columns  []string
+	groupBy  string
+	key      string
+	keyType  string
+	tie      string
+	tieType  string
+	rawOnly  bool
+	defaults SortKey
+}
+
+var groupings = map[Grouping]grouping{
+	GroupNone: {
+		selects:  "id, time, local_addr, remote_port, protocol, server_name, connections, sent, recv",
+		columns:  searchColumns,
+		key:      "time",
+		keyType:  "TIMESTAMP",
+		tie:      "id",
+		tieType:  "BIGINT",
+		rawOnly:  true,
+		defaults: SortGroup,
+	},
+	GroupDestination: {
+		selects:  "server_name",
+		columns:  []string{"server_name"},
+		groupBy:  "server_name",
+		key:      "server_name",
+		keyType:  "VARCHAR",
+		defaults: SortRecv,
+	},
+	GroupClient: {
+		selects:  "local_addr",
+		columns:  []string{"local_addr"},
+		groupBy:  "local_addr",
+		key:      "local_addr",
+		keyType:  "BLOB",
+		defaults: SortRecv,
+	},
+	GroupHour: {
+		selects:  "date_trunc('hour', time) AS time",
+		columns:  []string{"time"},
+		groupBy:  "date_trunc('hour', time)",
+		key:      "time",
+		keyType:  "TIMESTAMP",
+		rawOnly:  true,
+		defaults: SortGroup,
+	},
+	GroupDay: {
+		selects:  "date_trunc('day', time) AS time",
+		columns:  []string{"time"},
+		groupBy:  "date_trunc('day', time)",
+		key:      "time",
+		keyType:  "TIMESTAMP",
+		defaults: SortGroup,
+	},
+}
+
+// searchColumns are selected from every grouping, missing ones as NULL.
+var searchColumns = []string{"time", "local_addr", "remote_port", "protocol", "server_name"}
+
+type cursor struct {
+	Sort string `json:"s"`
+	Tie  string `json:"t"`
+}
+
+func (db *DB) Search(s Search) (SearchResult, error) {
+	g, ok := groupings[s.GroupBy]
+	if !ok {
+		return SearchResult{}, fmt.Errorf("unknown grouping %q", s.GroupBy)
+	}
+	if g.tie == "" {
+		g.tie, g.tieType = g.key, g.keyType
+	}
+	sortBy := s.SortBy
+	if sortBy == "" {
+		sortBy = g.defaults
+	}
+	var sortExpr, sortType string
+	switch sortBy {
+	case SortRecv, SortSent, SortConnections:
+		sortExpr, sortType = string(sortBy), "HUGEINT"
+	case SortGroup:
+		sortExpr, sortType = g.key, g.keyType
+	default:
+		return SearchResult{}, fmt.Errorf("unknown sort key %q", sortBy)
+	}
+	limit := s.Limit
+	if limit <= 0 {
+		limit = 100
+	} else if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+
+	var raw, daily []string
+	var rawArgs, dailyArgs []interface{}
+	where := func(rawCond, dailyCond string, args ...interface{}) {
+		raw = append(raw, rawCond)
+		rawArgs = append(rawArgs, args...)
+		daily = append(daily, dailyCond)
+		dailyArgs = append(dailyArgs, args...)
+	}
+	if len(s.Clients) > 0 {
+		args := addrArgs(s.Clients)
+		in := "local_addr IN ( ?" + strings.Repeat(",?", len(args)-1) + " )"
+		where(in, in, args...)
+	}
+	if !s.Begin.IsZero() {
+		where("created_at >= ?", "day >= CAST(? AS DATE)", s.Begin.UTC())
+	}
+	if !s.End.IsZero() {
+		where("created_at < ?", "day < ?", s.End.UTC())
+	}
+	if len(s.Protocols) > 0 {
+		var args []interface{}
+		for _, p := range s.Protocols {
+			args = append(args, string(p))
+		}
+		in := "protocol IN ( ?" + strings.Repeat(",?", len(args)-1) + " )"
+		where(in, in, args...)
+	}
+	if s.Destination != "" {
+		where("contains(lower(server_name), lower(?))", "contains(lower(server_name), lower(?))", s.Destination)
+	}
+	if s.DestinationSuffix != "" {
+		where("suffix(server_name, ?)", "suffix(server_name, ?)", s.DestinationSuffix)
+	}
+	rawOnly := g.rawOnly
+	if s.Port != 0 {
+		raw = append(raw, "remote_port = ?")
+		rawArgs = append(rawArgs, s.Port)
+		rawOnly = true
+	}
+
+	rows := `SELECT id, created_at AS time, local_addr, remote_port, protocol, server_name,
+			1 AS connections, sent_bytes AS sent, received_bytes AS recv
+		FROM log` + whereClause(raw)
+	args := rawArgs
+	if !rawOnly {
+		rows += `
+		UNION ALL
+		SELECT NULL, CAST(day AS TIMESTAMP), local_addr, NULL, protocol, server_name,
+			connections, sent_bytes, received_bytes
+		FROM log_daily` + whereClause(daily)
+		args = append(args, dailyArgs...)
+	}
+
+	groups := "SELECT " + g.selects
+	if g.groupBy != "" {
+		groups += ", SUM(connections) AS connections, SUM(sent) AS sent, SUM(recv) AS recv FROM rows GROUP BY " + g.groupBy
+	} else {
+		groups += " FROM rows"
+	}
+
+	var columns []string
+	for _, c := range searchColumns {
+		switch {
+		case !contains(g.columns, c):
+			c = "NULL"
+		case c == "protocol":
+			c = "CAST(protocol AS VARCHAR)"
+		}
+		columns = append(columns, c)
+	}
+	query := "WITH rows AS (" + rows + "), groups AS (" + groups + ")\n" +
+		"SELECT " + strings.Join(columns, ", ") + ", connections, sent, recv, " +
+		"CAST(" + sortExpr + " AS VARCHAR), CAST(" + g.tie + " AS VARCHAR) FROM groups"
+
+	dir, cmp := "DESC", "<"
+	if s.Ascending {
+		dir, cmp = "ASC", ">"
+	}
+	if s.Cursor != "" {
+		var cur cursor
+		b, err := base64.RawURLEncoding.DecodeString(s.Cursor)
+		if err != nil || json.Unmarshal(b, &cur) != nil {
+			return SearchResult{}, ErrInvalidCursor
+		}
+		query += fmt.Sprintf(" WHERE %[1]s %[3]s CAST(? AS %[2]s) OR (%[1]s = CAST(? AS %[2]s) AND %[4]s > CAST(? AS %[5]s))",
+			sortExpr, sortType, cmp, g.tie, g.tieType)
+		args = append(args, cur.Sort, cur.Sort, cur.Tie)
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, %s ASC LIMIT ?", sortExpr, dir, g.tie)
+	args = append(args, limit+1)
+
+	r, err := db.db.Query(query, args...)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	defer r.Close()
+
+	var result SearchResult
+	var last cursor
+	for r.Next() {
+		var (
+			t                   sql.NullTime
+			addr                []byte
+			port                sql.NullInt64
+			proto, server       sql.NullString
+			conns, sent, recv   uint64
+			sortValue, tieValue string
+		)
+		if err := r.Scan(&t, &addr, &port, &proto, &server, &conns, &sent, &recv, &sortValue, &tieValue); err != nil {
+			return SearchResult{}, err
+		}
+		if len(result.Rows) == limit {
+			b, _ := json.Marshal(last)
+			result.NextCursor = base64.RawURLEncoding.EncodeToString(b)
+			break
+		}
+		row := SearchRow{
+			Time:        t.Time,
+			ServerName:  server.String,
+			Protocol:    Protocol(proto.String),
+			Port:        uint16(port.Int64),
+			Connections: conns,
+			Sent:        sent,
+			Recv:        recv,
+		}
+		if addr != nil {
+			row.Client = toIP(addr)
+		}
+		result.Rows = append(result.Rows, row)
+		last = cursor{sortValue, tieValue}
+	}
+	return result, r.Err()
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
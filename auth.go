@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+var sessions = session.New(session.Config{
+	Expiration:     12 * time.Hour,
+	KeyLookup:      "cookie:session",
+	CookieHTTPOnly: true,
+	CookieSameSite: "Lax",
+})
+
+// publicPaths can be accessed without logging in. The API authenticates
+// with tokens instead of sessions.
+var publicPaths = []string{"/login", "/setup", "/assets/", "/portal", "/portal/", "/sso/", "/api/"}
+
+// authMiddleware loads the logged in user into the request context and
+// redirects to the login page otherwise. If there are no users yet, the
+// first admin has to be created through the setup page.
+func authMiddleware(c *fiber.Ctx) error {
+	for _, p := range publicPaths {
+		if c.Path() == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(c.Path(), p)) {
+			return c.Next()
+		}
+	}
+
+	sess, err := sessions.Get(c)
+	if err != nil {
+		return err
+	}
+	if id, ok := sess.Get("user").(int); ok {
+		var user models.User
+		if ret := models.DB.First(&user, id); ret.Error == nil {
+			c.Locals("user", &user)
+			c.Bind(fiber.Map{
+				"User":       user,
+				"CanOperate": user.Role.Allows(models.RoleOperator),
+				"IsAdmin":    user.Role.Allows(models.RoleAdmin),
+			})
+			return c.Next()
+		}
+	}
+
+	var cnt int64
+	models.DB.Model(&models.User{}).Count(&cnt)
+	if cnt == 0 {
+		return c.Redirect("/setup")
+	}
+	return c.Redirect("/login")
+}
+
+// requireRole only lets users with at least the privileges of role through.
+func requireRole(role models.Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user := currentUser(c)
+		if user == nil || !user.Role.Allows(role) {
+			return fiber.ErrForbidden
+		}
+		return c.Next()
+	}
+}
+
+func currentUser(c *fiber.Ctx) *models.User {
+	u, _ := c.Locals("user").(*models.User)
+	return u
+}
+
+func login(c *fiber.Ctx, user *models.User) error {
+	sess, err := sessions.Get(c)
+	if err != nil {
+		return err
+	}
+	if err := sess.Regenerate(); err != nil {
+		return err
+	}
+	// Regenerate keeps the data, a signed in account holder is signed out
+	sess.Delete("account")
+	sess.Set("user", user.ID)
+	return sess.Save()
+}
+
+func authHandler(app *fiber.App) {
+	// login page
+	app.Get("/login", func(c *fiber.Ctx) error {
+		return c.Render("login", fiber.Map{
+			"SSO": ssoProvider != nil,
+		})
+	})
+
+	// login
+	app.Post("/login", func(c *fiber.Ctx) error {
+		var user models.User
+		ret := models.DB.Where("username = ?", c.FormValue("username")).First(&user)
+		if ret.Error != nil || bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(c.FormValue("password"))) != nil {
+			flashError(c, "Invalid username or password")
+			return c.Redirect("/login")
+		}
+		if err := login(c, &user); err != nil {
+			return err
+		}
+		return c.Redirect("/")
+	})
+
+	// logout
+	app.Post("/logout", func(c *fiber.Ctx) error {
+		sess, err := sessions.Get(c)
+		if err != nil {
+			return err
+		}
+		if err := sess.Destroy(); err != nil {
+			return err
+		}
+		return c.Redirect("/login")
+	})
+
+	// create first admin
+	app.Get("/setup", func(c *fiber.Ctx) error {
+		var cnt int64
+		models.DB.Model(&models.User{}).Count(&cnt)
+		if cnt > 0 {
+			return c.Redirect("/login")
+		}
+		return c.Render("setup", fiber.Map{})
+	})
+
+	app.Post("/setup", func(c *fiber.Ctx) error {
+		var cnt int64
+		models.DB.Model(&models.User{}).Count(&cnt)
+		if cnt > 0 {
+			return c.Redirect("/login")
+		}
+
+		user, err := newUser(c.FormValue("username"), c.FormValue("password"), models.RoleAdmin)
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/setup")
+		}
+		if ret := models.DB.Create(user); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/setup")
+		}
+		recordEvent("setup", "create", nil, userSnapshot(*user))
+		if err := login(c, user); err != nil {
+			return err
+		}
+		return c.Redirect("/")
+	})
+
+	// all users
+	app.Get("/users", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		var users []models.User
+		models.DB.Order("id").Find(&users)
+		return c.Render("users", fiber.Map{
+			"Users": users,
+			"Roles": models.Roles,
+		})
+	})
+
+	// create user
+	app.Post("/users", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		user, err := newUser(c.FormValue("username"), c.FormValue("password"), models.Role(c.FormValue("role")))
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/users")
+		}
+		if ret := models.DB.Create(user); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+		} else {
+			flashInfo(c, "User created")
+			recordEvent(actor(c), "create", nil, userSnapshot(*user))
+		}
+		return c.Redirect("/users")
+	})
+
+	// update user
+	app.Post("/users/:id", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		var user models.User
+		if ret := models.DB.First(&user, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/users")
+		}
+		before := userSnapshot(user)
+		if role := models.Role(c.FormValue("role")); role != user.Role {
+			if !validRole(role) {
+				flashError(c, "Invalid role")
+				return c.Redirect("/users")
+			}
+			if user.ID == currentUser(c).ID {
+				flashError(c, "Cannot change your own role")
+				return c.Redirect("/users")
+			}
+			user.Role = role
+		}
+		if pw := c.FormValue("password"); pw != "" {
+			hash, err := hashPassword(pw)
+			if err != nil {
+				flashError(c, err.Error())
+				return c.Redirect("/users")
+			}
+			user.PasswordHash = hash
+		}
+		if ret := models.DB.Save(&user); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+		} else {
+			flashInfo(c, "User updated")
+			action := "update"
+			if c.FormValue("password") != "" {
+				action = "set_password"
+			}
+			recordEvent(actor(c), action, before, userSnapshot(user))
+		}
+		return c.Redirect("/users")
+	})
+
+	// delete user
+	app.Post("/users/:id/delete", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		if c.Params("id") == fmt.Sprint(currentUser(c).ID) {
+			flashError(c, "Cannot delete yourself")
+			return c.Redirect("/users")
+		}
+		var user models.User
+		if ret := models.DB.First(&user, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/users")
+		}
+		if ret := models.DB.Unscoped().Delete(&user); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+		} else {
+			flashInfo(c, "User deleted")
+			recordEvent(actor(c), "delete", userSnapshot(user), nil)
+		}
+		return c.Redirect("/users")
+	})
+
+	// all API tokens
+	app.Get("/tokens", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		var tokens []models.APIToken
+		models.DB.Order("id").Find(&tokens)
+		return c.Render("tokens", fiber.Map{
+			"Tokens": tokens,
+			"Roles":  models.Roles,
+		})
+	})
+
+	// create API token, it is only shown once
+	app.Post("/tokens", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		role := models.Role(c.FormValue("role"))
+		if !validRole(role) {
+			flashError(c, "Invalid role")
+			return c.Redirect("/tokens")
+		}
+		if c.FormValue("name") == "" {
+			flashError(c, "Invalid name")
+			return c.Redirect("/tokens")
+		}
+		token, err := randomString()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256([]byte(token))
+		tok := models.APIToken{
+			Name:      c.FormValue("name"),
+			TokenHash: hash[:],
+			Role:      role,
+		}
+		if ret := models.DB.Create(&tok); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+		} else {
+			flashInfo(c, "Token created, it will not be shown again: "+token)
+			recordEvent(actor(c), "create", nil, tokenSnapshot(tok))
+		}
+		return c.Redirect("/tokens")
+	})
+
+	// delete API token
+	app.Post("/tokens/:id/delete", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		var tok models.APIToken
+		if ret := models.DB.First(&tok, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/tokens")
+		}
+		if ret := models.DB.Unscoped().Delete(&tok); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+		} else {
+			flashInfo(c, "Token deleted")
+			recordEvent(actor(c), "delete", tokenSnapshot(tok), nil)
+		}
+		return c.Redirect("/tokens")
+	})
+}
+
+func validRole(role models.Role) bool {
+	for _, r := range models.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func hashPassword(password string) ([]byte, error) {
+	if len(password) < 8 {
+		return nil, fmt.Errorf("Password must be at least 8 characters")
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+func newUser(username, password string, role models.Role) (*models.User, error) {
+	if username == "" {
+		return nil, fmt.Errorf("Invalid username")
+	}
+	if !validRole(role) {
+		return nil, fmt.Errorf("Invalid role")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return &models.User{
+		Username:     username,
+		PasswordHash: hash,
+		Role:         role,
+	}, nil
+}
+
+// randomString returns a random URL-safe string for tokens.
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
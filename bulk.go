@@ -0,0 +1,641 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+// backup is the document format of the JSON import and export. Keys are
+// wireguard keys in base64.
+type backup struct {
+	Interfaces []backupInterface `json:"interfaces,omitempty" doc:"interfaces created if they do not exist, requires admin"`
+	Accounts   []backupAccount   `json:"accounts"`
+}
+
+type backupInterface struct {
+	Name                string `json:"name"`
+	PrivateKey          string `json:"private_key,omitempty" doc:"generated if empty"`
+	ListenPort          int    `json:"listen_port"`
+	Subnet              string `json:"subnet"`
+	NatIface            string `json:"nat_iface,omitempty"`
+	ExternalIP          string `json:"external_ip"`
+	DNS                 string `json:"dns,omitempty"`
+	PersistentKeepalive int    `json:"persistent_keepalive,omitempty"`
+}
+
+type backupAccount struct {
+	Name      string `json:"name"`
+	Interface string `json:"interface" doc:"name of the interface"`
+	apiAccountLimits
+	Clients []backupClient `json:"clients,omitempty"`
+}
+
+type backupClient struct {
+	Name                string `json:"name"`
+	PublicKey           string `json:"public_key,omitempty" doc:"generated with the private key if both are empty"`
+	PrivateKey          string `json:"private_key,omitempty" doc:"only exported if stored"`
+	PresharedKey        string `json:"preshared_key,omitempty" doc:"generated if empty"`
+	IPAddress           string `json:"ip_address,omitempty" doc:"the next free address if empty"`
+	PersistentKeepalive int    `json:"persistent_keepalive,omitempty"`
+}
+
+// csvColumns are the columns of the CSV import and export. Every row is an
+// account, optionally with a client. Account columns may be empty on rows
+// repeating the account.
+var csvColumns = []string{"account", "interface", "bandwidth_in_limit", "bandwidth_out_limit", "device_limit", "client", "public_key", "ip_address"}
+
+// parseBackup reads a JSON document or a CSV file with a header row.
+func parseBackup(data []byte) (*backup, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		var b backup
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&b); err != nil {
+			return nil, fmt.Errorf("Invalid JSON: %w", err)
+		}
+		return &b, nil
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CSV: %w", err)
+	}
+	cols := map[string]int{}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		known := false
+		for _, c := range csvColumns {
+			known = known || c == h
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown CSV column %q", h)
+		}
+		cols[h] = i
+	}
+	for _, c := range []string{"account", "interface"} {
+		if _, ok := cols[c]; !ok {
+			return nil, fmt.Errorf("Missing CSV column %q", c)
+		}
+	}
+
+	b := backup{Accounts: []backupAccount{}}
+	accounts := map[[2]string]int{}
+	for line := 2; ; line++ {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Invalid CSV: %w", err)
+		}
+		get := func(col string) string {
+			if i, ok := cols[col]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		num := func(col string, v *float64) error {
+			if s := get(col); s != "" {
+				f, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					return fmt.Errorf("Line %d: invalid %s %q", line, col, s)
+				}
+				*v = f
+			}
+			return nil
+		}
+
+		key := [2]string{get("interface"), get("account")}
+		i, ok := accounts[key]
+		if !ok {
+			i = len(b.Accounts)
+			accounts[key] = i
+			b.Accounts = append(b.Accounts, backupAccount{Name: key[1], Interface: key[0]})
+		}
+		acc := &b.Accounts[i]
+		if err := num("bandwidth_in_limit", &acc.BandwidthInLimit); err != nil {
+			return nil, err
+		}
+		if err := num("bandwidth_out_limit", &acc.BandwidthOutLimit); err != nil {
+			return nil, err
+		}
+		var limit float64
+		if err := num("device_limit", &limit); err != nil {
+			return nil, err
+		} else if limit != 0 {
+			acc.DeviceLimit = int(limit)
+		}
+		if get("client") != "" {
+			acc.Clients = append(acc.Clients, backupClient{
+				Name:      get("client"),
+				PublicKey: get("public_key"),
+				IPAddress: get("ip_address"),
+			})
+		}
+	}
+	return &b, nil
+}
+
+// importStep is a change of an import.
+type importStep struct {
+	Entity string `json:"entity" doc:"interface, account or client"`
+	Name   string `json:"name" doc:"clients are named <account>/<client>"`
+	Action string `json:"action" doc:"create, update or skip"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type importConfig struct {
+	Account string `json:"account"`
+	Client  string `json:"client"`
+	Config  string `json:"config"`
+}
+
+type importResult struct {
+	DryRun  bool           `json:"dry_run" doc:"nothing was changed"`
+	Errors  int            `json:"errors" doc:"nothing is imported if there are errors"`
+	Steps   []importStep   `json:"steps"`
+	Configs []importConfig `json:"configs,omitempty" doc:"configurations of the created clients"`
+}
+
+// importBackup validates the document and, unless dryRun is set or there are
+// errors, imports it. Existing interfaces, accounts and clients are matched
+// by name; only the limits of existing accounts are updated.
+func importBackup(b *backup, role models.Role, actor string, dryRun bool) *importResult {
+	res := runImport(b, role, actor, false)
+	if res.Errors > 0 || dryRun {
+		res.DryRun = true
+		return res
+	}
+	return runImport(b, role, actor, true)
+}
+
+// runImport walks the document and records the steps, making the changes
+// if apply is set. It is run without apply first to validate all steps.
+func runImport(b *backup, role models.Role, actor string, apply bool) *importResult {
+	res := &importResult{Steps: []importStep{}}
+	step := func(entity, name, action, detail string, err error) {
+		s := importStep{Entity: entity, Name: name, Action: action, Detail: detail}
+		if err != nil {
+			s.Error = err.Error()
+			res.Errors++
+		}
+		res.Steps = append(res.Steps, s)
+	}
+
+	ifaces := map[string]models.Interface{}
+	created := map[string]bool{}
+	var existing []models.Interface
+	models.DB.Find(&existing)
+	for _, iface := range existing {
+		ifaces[iface.Name] = iface
+	}
+
+	for _, bi := range b.Interfaces {
+		if _, ok := ifaces[bi.Name]; ok && !created[bi.Name] {
+			step("interface", bi.Name, "skip", "already exists", nil)
+			continue
+		}
+		iface, err := bi.model()
+		if err == nil && created[bi.Name] {
+			err = fmt.Errorf("Interface %s is listed twice", bi.Name)
+		}
+		if err == nil && !role.Allows(models.RoleAdmin) {
+			err = fmt.Errorf("Creating interfaces requires the admin role")
+		}
+		if err == nil {
+			err = checkInterface(&iface)
+		}
+		if err == nil && apply {
+			if ret := models.DB.Create(&iface); ret.Error != nil {
+				err = ret.Error
+			} else {
+				recordEvent(actor, "import", nil, interfaceSnapshot(iface))
+				syncers.UpdateInterface(iface.ID)
+			}
+		}
+		ifaces[bi.Name] = iface
+		created[bi.Name] = true
+		step("interface", bi.Name, "create", iface.Subnet, err)
+	}
+
+	seenAccounts := map[[2]string]bool{}
+	seenIPs := map[string]bool{}
+	seenKeys := map[wgtypes.Key]bool{}
+	var pending []func()
+	for _, ba := range b.Accounts {
+		iface, ok := ifaces[ba.Interface]
+		var acc models.Account
+		if ok && !created[ba.Interface] {
+			models.DB.Where("interface_id = ? AND name = ?", iface.ID, ba.Name).Limit(1).Find(&acc)
+		}
+		exists := acc.ID != 0
+
+		// limits may be left out to keep those of existing accounts
+		update := ba.BandwidthInLimit != 0 || ba.BandwidthOutLimit != 0 || ba.DeviceLimit != 0
+		key := [2]string{ba.Interface, ba.Name}
+		var err error
+		switch {
+		case ba.Name == "":
+			err = fmt.Errorf("Account name must not be empty")
+		case !ok:
+			err = fmt.Errorf("Interface %q does not exist", ba.Interface)
+		case seenAccounts[key]:
+			err = fmt.Errorf("Account is listed twice")
+		case !exists || update:
+			v := validation{}
+			ba.validate(v)
+			if len(v) > 0 {
+				err = fmt.Errorf("Invalid limits: %s", fieldErrors(v))
+			}
+		}
+		seenAccounts[key] = true
+
+		action, detail := "create", fmt.Sprintf("%g/%g Mb/s, %d devices", ba.BandwidthInLimit, ba.BandwidthOutLimit, ba.DeviceLimit)
+		before := accountSnapshot(acc)
+		if exists && update {
+			action, detail = "update", "limits "+detail
+			ba.apply(&acc)
+		} else if exists {
+			action, detail = "skip", "already exists"
+		} else {
+			acc = models.Account{Name: ba.Name, InterfaceID: iface.ID}
+			ba.apply(&acc)
+		}
+		if err == nil && apply && action != "skip" {
+			if ret := models.DB.Save(&acc); ret.Error != nil {
+				err = ret.Error
+			} else if exists {
+				recordEvent(actor, "import", before, accountSnapshot(acc))
+				syncers.UpdateAccounts(acc.InterfaceID)
+			} else {
+				recordEvent(actor, "import", nil, accountSnapshot(acc))
+			}
+		}
+		step("account", ba.Name, action, detail, err)
+		accountOK := err == nil
+
+		seenClients := map[string]bool{}
+		for _, bc := range ba.Clients {
+			name := ba.Name + "/" + bc.Name
+			var cli models.Client
+			if exists {
+				models.DB.Where("account_id = ? AND name = ?", acc.ID, bc.Name).Limit(1).Find(&cli)
+			}
+			if cli.ID != 0 {
+				step("client", name, "skip", "already exists", nil)
+				continue
+			}
+
+			pub, privateKey, psk, err := bc.keys()
+			switch {
+			case err != nil:
+			case bc.Name == "":
+				err = fmt.Errorf("Client name must not be empty")
+			case seenClients[bc.Name]:
+				err = fmt.Errorf("Client is listed twice")
+			case bc.PersistentKeepalive < 0 || bc.PersistentKeepalive > 65535:
+				err = fmt.Errorf("Persistent keepalive must be between 0 and 65535")
+			case pub != nil && seenKeys[*pub]:
+				err = fmt.Errorf("Public key is listed twice")
+			case bc.IPAddress != "" && seenIPs[net.ParseIP(bc.IPAddress).String()]:
+				err = fmt.Errorf("IP address %s is listed twice", bc.IPAddress)
+			case !ok:
+				err = fmt.Errorf("Unknown interface")
+			case bc.IPAddress != "":
+				err = checkClientIP(iface, bc.IPAddress)
+			}
+			if err == nil && pub != nil {
+				_, _, err = clientKey(pub.String(), 0)
+			}
+			seenClients[bc.Name] = true
+			if pub != nil {
+				seenKeys[*pub] = true
+			}
+			if bc.IPAddress != "" {
+				seenIPs[net.ParseIP(bc.IPAddress).String()] = true
+			}
+			if err == nil && !accountOK {
+				err = fmt.Errorf("Account cannot be imported")
+			}
+
+			detail := bc.IPAddress
+			if detail == "" {
+				detail = "next free address"
+			}
+			step("client", name, "create", detail, err)
+			if err == nil && apply {
+				i, acc, bc := len(res.Steps)-1, acc, bc
+				create := func() {
+					cfg, err := importClient(acc, bc, pub, privateKey, psk, actor)
+					if err != nil {
+						res.Steps[i].Error = err.Error()
+						res.Errors++
+						return
+					}
+					res.Configs = append(res.Configs, importConfig{Account: acc.Name, Client: bc.Name, Config: cfg})
+				}
+				if bc.IPAddress != "" {
+					create()
+				} else {
+					pending = append(pending, create)
+				}
+			}
+		}
+	}
+	// clients with fixed addresses first, the free ones must not take them
+	for _, create := range pending {
+		create()
+	}
+	return res
+}
+
+func (bi backupInterface) model() (models.Interface, error) {
+	iface := models.Interface{
+		Name:                bi.Name,
+		ListenPort:          bi.ListenPort,
+		Subnet:              bi.Subnet,
+		NatIface:            bi.NatIface,
+		ExternalIP:          bi.ExternalIP,
+		DNS:                 bi.DNS,
+		PersistentKeepalive: bi.PersistentKeepalive,
+	}
+	if bi.ListenPort <= 0 || bi.ListenPort > 65535 {
+		return iface, fmt.Errorf("Invalid listen port")
+	}
+	if bi.ExternalIP == "" {
+		return iface, fmt.Errorf("External IP must not be empty")
+	}
+	key, err := wgtypes.GenerateKey()
+	if bi.PrivateKey != "" {
+		key, err = wgtypes.ParseKey(bi.PrivateKey)
+	}
+	if err != nil {
+		return iface, fmt.Errorf("Invalid private key: %w", err)
+	}
+	iface.PrivateKey = key[:]
+	return iface, nil
+}
+
+// keys parses the keys of the client. pub is nil if it is generated when
+// the client is created.
+func (bc backupClient) keys() (pub *wgtypes.Key, privateKey string, psk *wgtypes.Key, err error) {
+	if bc.PrivateKey != "" {
+		key, err := wgtypes.ParseKey(bc.PrivateKey)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("Invalid private key: %w", err)
+		}
+		p := key.PublicKey()
+		pub, privateKey = &p, key.String()
+	}
+	if bc.PublicKey != "" {
+		p, err := wgtypes.ParseKey(bc.PublicKey)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("Invalid public key: %w", err)
+		}
+		if pub != nil && *pub != p {
+			return nil, "", nil, fmt.Errorf("Public key does not match the private key")
+		}
+		pub = &p
+	}
+	if bc.PresharedKey != "" {
+		k, err := wgtypes.ParseKey(bc.PresharedKey)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("Invalid preshared key: %w", err)
+		}
+		psk = &k
+	}
+	return pub, privateKey, psk, nil
+}
+
+// importClient creates a client and returns its configuration.
+func importClient(acc models.Account, bc backupClient, pub *wgtypes.Key, privateKey string, psk *wgtypes.Key, actor string) (string, error) {
+	var publicKey string
+	if pub != nil {
+		publicKey = pub.String()
+	}
+	cli, iface, generated, err := newClient(acc, bc.Name, publicKey, bc.PersistentKeepalive, psk == nil, bc.IPAddress)
+	if err != nil {
+		return "", err
+	}
+	if generated != "" {
+		privateKey = generated
+	} else if psk != nil || privateKey != "" {
+		// keep the keys of the backup
+		if psk != nil {
+			if cli.PresharedKey, err = secrets.Seal(psk[:]); err != nil {
+				return "", err
+			}
+		}
+		if cli.PrivateKey, err = sealPrivateKey(privateKey); err != nil {
+			return "", err
+		}
+		if ret := models.DB.Save(&cli); ret.Error != nil {
+			return "", ret.Error
+		}
+		// newClient synced the generated preshared key
+		syncers.UpdateClients(iface.ID)
+	}
+	recordEvent(actor, "import", nil, clientSnapshot(cli))
+	return clientConfig(iface, cli, privateKey)
+}
+
+// exportBackup returns all interfaces, accounts and clients including their
+// secrets.
+func exportBackup() (*backup, error) {
+	var ifaces []models.Interface
+	if ret := models.DB.Order("id").Preload("Accounts.Clients").Find(&ifaces); ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	b := &backup{Interfaces: []backupInterface{}, Accounts: []backupAccount{}}
+	for _, iface := range ifaces {
+		bi := backupInterface{
+			Name:                iface.Name,
+			ListenPort:          iface.ListenPort,
+			Subnet:              iface.Subnet,
+			NatIface:            iface.NatIface,
+			ExternalIP:          iface.ExternalIP,
+			DNS:                 iface.DNS,
+			PersistentKeepalive: iface.PersistentKeepalive,
+		}
+		if key, err := wgtypes.NewKey(iface.PrivateKey); err == nil {
+			bi.PrivateKey = key.String()
+		}
+		b.Interfaces = append(b.Interfaces, bi)
+
+		for _, acc := range iface.Accounts {
+			ba := backupAccount{
+				Name:             acc.Name,
+				Interface:        iface.Name,
+				apiAccountLimits: toAPIAccount(acc).apiAccountLimits,
+			}
+			for _, cli := range acc.Clients {
+				bc := backupClient{
+					Name:                cli.Name,
+					PublicKey:           toAPIClient(cli).PublicKey,
+					IPAddress:           cli.IPAddress,
+					PersistentKeepalive: cli.PersistentKeepalive,
+				}
+				var err error
+				if bc.PrivateKey, err = openPrivateKey(cli); err != nil {
+					return nil, err
+				}
+				if len(cli.PresharedKey) > 0 {
+					psk, err := secrets.Open(cli.PresharedKey)
+					if err != nil {
+						return nil, err
+					}
+					key, err := wgtypes.NewKey(psk)
+					if err != nil {
+						return nil, err
+					}
+					bc.PresharedKey = key.String()
+				}
+				ba.Clients = append(ba.Clients, bc)
+			}
+			b.Accounts = append(b.Accounts, ba)
+		}
+	}
+	return b, nil
+}
+
+// writeCSV writes the accounts and clients of the backup without secrets in
+// the format of the CSV import.
+func writeCSV(w io.Writer, b *backup) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvColumns)
+	for _, a := range b.Accounts {
+		row := []string{
+			a.Name, a.Interface,
+			strconv.FormatFloat(a.BandwidthInLimit, 'f', -1, 64),
+			strconv.FormatFloat(a.BandwidthOutLimit, 'f', -1, 64),
+			strconv.Itoa(a.DeviceLimit),
+		}
+		if len(a.Clients) == 0 {
+			cw.Write(append(row, "", "", ""))
+		}
+		for _, c := range a.Clients {
+			cw.Write(append(row, c.Name, c.PublicKey, c.IPAddress))
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// configZip packs the configurations into a zip file with a directory per
+// account.
+func configZip(configs []importConfig) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	clean := strings.NewReplacer("/", "_", "\\", "_", "..", "_")
+	for _, c := range configs {
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     clean.Replace(c.Account) + "/" + clean.Replace(c.Client) + ".conf",
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, c.Config); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func fieldErrors(fields map[string]string) string {
+	var s []string
+	for _, k := range []string{"name", "interface", "bandwidth_in_limit", "bandwidth_out_limit", "device_limit"} {
+		if v, ok := fields[k]; ok {
+			s = append(s, k+" "+v)
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func bulkHandler(app *fiber.App) {
+	// import form
+	app.Get("/import", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		return c.Render("import", fiber.Map{})
+	})
+
+	// preview or run an import
+	app.Post("/import", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		data := c.FormValue("data")
+		if fh, err := c.FormFile("file"); err == nil && fh.Size > 0 {
+			f, err := fh.Open()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			b, err := io.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			data = string(b)
+		}
+
+		b, err := parseBackup([]byte(data))
+		if err != nil {
+			return c.Render("import", fiber.Map{"Data": data, "FlashError": err.Error()})
+		}
+		res := importBackup(b, currentUser(c).Role, actor(c), c.FormValue("action") != "Import")
+
+		// configurations of the created clients for download
+		var zip string
+		if len(res.Configs) > 0 {
+			z, err := configZip(res.Configs)
+			if err != nil {
+				return err
+			}
+			zip = base64.StdEncoding.EncodeToString(z)
+		}
+		return c.Render("import", fiber.Map{
+			"Data":   data,
+			"Result": res,
+			"Zip":    zip,
+		})
+	})
+
+	// backup including secrets
+	app.Get("/export.json", requireRole(models.RoleAdmin), func(c *fiber.Ctx) error {
+		b, err := exportBackup()
+		if err != nil {
+			return err
+		}
+		c.Attachment("wg-gatekeeper.json")
+		return c.JSON(b)
+	})
+
+	// accounts and clients without secrets
+	app.Get("/export.csv", requireRole(models.RoleAuditor), func(c *fiber.Ctx) error {
+		b, err := exportBackup()
+		if err != nil {
+			return err
+		}
+		c.Attachment("wg-gatekeeper.csv")
+		return writeCSV(c, b)
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+// limits are valid limits of an imported account.
+var limits = apiAccountLimits{BandwidthInLimit: 10, BandwidthOutLimit: 10}
+
+func TestParseBackupCSV(t *testing.T) {
+	b, err := parseBackup([]byte(`Account, Interface, bandwidth_in_limit, device_limit, client, ip_address
+bob, wg0, 10, 2, laptop, 10.0.0.5
+bob, wg0, , , phone,
+alice, wg0, 5, , ,
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []backupAccount{
+		{Name: "bob", Interface: "wg0", apiAccountLimits: apiAccountLimits{BandwidthInLimit: 10, DeviceLimit: 2},
+			Clients: []backupClient{{Name: "laptop", IPAddress: "10.0.0.5"}, {Name: "phone"}}},
+		{Name: "alice", Interface: "wg0", apiAccountLimits: apiAccountLimits{BandwidthInLimit: 5}},
+	}, b.Accounts)
+
+	for _, tc := range []struct {
+		data string
+		err  string
+	}{
+		{"account,interface,quota\nbob,wg0,1\n", `Unknown CSV column "quota"`},
+		{"account,client\nbob,laptop\n", `Missing CSV column "interface"`},
+		{"account,interface,device_limit\nbob,wg0,1\nalice,wg0,many\n", `Line 3: invalid device_limit "many"`},
+		{"account,interface\nbob,wg0,extra\n", "Invalid CSV: record on line 2: wrong number of fields"},
+		{`{"accounts": [], "unknown": 1}`, `Invalid JSON: json: unknown field "unknown"`},
+	} {
+		_, err := parseBackup([]byte(tc.data))
+		assert.EqualError(t, err, tc.err)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	app, _ := testApp(t)
+	testUser(t, "alice", models.RoleOperator)
+	s := newTestSession(t, app)
+	s.login("alice")
+	s.do("GET", "/import", nil)
+
+	data := "account,interface,bandwidth_in_limit,bandwidth_out_limit,client\nbob,wg0,10,10,laptop\n"
+	resp := s.post("/import", url.Values{"data": {data}, "action": {"Preview"}})
+	assert.Equal(t, 200, resp.StatusCode)
+	var cnt int64
+	models.DB.Model(&models.Account{}).Count(&cnt)
+	assert.Equal(t, int64(0), cnt)
+	models.DB.Model(&models.Event{}).Count(&cnt)
+	assert.Equal(t, int64(0), cnt)
+
+	res := importBackup(&backup{Accounts: []backupAccount{{Name: "bob", Interface: "wg0", apiAccountLimits: limits,
+		Clients: []backupClient{{Name: "laptop"}}}}}, models.RoleOperator, "test", true)
+	assert.True(t, res.DryRun)
+	assert.Equal(t, 0, res.Errors)
+	assert.Equal(t, []importStep{
+		{Entity: "account", Name: "bob", Action: "create", Detail: "10/10 Mb/s, 0 devices"},
+		{Entity: "client", Name: "bob/laptop", Action: "create", Detail: "next free address"},
+	}, res.Steps)
+	assert.Empty(t, res.Configs)
+	models.DB.Model(&models.Account{}).Count(&cnt)
+	assert.Equal(t, int64(0), cnt)
+	models.DB.Model(&models.Client{}).Count(&cnt)
+	assert.Equal(t, int64(0), cnt)
+}
+
+func TestImportAbortsOnError(t *testing.T) {
+	testDB(t)
+	for _, tc := range []struct {
+		name string
+		b    backup
+	}{
+		{"unknown interface", backup{Accounts: []backupAccount{
+			{Name: "bob", Interface: "wg0", apiAccountLimits: limits},
+			{Name: "alice", Interface: "wg1", apiAccountLimits: limits},
+		}}},
+		{"invalid client", backup{Accounts: []backupAccount{
+			{Name: "bob", Interface: "wg0", apiAccountLimits: limits, Clients: []backupClient{{Name: "laptop"}, {Name: "phone", IPAddress: "10.1.0.5"}}},
+		}}},
+		{"duplicate address", backup{Accounts: []backupAccount{
+			{Name: "bob", Interface: "wg0", apiAccountLimits: limits, Clients: []backupClient{{Name: "laptop", IPAddress: "10.0.0.5"}}},
+			{Name: "alice", Interface: "wg0", apiAccountLimits: limits, Clients: []backupClient{{Name: "laptop", IPAddress: "10.0.0.5"}}},
+		}}},
+		{"interface without admin", backup{
+			Interfaces: []backupInterface{{Name: "wg1", ListenPort: 51821, Subnet: "10.1.0.1/24", ExternalIP: "192.0.2.1"}},
+			Accounts:   []backupAccount{{Name: "bob", Interface: "wg1", apiAccountLimits: limits}},
+		}},
+	} {
+		res := importBackup(&tc.b, models.RoleOperator, "test", false)
+		assert.True(t, res.DryRun, tc.name)
+		assert.Equal(t, 1, res.Errors, tc.name)
+
+		var cnt int64
+		models.DB.Model(&models.Account{}).Count(&cnt)
+		assert.Equal(t, int64(0), cnt, tc.name)
+		models.DB.Model(&models.Interface{}).Count(&cnt)
+		assert.Equal(t, int64(1), cnt, tc.name)
+	}
+}
+
+func TestImportFixedIPsFirst(t *testing.T) {
+	testDB(t)
+	res := importBackup(&backup{Accounts: []backupAccount{
+		{Name: "bob", Interface: "wg0", apiAccountLimits: limits, Clients: []backupClient{{Name: "laptop"}, {Name: "phone"}}},
+		{Name: "alice", Interface: "wg0", apiAccountLimits: limits, Clients: []backupClient{{Name: "laptop", IPAddress: "10.0.0.2"}}},
+	}}, models.RoleOperator, "test", false)
+	assert.False(t, res.DryRun)
+	assert.Equal(t, 0, res.Errors, res.Steps)
+	assert.Len(t, res.Configs, 3)
+
+	addrs := map[string]string{}
+	var accounts []models.Account
+	models.DB.Preload("Clients").Find(&accounts)
+	for _, acc := range accounts {
+		for _, cli := range acc.Clients {
+			addrs[acc.Name+"/"+cli.Name] = cli.IPAddress
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"alice/laptop": "10.0.0.2",
+		"bob/laptop":   "10.0.0.3",
+		"bob/phone":    "10.0.0.4",
+	}, addrs)
+}
+
+func TestExportImport(t *testing.T) {
+	testDB(t)
+	*flagStoreClientKeys = true
+	defer func() { *flagStoreClientKeys = false }()
+	pub, err := wgtypes.GeneratePrivateKey()
+	assert.NoError(t, err)
+	res := importBackup(&backup{Accounts: []backupAccount{
+		{Name: "bob", Interface: "wg0", apiAccountLimits: apiAccountLimits{BandwidthInLimit: 10, BandwidthOutLimit: 5, DeviceLimit: 3},
+			Clients: []backupClient{{Name: "laptop"}, {Name: "phone", PublicKey: pub.PublicKey().String(), IPAddress: "10.0.0.9"}}},
+		{Name: "alice", Interface: "wg0", apiAccountLimits: limits},
+	}}, models.RoleOperator, "test", false)
+	if !assert.Equal(t, 0, res.Errors, res.Steps) {
+		t.FailNow()
+	}
+	exported, err := exportBackup()
+	assert.NoError(t, err)
+	var csv1 bytes.Buffer
+	assert.NoError(t, writeCSV(&csv1, exported))
+
+	// import into another database
+	testDB(t)
+	res = importBackup(exported, models.RoleAdmin, "test", false)
+	assert.Equal(t, 0, res.Errors, res.Steps)
+	imported, err := exportBackup()
+	assert.NoError(t, err)
+	var csv2 bytes.Buffer
+	assert.NoError(t, writeCSV(&csv2, imported))
+
+	assert.Equal(t, exported.Accounts, imported.Accounts)
+	assert.Equal(t, csv1.String(), csv2.String())
+	// the client with a fixed address is created first
+	laptop := imported.Accounts[0].Clients[1]
+	assert.Equal(t, "laptop", laptop.Name)
+	assert.NotEmpty(t, laptop.PrivateKey)
+	assert.NotEmpty(t, laptop.PresharedKey)
+	assert.Equal(t, "10.0.0.2", laptop.IPAddress)
+}
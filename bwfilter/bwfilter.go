@@ -4,9 +4,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os"
+	"sort"
 	"syscall"
 	"unsafe"
 
@@ -17,18 +17,23 @@ import (
 )
 
 type Handle struct {
-	done chan struct{}
-	objs bwfilterObjects
+	done  chan struct{}
+	objs  bwfilterObjects
+	iface int
 
 	currClientAccount map[uint32]bwfilterClientInfo
 }
 
-func Attach(iface int) (*Handle, error) {
+func Attach(iface int) (_ *Handle, outErr error) {
 	objs := bwfilterObjects{}
 	if err := loadBwfilterObjects(&objs, nil); err != nil {
-		log.Fatalf("loading objects: %s", err)
+		return nil, fmt.Errorf("loading objects: %w", err)
 	}
-	// defer objs.Close()
+	defer func() {
+		if outErr != nil {
+			objs.Close()
+		}
+	}()
 
 	tcnl, err := tc.Open(&tc.Config{})
 	if err != nil {
@@ -93,8 +98,9 @@ func Attach(iface int) (*Handle, error) {
 	}
 
 	h := &Handle{
-		objs: objs,
-		done: make(chan struct{}),
+		objs:  objs,
+		done:  make(chan struct{}),
+		iface: iface,
 	}
 	return h, nil
 }
@@ -104,22 +110,97 @@ func (h *Handle) Close() error {
 	return h.objs.Close()
 }
 
-func (h *Handle) GetMetric(f func(accountID int, bytesIn, bytesOut int64)) {
-	m := h.objs.AccountMetricMap.Iterate()
-	var aid uint32
-	var values []bwfilterAccountMetric
-	for m.Next(&aid, &values) {
-		h.objs.AccountMetricMap.Delete(&aid)
-		var bytesIn int64 = 0
-		var bytesOut int64 = 0
-		for _, v := range values {
-			bytesIn += int64(v.BytesIn)
-			bytesOut += int64(v.BytesOut)
+// Attached reports whether the classifier is still attached to both the
+// ingress and egress hooks of the interface.
+func (h *Handle) Attached() (bool, error) {
+	info, err := h.objs.TcProg.Info()
+	if err != nil {
+		return false, err
+	}
+	id, ok := info.ID()
+	if !ok {
+		return false, errors.New("program id not available")
+	}
+
+	tcnl, err := tc.Open(&tc.Config{})
+	if err != nil {
+		return false, err
+	}
+	defer tcnl.Close()
+
+	for _, e := range []uint32{tc.HandleMinIngress, tc.HandleMinEgress} {
+		filters, err := tcnl.Filter().Get(&tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: uint32(h.iface),
+			Parent:  core.BuildHandle(tc.HandleRoot, e),
+		})
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, unix.EINVAL) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		found := false
+		for _, f := range filters {
+			if f.Kind == "bpf" && f.BPF != nil && f.BPF.ID != nil && ebpf.ProgramID(*f.BPF.ID) == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Metric is the traffic of an account or client since the last call to
+// GetMetric. Dropped packets are not included in the bytes and packets.
+type Metric struct {
+	BytesIn    int64
+	BytesOut   int64
+	PacketsIn  int64
+	PacketsOut int64
+	DropsIn    int64
+	DropsOut   int64
+}
+
+// GetMetric calls account for the traffic of every account and client for
+// the traffic of every client IP address, and resets the counters. client
+// may be nil.
+func (h *Handle) GetMetric(account func(accountID int, m Metric), client func(ip string, m Metric)) {
+	var key uint32
+	var values []bwfilterTrafficMetric
+
+	it := h.objs.AccountMetricMap.Iterate()
+	for it.Next(&key, &values) {
+		h.objs.AccountMetricMap.Delete(&key)
+		account(int(key), sumMetric(values))
+	}
+
+	it = h.objs.ClientMetricMap.Iterate()
+	for it.Next(&key, &values) {
+		h.objs.ClientMetricMap.Delete(&key)
+		if client != nil {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, key)
+			client(ip.String(), sumMetric(values))
 		}
-		f(int(aid), bytesIn, bytesOut)
 	}
 }
 
+func sumMetric(values []bwfilterTrafficMetric) Metric {
+	var metric Metric
+	for _, v := range values {
+		metric.BytesIn += int64(v.BytesIn)
+		metric.BytesOut += int64(v.BytesOut)
+		metric.PacketsIn += int64(v.PacketsIn)
+		metric.PacketsOut += int64(v.PacketsOut)
+		metric.DropsIn += int64(v.DropsIn)
+		metric.DropsOut += int64(v.DropsOut)
+	}
+	return metric
+}
+
 type ClientAccount struct {
 	AccountID    uint32
 	BandwidthIn  uint64
@@ -139,12 +220,8 @@ func (h *Handle) UpdateClientAccount(ca map[string]ClientAccount) error {
 
 	keys := make(map[uint32]struct{})
 	for k, v := range ca {
-		i := binary.BigEndian.Uint32(net.ParseIP(k).To4())
-		val := bwfilterClientInfo{
-			AccountId:          v.AccountID,
-			ThrottleInRateBps:  uint32(v.BandwidthIn),
-			ThrottleOutRateBps: uint32(v.BandwidthOut),
-		}
+		i := clientKey(k)
+		val := v.info()
 		keys[i] = struct{}{}
 		if ca, ok := h.currClientAccount[i]; ok {
 			if ca == val {
@@ -170,3 +247,53 @@ func (h *Handle) UpdateClientAccount(ca map[string]ClientAccount) error {
 
 	return nil
 }
+
+// ReconcileClientAccount reads back the client account map from the kernel
+// instead of trusting what was last written, converges it to ca and returns
+// a description of every correction that was made.
+func (h *Handle) ReconcileClientAccount(ca map[string]ClientAccount) ([]string, error) {
+	curr := make(map[uint32]bwfilterClientInfo)
+	it := h.objs.ClientAccountMap.Iterate()
+	var key uint32
+	var value bwfilterClientInfo
+	for it.Next(&key, &value) {
+		curr[key] = value
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	h.currClientAccount = curr
+
+	var changes []string
+	keys := make(map[uint32]struct{})
+	for k, v := range ca {
+		i := clientKey(k)
+		keys[i] = struct{}{}
+		if c, ok := curr[i]; !ok {
+			changes = append(changes, fmt.Sprintf("added bandwidth account of %s", k))
+		} else if c != v.info() {
+			changes = append(changes, fmt.Sprintf("corrected bandwidth account of %s", k))
+		}
+	}
+	for k := range curr {
+		if _, ok := keys[k]; !ok {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, k)
+			changes = append(changes, fmt.Sprintf("removed bandwidth account of %s", ip))
+		}
+	}
+	sort.Strings(changes)
+	return changes, h.UpdateClientAccount(ca)
+}
+
+func clientKey(ip string) uint32 {
+	return binary.BigEndian.Uint32(net.ParseIP(ip).To4())
+}
+
+func (ca ClientAccount) info() bwfilterClientInfo {
+	return bwfilterClientInfo{
+		AccountId:          ca.AccountID,
+		ThrottleInRateBps:  uint32(ca.BandwidthIn),
+		ThrottleOutRateBps: uint32(ca.BandwidthOut),
+	}
+}
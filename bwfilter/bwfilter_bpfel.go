@@ -13,17 +13,21 @@ import (
 	"github.com/cilium/ebpf"
 )
 
-type bwfilterAccountMetric struct {
-	BytesIn  uint32
-	BytesOut uint32
-}
-
 type bwfilterClientInfo struct {
 	AccountId          uint32
 	ThrottleInRateBps  uint32
 	ThrottleOutRateBps uint32
 }
 
+type bwfilterTrafficMetric struct {
+	BytesIn    uint32
+	BytesOut   uint32
+	PacketsIn  uint32
+	PacketsOut uint32
+	DropsIn    uint32
+	DropsOut   uint32
+}
+
 // loadBwfilter returns the embedded CollectionSpec for bwfilter.
 func loadBwfilter() (*ebpf.CollectionSpec, error) {
 	reader := bytes.NewReader(_BwfilterBytes)
@@ -74,6 +78,7 @@ type bwfilterProgramSpecs struct {
 type bwfilterMapSpecs struct {
 	AccountMetricMap *ebpf.MapSpec `ebpf:"account_metric_map"`
 	ClientAccountMap *ebpf.MapSpec `ebpf:"client_account_map"`
+	ClientMetricMap  *ebpf.MapSpec `ebpf:"client_metric_map"`
 	FlowMap          *ebpf.MapSpec `ebpf:"flow_map"`
 }
 
@@ -98,6 +103,7 @@ func (o *bwfilterObjects) Close() error {
 type bwfilterMaps struct {
 	AccountMetricMap *ebpf.Map `ebpf:"account_metric_map"`
 	ClientAccountMap *ebpf.Map `ebpf:"client_account_map"`
+	ClientMetricMap  *ebpf.Map `ebpf:"client_metric_map"`
 	FlowMap          *ebpf.Map `ebpf:"flow_map"`
 }
 
@@ -105,6 +111,7 @@ func (m *bwfilterMaps) Close() error {
 	return _BwfilterClose(
 		m.AccountMetricMap,
 		m.ClientAccountMap,
+		m.ClientMetricMap,
 		m.FlowMap,
 	)
 }
@@ -47,25 +47,38 @@ struct {
   __uint(map_flags, BPF_F_NO_PREALLOC);
 } client_account_map SEC(".maps");
 
-struct account_metric {
+struct traffic_metric {
   uint32_t bytes_in;
   uint32_t bytes_out;
+  uint32_t packets_in;
+  uint32_t packets_out;
+  /* packets dropped by the throttle, not included in bytes and packets */
+  uint32_t drops_in;
+  uint32_t drops_out;
 };
 
 struct {
   __uint(type, BPF_MAP_TYPE_PERCPU_HASH);
   __type(key, uint32_t); // account_id
-  __type(value, struct account_metric);
+  __type(value, struct traffic_metric);
   __uint(max_entries, 65536);
   __uint(map_flags, BPF_F_NO_PREALLOC);
 } account_metric_map SEC(".maps");
 
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+  __type(key, uint32_t); // client ip
+  __type(value, struct traffic_metric);
+  __uint(max_entries, 65536);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} client_metric_map SEC(".maps");
+
 enum flags {
   FLAGS_OUT = 1,
 };
 
 static inline void get_flow_key(struct __sk_buff *skb, struct client_info **cli,
-                                int *flags) {
+                                uint32_t *client_ip, int *flags) {
   *flags = FLAGS_OUT;
   *cli = NULL;
 
@@ -85,6 +98,32 @@ static inline void get_flow_key(struct __sk_buff *skb, struct client_info **cli,
     *cli = (struct client_info *)bpf_map_lookup_elem(&client_account_map, &ip);
     *flags &= ~FLAGS_OUT;
   }
+  *client_ip = ip;
+}
+
+static __always_inline void count_packet(void *map, uint32_t *key, int flag,
+                                         int act, struct __sk_buff *skb) {
+  struct traffic_metric value = {};
+  struct traffic_metric *metric = bpf_map_lookup_elem(map, key);
+  if (metric != NULL) {
+    value = *metric;
+  }
+
+  if (act != TC_ACT_OK) {
+    if (flag & FLAGS_OUT) {
+      value.drops_out++;
+    } else {
+      value.drops_in++;
+    }
+  } else if (flag & FLAGS_OUT) {
+    value.bytes_out += skb->wire_len;
+    value.packets_out++;
+  } else {
+    value.bytes_in += skb->wire_len;
+    value.packets_in++;
+  }
+
+  bpf_map_update_elem(map, key, &value, metric == NULL ? BPF_ANY : BPF_EXIST);
 }
 
 static inline int throttle_flow(int key, uint64_t limit,
@@ -135,8 +174,9 @@ static inline int throttle_flow(int key, uint64_t limit,
 
 SEC("classifier") int tc_prog(struct __sk_buff *skb) {
   struct client_info *cli;
+  uint32_t client_ip;
   int flag;
-  get_flow_key(skb, &cli, &flag);
+  get_flow_key(skb, &cli, &client_ip, &flag);
 
   if (cli == NULL) {
     return throttle_flow(0, THROTTLE_RATE_BPS, skb);
@@ -150,29 +190,7 @@ SEC("classifier") int tc_prog(struct __sk_buff *skb) {
     act = throttle_flow(cli->account_id, cli->throttle_in_rate_bps / 8, skb);
   }
 
-  if (act != TC_ACT_OK) {
-    return act;
-  }
-
-  struct account_metric *metric =
-      bpf_map_lookup_elem(&account_metric_map, &cli->account_id);
-  if (metric == NULL) {
-    struct account_metric value = {
-        .bytes_in = (flag & FLAGS_OUT) ? 0 : skb->wire_len,
-        .bytes_out = (flag & FLAGS_OUT) ? skb->wire_len : 0,
-    };
-
-    bpf_map_update_elem(&account_metric_map, &cli->account_id, &value, BPF_ANY);
-  } else {
-    struct account_metric value = {
-        .bytes_in = metric->bytes_in + ((flag & FLAGS_OUT) ? 0 : skb->wire_len),
-        .bytes_out =
-            metric->bytes_out + ((flag & FLAGS_OUT) ? skb->wire_len : 0),
-    };
-
-    bpf_map_update_elem(&account_metric_map, &cli->account_id, &value,
-                        BPF_EXIST);
-  }
-
+  count_packet(&account_metric_map, &cli->account_id, flag, act, skb);
+  count_packet(&client_metric_map, &client_ip, flag, act, skb);
   return act;
 }
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/brian14708/wg-gatekeeper/auditlog"
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+const cliUsage = `Usage: wg-gatekeeper [flags] <command> [command flags] [args]
+
+Without a command the server is started. Commands use the database directly,
+or the REST API of a running instance if -api is set (with the token in
+$GATEKEEPER_API_TOKEN). Changes made to the database directly are applied by
+a running server at its next reconciliation, see -reconcile-interval.
+
+Commands:
+  account create -name NAME -interface ID -bandwidth-in MBPS -bandwidth-out MBPS [-device-limit N]
+  account list [-interface ID]
+  account delete ID
+  client add -account ID -name NAME [-public-key KEY] [-ip ADDRESS] [-keepalive SECONDS] [-no-preshared-key]
+  client show-config -account ID CLIENT_ID
+  client revoke -account ID CLIENT_ID
+  interface show [ID]
+  usage report [-interface ID]
+  audit query -account ID [-since RFC3339] [-limit N]
+  audit export [-account ID] [-from RFC3339] [-to RFC3339] [-format csv|parquet] [-o FILE]
+  import [-dry-run] [-zip FILE] FILE|-
+  export [-csv]
+
+Most commands accept -json to print JSON instead of a table.
+
+Flags:
+`
+
+// cliClient calls the REST API, either of a running instance or in process
+// against the local database.
+type cliClient struct {
+	base  string
+	token string
+	app   *fiber.App
+}
+
+func newCLIClient() (*cliClient, error) {
+	if *flagAPI != "" {
+		return &cliClient{
+			base:  strings.TrimSuffix(*flagAPI, "/") + apiPrefix,
+			token: os.Getenv("GATEKEEPER_API_TOKEN"),
+		}, nil
+	}
+
+	if err := openDB(); err != nil {
+		return nil, err
+	}
+	// there is no syncer in this process, a running server picks up the
+	// changes when reconciling
+	syncers = &Syncers{detached: true}
+
+	// changes are recorded as made by the system user
+	name := "cli"
+	if u, err := user.Current(); err == nil {
+		name += ":" + u.Username
+	}
+	app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+	apiHandler(app, func(c *fiber.Ctx) error {
+		c.Locals("user", &models.User{Username: name, Role: models.RoleAdmin})
+		return c.Next()
+	})
+	return &cliClient{base: apiPrefix, app: app}, nil
+}
+
+// do sends a request and decodes the response into out, which may be a
+// *string for plain text responses.
+func (cc *cliClient) do(method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, cc.base+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+cc.token)
+	}
+
+	var resp *http.Response
+	if cc.app != nil {
+		resp, err = cc.app.Test(req, -1)
+	} else {
+		resp, err = http.DefaultClient.Do(req)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		var ae apiError
+		if json.Unmarshal(b, &ae) != nil || ae.Message == "" {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		msg := ae.Message
+		var fields []string
+		for k, v := range ae.Fields {
+			fields = append(fields, k+": "+v)
+		}
+		sort.Strings(fields)
+		if len(fields) > 0 {
+			msg += ": " + strings.Join(fields, ", ")
+		}
+		return errors.New(msg)
+	}
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *string:
+		*out = string(b)
+		return nil
+	default:
+		return json.Unmarshal(b, out)
+	}
+}
+
+// runCommand runs a subcommand and returns the exit code.
+func runCommand(args []string) int {
+	cmd, rest := cliCommands[args[0]], args[1:]
+	if cmd == nil && len(args) >= 2 {
+		cmd, rest = cliCommands[args[0]+" "+args[1]], args[2:]
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", strings.Join(args, " "))
+		flag.Usage()
+		return 2
+	}
+
+	cc, err := newCLIClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := cmd(cc, rest); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, flag.ErrHelp) {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+var cliCommands = map[string]func(*cliClient, []string) error{
+	"account create": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("account create", flag.ContinueOnError)
+		var req apiAccountRequest
+		fs.StringVar(&req.Name, "name", "", "account name")
+		fs.IntVar(&req.InterfaceID, "interface", 0, "interface ID")
+		fs.Float64Var(&req.BandwidthInLimit, "bandwidth-in", 0, "download limit in Mb/s")
+		fs.Float64Var(&req.BandwidthOutLimit, "bandwidth-out", 0, "upload limit in Mb/s")
+		fs.IntVar(&req.DeviceLimit, "device-limit", 0, "portal device limit, 0 for no limit")
+		jsonOut := fs.Bool("json", false, "print JSON")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+
+		var acc apiAccount
+		if err := cc.do("POST", "/accounts", req, &acc); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(acc)
+		}
+		fmt.Println(acc.ID)
+		return nil
+	},
+	"account list": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("account list", flag.ContinueOnError)
+		iface := fs.Int("interface", 0, "only list accounts of this interface")
+		jsonOut := fs.Bool("json", false, "print JSON")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+
+		var accs []apiAccount
+		if err := cc.do("GET", "/accounts"+query("interface", *iface), nil, &accs); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(accs)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tINTERFACE\tDOWNLOAD (Mb/s)\tUPLOAD (Mb/s)\tDEVICE LIMIT")
+		for _, a := range accs {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%.2f\t%.2f\t%d\n", a.ID, a.Name, a.InterfaceID, a.BandwidthInLimit, a.BandwidthOutLimit, a.DeviceLimit)
+		}
+		return w.Flush()
+	},
+	"account delete": func(cc *cliClient, args []string) error {
+		id, err := idArg("account delete", args)
+		if err != nil {
+			return err
+		}
+		return cc.do("DELETE", "/accounts/"+id, nil, nil)
+	},
+	"client add": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("client add", flag.ContinueOnError)
+		var req apiClientRequest
+		account := fs.Int("account", 0, "account ID")
+		fs.StringVar(&req.Name, "name", "", "client name")
+		fs.StringVar(&req.PublicKey, "public-key", "", "public key of the client, generated if empty")
+		fs.StringVar(&req.IPAddress, "ip", "", "IP address of the client, the next free address if empty")
+		fs.IntVar(&req.PersistentKeepalive, "keepalive", 0, "persistent keepalive in seconds, 0 to use the interface setting")
+		noPSK := fs.Bool("no-preshared-key", false, "do not use a preshared key")
+		jsonOut := fs.Bool("json", false, "print JSON")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		psk := !*noPSK
+		req.PresharedKey = &psk
+
+		var resp apiClientConfig
+		if err := cc.do("POST", fmt.Sprintf("/accounts/%d/clients", *account), req, &resp); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(resp)
+		}
+		fmt.Println(resp.Config)
+		return nil
+	},
+	"client show-config": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("client show-config", flag.ContinueOnError)
+		account := fs.Int("account", 0, "account ID")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		id, err := idArg("client show-config", fs.Args())
+		if err != nil {
+			return err
+		}
+
+		var config string
+		if err := cc.do("GET", fmt.Sprintf("/accounts/%d/clients/%s/config", *account, id), nil, &config); err != nil {
+			return err
+		}
+		fmt.Println(config)
+		return nil
+	},
+	"client revoke": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("client revoke", flag.ContinueOnError)
+		account := fs.Int("account", 0, "account ID")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		id, err := idArg("client revoke", fs.Args())
+		if err != nil {
+			return err
+		}
+		return cc.do("DELETE", fmt.Sprintf("/accounts/%d/clients/%s", *account, id), nil, nil)
+	},
+	"interface show": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("interface show", flag.ContinueOnError)
+		jsonOut := fs.Bool("json", false, "print JSON")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+
+		var ifaces []apiInterface
+		if fs.NArg() > 0 {
+			var iface apiInterface
+			if err := cc.do("GET", "/interfaces/"+url.PathEscape(fs.Arg(0)), nil, &iface); err != nil {
+				return err
+			}
+			ifaces = append(ifaces, iface)
+		} else if err := cc.do("GET", "/interfaces", nil, &ifaces); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(ifaces)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tPORT\tSUBNET\tENDPOINT\tPUBLIC KEY")
+		for _, i := range ifaces {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\n", i.ID, i.Name, i.ListenPort, i.Subnet, i.ExternalIP, i.PublicKey)
+		}
+		return w.Flush()
+	},
+	"usage report": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("usage report", flag.ContinueOnError)
+		iface := fs.Int("interface", 0, "only report accounts of this interface")
+		jsonOut := fs.Bool("json", false, "print JSON")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+
+		var accs []apiAccount
+		if err := cc.do("GET", "/accounts"+query("interface", *iface), nil, &accs); err != nil {
+			return err
+		}
+		type usage struct {
+			ID        int    `json:"id"`
+			Name      string `json:"name"`
+			Interface int    `json:"interface_id"`
+			apiUsage
+		}
+		var report []usage
+		for _, a := range accs {
+			u := usage{ID: a.ID, Name: a.Name, Interface: a.InterfaceID}
+			if err := cc.do("GET", fmt.Sprintf("/accounts/%d/usage", a.ID), nil, &u.apiUsage); err != nil {
+				return err
+			}
+			report = append(report, u)
+		}
+		if *jsonOut {
+			return printJSON(report)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tINTERFACE\tDOWNLOAD (MB)\tUPLOAD (MB)")
+		for _, u := range report {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%.2f\t%.2f\n", u.ID, u.Name, u.Interface, float64(u.BytesIn)/1024/1024, float64(u.BytesOut)/1024/1024)
+		}
+		return w.Flush()
+	},
+	"audit query": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("audit query", flag.ContinueOnError)
+		account := fs.Int("account", 0, "account ID")
+		since := fs.String("since", "", "start of the time range (RFC 3339), defaults to 2 hours ago")
+		limit := fs.Int("limit", 100, "maximum number of destinations")
+		jsonOut := fs.Bool("json", false, "print JSON")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		closeAudit, err := cc.openAuditLog()
+		if err != nil {
+			return err
+		}
+		defer closeAudit()
+
+		q := url.Values{"limit": {strconv.Itoa(*limit)}}
+		if *since != "" {
+			q.Set("since", *since)
+		}
+		var logs []apiAccessLog
+		if err := cc.do("GET", fmt.Sprintf("/accounts/%d/audit?%s", *account, q.Encode()), nil, &logs); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(logs)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DESTINATION\tDOWNLOAD (MB)\tUPLOAD (MB)")
+		for _, l := range logs {
+			fmt.Fprintf(w, "%s\t%.2f\t%.2f\n", l.ServerName, float64(l.Recv)/1024/1024, float64(l.Sent)/1024/1024)
+		}
+		return w.Flush()
+	},
+	"audit export": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("audit export", flag.ContinueOnError)
+		account := fs.Int("account", 0, "only connections of the clients of this account")
+		from := fs.String("from", "", "start of the time range (RFC 3339)")
+		to := fs.String("to", "", "end of the time range (RFC 3339), exclusive")
+		format := fs.String("format", "csv", "csv or parquet")
+		out := fs.String("o", "", "write to this file instead of the standard output")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		closeAudit, err := cc.openAuditLog()
+		if err != nil {
+			return err
+		}
+		defer closeAudit()
+
+		q := url.Values{"format": {*format}}
+		if *account != 0 {
+			q.Set("account", strconv.Itoa(*account))
+		}
+		if *from != "" {
+			q.Set("from", *from)
+		}
+		if *to != "" {
+			q.Set("to", *to)
+		}
+		var data string
+		if err := cc.do("GET", "/audit/export?"+q.Encode(), nil, &data); err != nil {
+			return err
+		}
+		if *out == "" {
+			_, err := os.Stdout.WriteString(data)
+			return err
+		}
+		return os.WriteFile(*out, []byte(data), 0o600)
+	},
+	"import": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("import", flag.ContinueOnError)
+		dryRun := fs.Bool("dry-run", false, "only validate and preview the changes")
+		zipFile := fs.String("zip", "", "write the configurations of the created clients to this zip file")
+		jsonOut := fs.Bool("json", false, "print JSON")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: import [flags] FILE")
+		}
+		var data []byte
+		var err error
+		if fs.Arg(0) == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(fs.Arg(0))
+		}
+		if err != nil {
+			return err
+		}
+		b, err := parseBackup(data)
+		if err != nil {
+			return err
+		}
+
+		path := "/import"
+		if *dryRun {
+			path += "?dry_run=true"
+		}
+		var res importResult
+		if err := cc.do("POST", path, b, &res); err != nil {
+			return err
+		}
+		if *zipFile != "" && len(res.Configs) > 0 {
+			z, err := configZip(res.Configs)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(*zipFile, z, 0o600); err != nil {
+				return err
+			}
+		}
+		if *jsonOut {
+			if err := printJSON(res); err != nil {
+				return err
+			}
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ENTITY\tNAME\tACTION\tDETAIL")
+			for _, s := range res.Steps {
+				detail := s.Detail
+				if s.Error != "" {
+					detail = "ERROR: " + s.Error
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Entity, s.Name, s.Action, detail)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		if res.Errors > 0 {
+			return fmt.Errorf("%d error(s), nothing was imported", res.Errors)
+		}
+		return nil
+	},
+	"export": func(cc *cliClient, args []string) error {
+		fs := flag.NewFlagSet("export", flag.ContinueOnError)
+		csvOut := fs.Bool("csv", false, "print accounts and clients as CSV without keys")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+
+		var b backup
+		if err := cc.do("GET", "/export", nil, &b); err != nil {
+			return err
+		}
+		if *csvOut {
+			return writeCSV(os.Stdout, &b)
+		}
+		return printJSON(b)
+	},
+}
+
+// openAuditLog opens the audit log for commands using the database directly,
+// it can only be opened if the server is not running.
+func (cc *cliClient) openAuditLog() (func(), error) {
+	if _, err := os.Stat("audit.db"); err != nil || cc.app == nil || auditDB != nil {
+		return func() {}, nil
+	}
+	d, err := auditlog.New("audit.db")
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log, use -api if the server is running: %w", err)
+	}
+	auditDB = d
+	return func() {
+		d.Close()
+		auditDB = nil
+	}, nil
+}
+
+func idArg(cmd string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: %s [flags] ID", cmd)
+	}
+	if _, err := strconv.Atoi(args[0]); err != nil {
+		return "", fmt.Errorf("invalid ID %q", args[0])
+	}
+	return args[0], nil
+}
+
+func query(key string, id int) string {
+	if id == 0 {
+		return ""
+	}
+	return "?" + key + "=" + strconv.Itoa(id)
+}
+
+func printJSON(v any) error {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+func TestCLI(t *testing.T) {
+	iface := testDB(t)
+	cc, err := newCLIClient()
+	assert.NoError(t, err)
+	run := func(args ...string) error {
+		cmd, rest := cliCommands[args[0]+" "+args[1]], args[2:]
+		return cmd(cc, rest)
+	}
+
+	assert.NoError(t, run("account", "create", "-name", "bob", "-interface", strconv.Itoa(iface.ID),
+		"-bandwidth-in", "10", "-bandwidth-out", "10"))
+	var acc models.Account
+	assert.NoError(t, models.DB.Where("name = ?", "bob").First(&acc).Error)
+	account := strconv.Itoa(acc.ID)
+
+	assert.NoError(t, run("client", "add", "-account", account, "-name", "laptop", "-ip", "10.0.0.5"))
+	err = run("client", "add", "-account", account, "-name", "phone", "-ip", "10.0.0.5")
+	assert.EqualError(t, err, "IP address 10.0.0.5 is already used")
+
+	var cli models.Client
+	assert.NoError(t, models.DB.Where("account_id = ?", acc.ID).First(&cli).Error)
+	assert.NoError(t, run("client", "revoke", "-account", account, strconv.Itoa(cli.ID)))
+	assert.ErrorIs(t, models.DB.First(&cli, cli.ID).Error, gorm.ErrRecordNotFound)
+
+	// changes are left to the reconciliation of a running server
+	syncers.UpdateInterface(iface.ID)
+	assert.Nil(t, syncers.get(iface.ID))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+// entitySnapshot is the state of an entity recorded in the change history.
+// It must not contain secrets.
+type entitySnapshot struct {
+	entity    string
+	id        int
+	accountID int
+	value     any
+}
+
+type accountState struct {
+	Name        string `json:"name"`
+	InterfaceID int    `json:"interface_id"`
+	apiAccountLimits
+	PortalPassword bool   `json:"portal_password"`
+	Subject        string `json:"subject,omitempty"`
+}
+
+func accountSnapshot(acc models.Account) *entitySnapshot {
+	return &entitySnapshot{"account", acc.ID, acc.ID, accountState{
+		Name:             acc.Name,
+		InterfaceID:      acc.InterfaceID,
+		apiAccountLimits: toAPIAccount(acc).apiAccountLimits,
+		PortalPassword:   len(acc.PortalPasswordHash) > 0,
+		Subject:          acc.Subject,
+	}}
+}
+
+func clientSnapshot(cli models.Client) *entitySnapshot {
+	return &entitySnapshot{"client", cli.ID, cli.AccountID, toAPIClient(cli)}
+}
+
+func interfaceSnapshot(iface models.Interface) *entitySnapshot {
+	return &entitySnapshot{"interface", iface.ID, 0, toAPIInterface(iface)}
+}
+
+type userState struct {
+	Username string      `json:"username"`
+	Role     models.Role `json:"role"`
+	Subject  string      `json:"subject,omitempty"`
+}
+
+func userSnapshot(user models.User) *entitySnapshot {
+	return &entitySnapshot{"user", user.ID, 0, userState{user.Username, user.Role, user.Subject}}
+}
+
+type tokenState struct {
+	Name string      `json:"name"`
+	Role models.Role `json:"role"`
+}
+
+func tokenSnapshot(tok models.APIToken) *entitySnapshot {
+	return &entitySnapshot{"token", tok.ID, 0, tokenState{tok.Name, tok.Role}}
+}
+
+// recordEvent stores a change made by actor in the change history. before
+// is nil for created and after for deleted entities. Failures are logged,
+// the change itself has already been made.
+func recordEvent(actor, action string, before, after *entitySnapshot) {
+	s := after
+	if s == nil {
+		s = before
+	}
+	e := models.Event{
+		Actor:     actor,
+		Action:    action,
+		Entity:    s.entity,
+		EntityID:  s.id,
+		AccountID: s.accountID,
+	}
+	for _, v := range []struct {
+		s   *entitySnapshot
+		dst *string
+	}{{before, &e.Before}, {after, &e.After}} {
+		if v.s == nil {
+			continue
+		}
+		b, err := json.Marshal(v.s.value)
+		if err != nil {
+			log.Printf("history: %v", err)
+			return
+		}
+		*v.dst = string(b)
+	}
+	if ret := models.DB.Create(&e); ret.Error != nil {
+		log.Printf("history: %v", ret.Error)
+	}
+}
+
+// actor names who makes the changes of a request: the user, the API token
+// or the account holder signed in to the portal.
+func actor(c *fiber.Ctx) string {
+	if user := currentUser(c); user != nil {
+		return user.Username
+	}
+	if acc := currentAccount(c); acc != nil {
+		return "portal:" + acc.Name
+	}
+	return "anonymous"
+}
+
+// eventQuery filters events by the account, entity, entity_id, actor and
+// before (event ID) query parameters.
+func eventQuery(c *fiber.Ctx) *gorm.DB {
+	q := models.DB.Model(&models.Event{})
+	if id := c.QueryInt("account"); id != 0 {
+		q = q.Where("account_id = ?", id)
+	}
+	if e := c.Query("entity"); e != "" {
+		q = q.Where("entity = ?", e)
+	}
+	if id := c.QueryInt("entity_id"); id != 0 {
+		q = q.Where("entity_id = ?", id)
+	}
+	if a := c.Query("actor"); a != "" {
+		q = q.Where("actor = ?", a)
+	}
+	if id := c.QueryInt("before"); id != 0 {
+		q = q.Where("id < ?", id)
+	}
+	return q
+}
+
+type fieldChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// historyEvent is an event prepared for the views.
+type historyEvent struct {
+	models.Event
+	Name    string
+	Changes []fieldChange
+}
+
+func decodeSnapshot(s string) map[string]any {
+	m := map[string]any{}
+	if s != "" {
+		json.Unmarshal([]byte(s), &m)
+	}
+	return m
+}
+
+func toHistoryEvent(e models.Event) historyEvent {
+	before, after := decodeSnapshot(e.Before), decodeSnapshot(e.After)
+	h := historyEvent{Event: e}
+	for _, m := range []map[string]any{after, before} {
+		for _, k := range []string{"name", "username"} {
+			if v, ok := m[k].(string); ok && h.Name == "" {
+				h.Name = v
+			}
+		}
+	}
+	if e.After == "" {
+		return h
+	}
+
+	var keys []string
+	for k := range after {
+		keys = append(keys, k)
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b, a := formatValue(before[k]), formatValue(after[k])
+		if b != a {
+			h.Changes = append(h.Changes, fieldChange{k, b, a})
+		}
+	}
+	return h
+}
+
+func formatValue(v any) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func toHistoryEvents(events []models.Event) []historyEvent {
+	var result []historyEvent
+	for _, e := range events {
+		result = append(result, toHistoryEvent(e))
+	}
+	return result
+}
+
+const historyPageSize = 50
+
+func historyHandler(app *fiber.App) {
+	// change history
+	app.Get("/history", requireRole(models.RoleAuditor), func(c *fiber.Ctx) error {
+		var events []models.Event
+		if ret := eventQuery(c).Order("id DESC").Limit(historyPageSize).Find(&events); ret.Error != nil {
+			return ret.Error
+		}
+
+		q, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+		q.Del("before")
+		filter := q.Encode()
+		var older string
+		if len(events) == historyPageSize {
+			q.Set("before", strconv.Itoa(events[len(events)-1].ID))
+			older = "/history?" + q.Encode()
+		}
+		var acc models.Account
+		if id := c.QueryInt("account"); id != 0 {
+			models.DB.Unscoped().First(&acc, id)
+		}
+		return c.Render("history", fiber.Map{
+			"Events":   toHistoryEvents(events),
+			"Account":  acc,
+			"Entity":   c.Query("entity"),
+			"Actor":    c.Query("actor"),
+			"Entities": []string{"account", "client", "interface", "user", "token"},
+			"Export":   "/history.json?" + filter,
+			"Older":    older,
+		})
+	})
+
+	// export of the change history, oldest first
+	app.Get("/history.json", requireRole(models.RoleAuditor), func(c *fiber.Ctx) error {
+		var events []models.Event
+		if ret := eventQuery(c).Order("id").Find(&events); ret.Error != nil {
+			return ret.Error
+		}
+		result := []apiEvent{}
+		for _, e := range events {
+			result = append(result, toAPIEvent(e))
+		}
+		c.Attachment("history.json")
+		return c.JSON(result)
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+func TestHistoryAccountLimits(t *testing.T) {
+	app, iface := testApp(t)
+	testUser(t, "alice", models.RoleOperator)
+	token := testToken(t, models.RoleOperator)
+	acc := models.Account{Name: "bob", InterfaceID: iface.ID}
+	apiAccountLimits{BandwidthInLimit: 10, BandwidthOutLimit: 10}.apply(&acc)
+	assert.NoError(t, models.DB.Create(&acc).Error)
+	other := models.Account{Name: "carol", InterfaceID: iface.ID}
+	assert.NoError(t, models.DB.Create(&other).Error)
+	id := strconv.Itoa(acc.ID)
+
+	s := newTestSession(t, app)
+	s.login("alice")
+	resp := s.post("/account/"+id, url.Values{"bandwidth_in_limit": {"20"}, "bandwidth_out_limit": {"5"}})
+	assert.Equal(t, "/account/"+id, resp.Header.Get("Location"))
+	status, ae := apiCall(t, app, token, "PUT", "/accounts/"+id, apiAccountLimits{BandwidthInLimit: 30, BandwidthOutLimit: 5, DeviceLimit: 2})
+	assert.Equal(t, 200, status, ae.Message)
+	status, _ = apiCall(t, app, token, "DELETE", "/accounts/"+strconv.Itoa(other.ID), nil)
+	assert.Equal(t, 204, status)
+
+	resp, body := s.do("GET", "/history.json?account="+id, nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Disposition"), "history.json")
+	var events []apiEvent
+	assert.NoError(t, json.Unmarshal([]byte(body), &events))
+	if !assert.Len(t, events, 2) {
+		t.FailNow()
+	}
+
+	state := func(in, out float64, devices int) map[string]any {
+		m := map[string]any{
+			"name": "bob", "interface_id": float64(iface.ID), "portal_password": false,
+			"bandwidth_in_limit": in, "bandwidth_out_limit": out,
+		}
+		if devices != 0 {
+			m["device_limit"] = float64(devices)
+		}
+		return m
+	}
+	ui, api := events[0], events[1]
+	assert.Equal(t, "alice", ui.Actor)
+	assert.Equal(t, "update", ui.Action)
+	assert.Equal(t, "account", ui.Entity)
+	assert.Equal(t, acc.ID, ui.EntityID)
+	assert.Equal(t, acc.ID, ui.AccountID)
+	assert.Equal(t, state(10, 10, 0), ui.Before)
+	assert.Equal(t, state(20, 5, 0), ui.After)
+
+	assert.Equal(t, "token:operator", api.Actor)
+	assert.Equal(t, "update", api.Action)
+	assert.Equal(t, "account", api.Entity)
+	assert.Equal(t, acc.ID, api.EntityID)
+	assert.Equal(t, state(20, 5, 0), api.Before)
+	assert.Equal(t, state(30, 5, 2), api.After)
+
+	// the global history also has the deletion
+	_, body = s.do("GET", "/history.json", nil)
+	assert.NoError(t, json.Unmarshal([]byte(body), &events))
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, "delete", events[2].Action)
+		assert.Equal(t, other.ID, events[2].EntityID)
+		assert.Nil(t, events[2].After)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "sync"
+
+// Hub fans out events to subscribers. Slow subscribers miss events instead
+// of blocking the publisher.
+type Hub[T any] struct {
+	mu   sync.Mutex
+	subs map[chan T]struct{}
+}
+
+func NewHub[T any]() *Hub[T] {
+	return &Hub[T]{subs: make(map[chan T]struct{})}
+}
+
+func (h *Hub[T]) Subscribe() chan T {
+	ch := make(chan T, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *Hub[T]) Unsubscribe(ch chan T) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, ch)
+}
+
+func (h *Hub[T]) Publish(t T) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- t:
+		default:
+		}
+	}
+}
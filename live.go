@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/brian14708/wg-gatekeeper/auditlog"
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+// PeerTick is published by a Syncer every time it samples the peers of its
+// interface.
+type PeerTick struct {
+	InterfaceID int
+	Time        time.Time
+	Peers       map[wgtypes.Key]PeerStatus
+}
+
+// AuditEntry is published for every connection added to the audit log.
+type AuditEntry struct {
+	Src        net.IP
+	ServerName string
+	Protocol   auditlog.Protocol
+	Sent       uint64
+	Recv       uint64
+	Time       time.Time
+}
+
+var (
+	peerHub  = NewHub[PeerTick]()
+	auditHub = NewHub[AuditEntry]()
+)
+
+// liveHeartbeat is how often an idle event stream is written to, closed
+// connections are only noticed on write.
+const liveHeartbeat = 15 * time.Second
+
+type liveAccount struct {
+	AccountID    int     `json:"account_id"`
+	Online       int     `json:"online"`
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+}
+
+type livePeers struct {
+	InterfaceID int               `json:"interface_id"`
+	Accounts    []liveAccount     `json:"accounts"`
+	Clients     []apiClientStatus `json:"clients,omitempty"`
+}
+
+type liveBytes struct {
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+type liveUsage struct {
+	Accounts map[int]liveBytes `json:"accounts"`
+	Clients  map[int]liveBytes `json:"clients,omitempty"`
+}
+
+type liveAudit struct {
+	AccountID   int               `json:"account_id"`
+	AccountName string            `json:"account_name"`
+	ClientID    int               `json:"client_id"`
+	ServerName  string            `json:"server_name"`
+	Protocol    auditlog.Protocol `json:"protocol"`
+	Sent        uint64            `json:"sent"`
+	Recv        uint64            `json:"recv"`
+	Time        time.Time         `json:"time"`
+}
+
+// liveClient is a client with what is needed to attribute peers and audit
+// entries to it.
+type liveClient struct {
+	ID          int
+	AccountID   int
+	AccountName string
+	InterfaceID int
+	IPAddress   string
+	PublicKey   []byte
+}
+
+// liveIndex caches the clients an event stream reports on, all clients or
+// the clients of a single account.
+type liveIndex struct {
+	accountID int
+
+	loaded time.Time
+	byKey  map[wgtypes.Key]liveClient
+	byIP   map[string]liveClient
+}
+
+// load reloads the clients if they were loaded more than a peer interval
+// ago.
+func (ix *liveIndex) load() error {
+	if time.Since(ix.loaded) < PeerInterval {
+		return nil
+	}
+	var clients []liveClient
+	q := models.DB.Table("clients").
+		Select("clients.id, clients.account_id, accounts.name AS account_name, accounts.interface_id, clients.ip_address, clients.public_key").
+		Joins("JOIN accounts ON accounts.id = clients.account_id AND accounts.deleted_at IS NULL").
+		Where("clients.deleted_at IS NULL")
+	if ix.accountID != 0 {
+		q = q.Where("clients.account_id = ?", ix.accountID)
+	}
+	if ret := q.Scan(&clients); ret.Error != nil {
+		return ret.Error
+	}
+	ix.byKey = make(map[wgtypes.Key]liveClient, len(clients))
+	ix.byIP = make(map[string]liveClient, len(clients))
+	for _, cli := range clients {
+		if key, err := wgtypes.NewKey(cli.PublicKey); err == nil {
+			ix.byKey[key] = cli
+		}
+		ix.byIP[cli.IPAddress] = cli
+	}
+	ix.loaded = time.Now()
+	return nil
+}
+
+// peers sums the throughput of the peers on an interface by account, and
+// returns the status of every client if the index is for a single account.
+func (ix *liveIndex) peers(ifaceID int, peers map[wgtypes.Key]PeerStatus) ([]liveAccount, []apiClientStatus) {
+	accounts := make(map[int]*liveAccount)
+	var clients []apiClientStatus
+	for key, p := range peers {
+		cli, ok := ix.byKey[key]
+		if !ok || cli.InterfaceID != ifaceID {
+			continue
+		}
+		acc := accounts[cli.AccountID]
+		if acc == nil {
+			acc = &liveAccount{AccountID: cli.AccountID}
+			accounts[cli.AccountID] = acc
+		}
+		if p.Online() {
+			acc.Online++
+		}
+		acc.DownloadRate += p.TransmitRate
+		acc.UploadRate += p.ReceiveRate
+		if ix.accountID != 0 {
+			clients = append(clients, toAPIClientStatus(cli.ID, p))
+		}
+	}
+
+	ret := make([]liveAccount, 0, len(accounts))
+	for _, acc := range accounts {
+		ret = append(ret, *acc)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].AccountID < ret[j].AccountID })
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ClientID < clients[j].ClientID })
+	return ret, clients
+}
+
+// liveAccounts returns the current throughput of all accounts by account ID.
+func liveAccounts() (map[int]liveAccount, error) {
+	ix := &liveIndex{}
+	if err := ix.load(); err != nil {
+		return nil, err
+	}
+	ifaces := make(map[int]struct{})
+	for _, cli := range ix.byKey {
+		ifaces[cli.InterfaceID] = struct{}{}
+	}
+	ret := make(map[int]liveAccount)
+	for ifaceID := range ifaces {
+		accounts, _ := ix.peers(ifaceID, syncers.Peers(ifaceID))
+		for _, acc := range accounts {
+			ret[acc.AccountID] = acc
+		}
+	}
+	return ret, nil
+}
+
+func (ix *liveIndex) usage(t UsageTick) liveUsage {
+	ret := liveUsage{Accounts: make(map[int]liveBytes)}
+	for accountID, d := range t.Deltas {
+		if ix.accountID == 0 || ix.accountID == accountID {
+			ret.Accounts[accountID] = liveBytes(d)
+		}
+	}
+	if ix.accountID != 0 {
+		ret.Clients = make(map[int]liveBytes)
+		for clientID, d := range t.Clients {
+			if d.AccountID == ix.accountID {
+				ret.Clients[clientID] = liveBytes(d.UsageDelta)
+			}
+		}
+	}
+	return ret
+}
+
+// stream writes the events to w until the connection is closed.
+func (ix *liveIndex) stream(w *bufio.Writer) {
+	peers := peerHub.Subscribe()
+	defer peerHub.Unsubscribe(peers)
+	usage := usageHub.Subscribe()
+	defer usageHub.Unsubscribe(usage)
+	audit := auditHub.Subscribe()
+	defer auditHub.Unsubscribe(audit)
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+
+	// the headers are only sent on the first flush
+	if writeComment(w, "connected") != nil {
+		return
+	}
+	for {
+		var err error
+		select {
+		case t := <-peers:
+			if err = ix.load(); err != nil {
+				log.Printf("event stream: %v", err)
+				return
+			}
+			accounts, clients := ix.peers(t.InterfaceID, t.Peers)
+			if len(accounts) > 0 || len(clients) > 0 {
+				err = writeEvent(w, "peers", livePeers{InterfaceID: t.InterfaceID, Accounts: accounts, Clients: clients})
+			}
+		case t := <-usage:
+			if u := ix.usage(t); len(u.Accounts) > 0 || len(u.Clients) > 0 {
+				err = writeEvent(w, "usage", u)
+			}
+		case e := <-audit:
+			cli, ok := ix.byIP[e.Src.String()]
+			if !ok {
+				continue
+			}
+			err = writeEvent(w, "audit", liveAudit{
+				AccountID:   cli.AccountID,
+				AccountName: cli.AccountName,
+				ClientID:    cli.ID,
+				ServerName:  e.ServerName,
+				Protocol:    e.Protocol,
+				Sent:        e.Sent,
+				Recv:        e.Recv,
+				Time:        e.Time,
+			})
+		case <-heartbeat.C:
+			err = writeComment(w, "heartbeat")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w *bufio.Writer, event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func writeComment(w *bufio.Writer, comment string) error {
+	if _, err := fmt.Fprintf(w, ": %s\n\n", comment); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func liveHandler(app *fiber.App) {
+	// server-sent events updating the account pages in place, for all
+	// accounts or a single one
+	app.Get("/events", requireRole(models.RoleAuditor), func(c *fiber.Ctx) error {
+		ix := &liveIndex{accountID: c.QueryInt("account")}
+		if err := ix.load(); err != nil {
+			return err
+		}
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set("X-Accel-Buffering", "no")
+		c.Context().SetBodyStreamWriter(ix.stream)
+		return nil
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/brian14708/wg-gatekeeper/wireguard"
+)
+
+func TestLiveUsage(t *testing.T) {
+	tick := UsageTick{
+		Deltas: map[int]UsageDelta{1: {BytesIn: 30, BytesOut: 3}, 2: {BytesIn: 5}},
+		Clients: map[int]ClientUsageDelta{
+			10: {1, UsageDelta{BytesIn: 10, BytesOut: 1}},
+			11: {1, UsageDelta{BytesIn: 20, BytesOut: 2}},
+			20: {2, UsageDelta{BytesIn: 5}},
+		},
+	}
+
+	all := (&liveIndex{}).usage(tick)
+	assert.Equal(t, map[int]liveBytes{1: {30, 3}, 2: {5, 0}}, all.Accounts)
+	assert.Nil(t, all.Clients, "clients are only sent for a single account")
+
+	one := (&liveIndex{accountID: 1}).usage(tick)
+	assert.Equal(t, map[int]liveBytes{1: {30, 3}}, one.Accounts)
+	assert.Equal(t, map[int]liveBytes{10: {10, 1}, 11: {20, 2}}, one.Clients)
+
+	idle := (&liveIndex{accountID: 3}).usage(tick)
+	assert.Empty(t, idle.Accounts)
+	assert.Empty(t, idle.Clients)
+}
+
+func TestLivePeers(t *testing.T) {
+	keys := make([]wgtypes.Key, 5)
+	for i := range keys {
+		var err error
+		keys[i], err = wgtypes.GenerateKey()
+		assert.NoError(t, err)
+	}
+	clients := map[wgtypes.Key]liveClient{
+		keys[0]: {ID: 10, AccountID: 1, InterfaceID: 1},
+		keys[1]: {ID: 11, AccountID: 1, InterfaceID: 1},
+		keys[2]: {ID: 20, AccountID: 2, InterfaceID: 1},
+		// a client of another interface
+		keys[3]: {ID: 30, AccountID: 3, InterfaceID: 2},
+	}
+	now := time.Now()
+	peer := func(handshake time.Time, rx, tx float64) PeerStatus {
+		return PeerStatus{PeerStatus: wireguard.PeerStatus{LastHandshake: handshake}, SampledAt: now, ReceiveRate: rx, TransmitRate: tx}
+	}
+	peers := map[wgtypes.Key]PeerStatus{
+		keys[0]: peer(now, 1, 100),
+		keys[1]: peer(now.Add(-time.Hour), 2, 200),
+		keys[2]: peer(time.Time{}, 0, 0),
+		keys[3]: peer(now, 5, 5),
+		// not a client
+		keys[4]: peer(now, 5, 5),
+	}
+
+	accounts, statuses := (&liveIndex{byKey: clients}).peers(1, peers)
+	assert.Equal(t, []liveAccount{
+		{AccountID: 1, Online: 1, DownloadRate: 300, UploadRate: 3},
+		{AccountID: 2},
+	}, accounts)
+	assert.Nil(t, statuses, "clients are only sent for a single account")
+
+	// the index of an account only has its own clients, see load
+	own := map[wgtypes.Key]liveClient{keys[0]: clients[keys[0]], keys[1]: clients[keys[1]]}
+	accounts, statuses = (&liveIndex{accountID: 1, byKey: own}).peers(1, peers)
+	assert.Equal(t, []liveAccount{{AccountID: 1, Online: 1, DownloadRate: 300, UploadRate: 3}}, accounts)
+	if assert.Len(t, statuses, 2) {
+		assert.Equal(t, 10, statuses[0].ClientID)
+		assert.True(t, statuses[0].Online)
+		assert.Equal(t, float64(100), statuses[0].DownloadRate)
+		assert.Equal(t, 11, statuses[1].ClientID)
+		assert.False(t, statuses[1].Online)
+	}
+
+	accounts, _ = (&liveIndex{byKey: clients}).peers(3, peers)
+	assert.Empty(t, accounts)
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/brian14708/wg-gatekeeper/auditlog"
@@ -23,6 +24,21 @@ func startLog(srv *grpc.Server) {
 		log.Fatalf("failed to open auditlog: %v", err)
 	}
 	auditDB = d
+	d.StartRetention(auditlog.Retention{
+		RawDays:       *flagAuditRetentionDays,
+		SummaryMonths: *flagAuditSummaryMonths,
+	})
+	if *flagAuditExportDir != "" {
+		format := auditlog.Format(*flagAuditExportFormat)
+		if format != auditlog.FormatParquet && format != auditlog.FormatCSV {
+			log.Fatalf("invalid audit export format %q", format)
+		}
+		d.StartExport(auditlog.ExportSchedule{
+			Dir:    *flagAuditExportDir,
+			Format: format,
+			Keep:   *flagAuditExportKeep,
+		})
+	}
 
 	v3.RegisterAccessLogServiceServer(srv, &LogServer{d})
 }
@@ -47,7 +63,7 @@ func (ls *LogServer) StreamAccessLogs(s v3.AccessLogService_StreamAccessLogsServ
 			} else {
 				ts = t.AsTime()
 			}
-			err := ls.db.Insert(
+			ls.insert(
 				net.ParseIP(l.GetCommonProperties().GetDownstreamDirectRemoteAddress().GetSocketAddress().GetAddress()),
 				uint16(l.GetCommonProperties().GetDownstreamDirectRemoteAddress().GetSocketAddress().GetPortValue()),
 				net.ParseIP(l.GetCommonProperties().GetUpstreamRemoteAddress().GetSocketAddress().GetAddress()),
@@ -58,9 +74,6 @@ func (ls *LogServer) StreamAccessLogs(s v3.AccessLogService_StreamAccessLogsServ
 				l.GetRequest().GetAuthority(),
 				ts,
 			)
-			if err != nil {
-				fmt.Println(err)
-			}
 		}
 		for _, l := range msg.GetTcpLogs().GetLogEntry() {
 			var ts time.Time
@@ -73,7 +86,7 @@ func (ls *LogServer) StreamAccessLogs(s v3.AccessLogService_StreamAccessLogsServ
 			if l.GetCommonProperties().GetTlsProperties() != nil {
 				proto = auditlog.ProtocolTLS
 			}
-			err := ls.db.Insert(
+			ls.insert(
 				net.ParseIP(l.GetCommonProperties().GetDownstreamDirectRemoteAddress().GetSocketAddress().GetAddress()),
 				uint16(l.GetCommonProperties().GetDownstreamDirectRemoteAddress().GetSocketAddress().GetPortValue()),
 				net.ParseIP(l.GetCommonProperties().GetUpstreamRemoteAddress().GetSocketAddress().GetAddress()),
@@ -84,9 +97,38 @@ func (ls *LogServer) StreamAccessLogs(s v3.AccessLogService_StreamAccessLogsServ
 				l.GetCommonProperties().GetTlsProperties().GetTlsSniHostname(),
 				ts,
 			)
-			if err != nil {
-				fmt.Println(err)
-			}
 		}
 	}
 }
+
+// insert adds an entry to the audit log and publishes it to the live
+// dashboards.
+func (ls *LogServer) insert(
+	src net.IP, srcPort uint16,
+	dst net.IP, dstPort uint16,
+	sentBytes uint64, receivedBytes uint64,
+	protocol auditlog.Protocol, serverName string,
+	startTime time.Time,
+) {
+	auditLogEntries.WithLabelValues(string(protocol)).Inc()
+	if sentBytes == 0 && receivedBytes == 0 {
+		return
+	}
+	if serverName == "" {
+		serverName = net.JoinHostPort(dst.String(), strconv.Itoa(int(dstPort)))
+	}
+	err := ls.db.Insert(src, srcPort, dst, dstPort, sentBytes, receivedBytes, protocol, serverName, startTime)
+	if err != nil {
+		auditLogErrors.Inc()
+		fmt.Println(err)
+		return
+	}
+	auditHub.Publish(AuditEntry{
+		Src:        src,
+		ServerName: serverName,
+		Protocol:   protocol,
+		Sent:       sentBytes,
+		Recv:       receivedBytes,
+		Time:       startTime,
+	})
+}
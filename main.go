@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Masterminds/sprig/v3"
@@ -20,6 +23,8 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/brian14708/wg-gatekeeper/models"
+	"github.com/brian14708/wg-gatekeeper/secret"
+	"github.com/brian14708/wg-gatekeeper/sso"
 )
 
 var (
@@ -29,20 +34,95 @@ var (
 	flagEnvoyListen = flag.Int("envoy-listen", 9001, "port for envoy tcp proxy")
 	flagEnvoyTcp    = flag.Int("envoy-tcp-proxy", 15000, "port for envoy tcp proxy")
 
-	syncer *Syncer
-)
+	flagAuditRetentionDays = flag.Int("audit-retention-days", 30, "days connections are kept in the audit log before being rolled up into daily summaries, 0 to keep forever")
+	flagAuditSummaryMonths = flag.Int("audit-summary-months", 12, "months the daily summaries of the audit log are kept, 0 to keep forever")
+	flagAuditExportDir     = flag.String("audit-export-dir", "", "directory the connections of the audit log are exported to daily; disabled if empty")
+	flagAuditExportFormat  = flag.String("audit-export-format", "parquet", "format of the daily audit log exports, parquet or csv")
+	flagAuditExportKeep    = flag.Int("audit-export-keep", 90, "number of daily audit log exports kept, 0 to keep all")
 
-func main() {
-	flag.Parse()
+	flagAPI = flag.String("api", "", "base URL of a running instance for commands, e.g. http://127.0.0.1:3000; the database is used directly if empty")
+
+	flagManagementListen = flag.String("management-listen", "", "address for the gRPC management API, e.g. 127.0.0.1:9002; disabled if empty")
+
+	flagMetricsListen = flag.String("metrics-listen", "", "address for the Prometheus metrics endpoint /metrics, e.g. 127.0.0.1:9100; disabled if empty")
+
+	flagSecretKeyFile = flag.String("secret-key-file", "secret.key", "path to the key used to encrypt secrets in the database, created if missing; overridden by $GATEKEEPER_SECRET_KEY")
+
+	flagStoreClientKeys = flag.Bool("store-client-keys", false, "store generated client private keys encrypted so configurations can be downloaded again")
+
+	flagReconcileInterval = flag.Duration("reconcile-interval", time.Minute, "interval for reconciling device state with the database")
+
+	flagOIDCIssuer               = flag.String("oidc-issuer", "", "OpenID Connect issuer URL, enables single sign-on")
+	flagOIDCClientID             = flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	flagOIDCClientSecret         = flag.String("oidc-client-secret", "", "OpenID Connect client secret; overridden by $GATEKEEPER_OIDC_CLIENT_SECRET")
+	flagOIDCRedirectURL          = flag.String("oidc-redirect-url", "", "OpenID Connect redirect URL, e.g. https://gatekeeper.example.com/sso/callback")
+	flagOIDCGroupsClaim          = flag.String("oidc-groups-claim", "groups", "ID token claim containing the groups of a user")
+	flagOIDCAdminGroups          = flag.String("oidc-admin-groups", "", "comma separated groups granted the admin role")
+	flagOIDCOperatorGroups       = flag.String("oidc-operator-groups", "", "comma separated groups granted the operator role")
+	flagOIDCAuditorGroups        = flag.String("oidc-auditor-groups", "", "comma separated groups granted the auditor role")
+	flagOIDCProvisionInterface   = flag.Int("oidc-provision-interface", 0, "interface ID for accounts created on first single sign-on of users without a role, 0 to disable")
+	flagOIDCProvisionBandwidth   = flag.Float64("oidc-provision-bandwidth", 10, "bandwidth limit (Mb/s) of provisioned accounts")
+	flagOIDCProvisionDeviceLimit = flag.Int("oidc-provision-device-limit", 3, "device limit of provisioned accounts, 0 for no limit")
+
+	syncers     *Syncers
+	secrets     *secret.Box
+	ssoProvider *sso.Provider
+)
 
+// openDB opens the database and loads the secret key.
+func openDB() error {
 	db, err := gorm.Open(sqlite.Open(*flagDBPath+"?_foreign_keys=on"), &gorm.Config{})
 	if err != nil {
-		panic("failed to connect database")
+		return fmt.Errorf("failed to connect database: %w", err)
 	}
 	models.Init(db)
 
-	syncer = NewSyncer()
-	syncer.UpdateInterface()
+	secrets, err = secret.Load(os.Getenv("GATEKEEPER_SECRET_KEY"), *flagSecretKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load secret key: %w", err)
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), cliUsage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	if err := openDB(); err != nil {
+		log.Fatal(err)
+	}
+
+	syncers = NewSyncers()
+	go pruneUsage()
+
+	if *flagOIDCIssuer != "" {
+		clientSecret := *flagOIDCClientSecret
+		if s := os.Getenv("GATEKEEPER_OIDC_CLIENT_SECRET"); s != "" {
+			clientSecret = s
+		}
+		var err error
+		ssoProvider, err = sso.New(context.Background(), sso.Config{
+			Issuer:       *flagOIDCIssuer,
+			ClientID:     *flagOIDCClientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  *flagOIDCRedirectURL,
+			GroupsClaim:  *flagOIDCGroupsClaim,
+			RoleGroups: map[models.Role][]string{
+				models.RoleAdmin:    splitList(*flagOIDCAdminGroups),
+				models.RoleOperator: splitList(*flagOIDCOperatorGroups),
+				models.RoleAuditor:  splitList(*flagOIDCAuditorGroups),
+			},
+		})
+		if err != nil {
+			log.Fatalf("failed to setup single sign-on: %v", err)
+		}
+	}
 
 	if *flagEnvoy {
 		grpcServer := grpc.NewServer()
@@ -56,29 +136,50 @@ func main() {
 		go grpcServer.Serve(l)
 	}
 
+	if *flagManagementListen != "" {
+		startManagement(*flagManagementListen)
+	}
+
+	if *flagMetricsListen != "" {
+		startMetrics(*flagMetricsListen)
+	}
+
+	newApp().Listen(*flagListen)
+}
+
+// newApp returns the web UI and REST API with all middlewares and handlers.
+func newApp() *fiber.App {
 	vfs := GetViews()
 	engine := html.NewFileSystem(http.FS(vfs), ".html")
 	engine.AddFuncMap(sprig.FuncMap())
 	engine.Reload(Debug)
 
 	app := fiber.New(fiber.Config{
-		Views:       engine,
-		ViewsLayout: "layouts/main",
+		Views:        engine,
+		ViewsLayout:  "layouts/main",
+		ErrorHandler: errorHandler,
 	})
 
-	app.Use(compress.New())
+	app.Use(compress.New(compress.Config{
+		// compression buffers the event stream
+		Next: func(c *fiber.Ctx) bool { return c.Path() == "/events" },
+	}))
 	app.Use("/assets", filesystem.New(filesystem.Config{
 		Root:   http.FS(GetAssets()),
 		MaxAge: int(time.Hour / time.Second),
 	}))
 
+	app.Use(csrfMiddleware)
+	app.Use(authMiddleware)
+
 	instanceKey := strconv.Itoa(rand.Int())
 	app.Use(func(c *fiber.Ctx) error {
-		if c.Cookies("iface") != instanceKey {
+		if user := currentUser(c); user != nil && c.Cookies("iface") != instanceKey {
 			var cnt int64
 			models.DB.Model(&models.Interface{}).Count(&cnt)
 			if cnt == 0 {
-				if c.Path() != "/interface" {
+				// interfaces can also be created through the API
+				if c.Path() != "/interface" && c.Path() != "/tokens" && user.Role.Allows(models.RoleAdmin) {
 					flashInfo(c, "Please setup interface first")
 					return c.Redirect("/interface")
 				}
@@ -93,6 +194,13 @@ func main() {
 			}
 		}
 
+		if errs, skipped := syncers.Errors(), syncers.Skipped(); currentUser(c) != nil && (len(errs) > 0 || len(skipped) > 0) {
+			c.Bind(fiber.Map{
+				"SyncErrors":  errs,
+				"SyncSkipped": skipped,
+			})
+		}
+
 		if c.Cookies("flash_error") != "" {
 			c.Bind(fiber.Map{
 				"FlashError": c.Cookies("flash_error"),
@@ -121,7 +229,28 @@ func main() {
 		return c.Next()
 	})
 
+	authHandler(app)
+	if ssoProvider != nil {
+		ssoHandler(app, ssoProvider)
+	}
+	portalHandler(app)
+	apiHandler(app, apiAuth)
+	historyHandler(app)
+	bulkHandler(app)
+	liveHandler(app)
+	auditHandler(app)
 	appHandler(app)
 
-	app.Listen(*flagListen)
+	return app
+}
+
+// splitList splits a comma separated flag value.
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
 }
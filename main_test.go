@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+// testDB opens a fresh database with an interface and returns the interface.
+// There is no syncer, changes are only made to the database.
+func testDB(t *testing.T) models.Interface {
+	dir := t.TempDir()
+	*flagDBPath = filepath.Join(dir, "db.sqlite")
+	*flagSecretKeyFile = filepath.Join(dir, "secret.key")
+	if !assert.NoError(t, openDB()) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		if db, err := models.DB.DB(); err == nil {
+			db.Close()
+		}
+	})
+	syncers = &Syncers{detached: true}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	assert.NoError(t, err)
+	iface := models.Interface{
+		Name:       "wg0",
+		PrivateKey: key[:],
+		ListenPort: 51820,
+		Subnet:     "10.0.0.1/24",
+		ExternalIP: "192.0.2.1",
+	}
+	assert.NoError(t, models.DB.Create(&iface).Error)
+	return iface
+}
+
+// testApp returns the app on a fresh database, see testDB.
+func testApp(t *testing.T) (*fiber.App, models.Interface) {
+	iface := testDB(t)
+	return newApp(), iface
+}
+
+func testUser(t *testing.T, name string, role models.Role) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	assert.NoError(t, models.DB.Create(&models.User{Username: name, PasswordHash: hash, Role: role}).Error)
+}
+
+var csrfInput = regexp.MustCompile(`name="` + csrfField + `" value="([^"]*)"`)
+
+// testSession makes requests like a browser, keeping the cookies and the
+// CSRF token of the last page.
+type testSession struct {
+	t       *testing.T
+	app     *fiber.App
+	cookies map[string]string
+	csrf    string
+}
+
+func newTestSession(t *testing.T, app *fiber.App) *testSession {
+	return &testSession{t: t, app: app, cookies: make(map[string]string)}
+}
+
+// do sends a request with form as the body if not nil, and returns the
+// response with its body.
+func (s *testSession) do(method, path string, form url.Values) (*http.Response, string) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req := httptest.NewRequest(method, path, body)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for k, v := range s.cookies {
+		req.AddCookie(&http.Cookie{Name: k, Value: v})
+	}
+	resp, err := s.app.Test(req, -1)
+	if !assert.NoError(s.t, err) {
+		s.t.FailNow()
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	assert.NoError(s.t, err)
+
+	for _, c := range resp.Cookies() {
+		if c.Value == "" {
+			delete(s.cookies, c.Name)
+		} else {
+			s.cookies[c.Name] = c.Value
+		}
+	}
+	if m := csrfInput.FindSubmatch(b); m != nil {
+		s.csrf = string(m[1])
+	}
+	return resp, string(b)
+}
+
+// post submits form with the CSRF token of the last page.
+func (s *testSession) post(path string, form url.Values) *http.Response {
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set(csrfField, s.csrf)
+	resp, _ := s.do("POST", path, form)
+	return resp
+}
+
+// login signs in as the user and loads a page for the CSRF token.
+func (s *testSession) login(name string) {
+	s.do("GET", "/login", nil)
+	resp := s.post("/login", url.Values{"username": {name}, "password": {"password"}})
+	assert.Equal(s.t, "/", resp.Header.Get("Location"), "login failed")
+	s.do("GET", "/", nil)
+}
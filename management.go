@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+
+	"github.com/brian14708/wg-gatekeeper/mgmtpb"
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+// managementRoles is the role required by every management RPC.
+var managementRoles = map[string]models.Role{
+	mgmtpb.Management_ListInterfaces_FullMethodName:      models.RoleAuditor,
+	mgmtpb.Management_ListAccounts_FullMethodName:        models.RoleAuditor,
+	mgmtpb.Management_GetAccount_FullMethodName:          models.RoleAuditor,
+	mgmtpb.Management_CreateAccount_FullMethodName:       models.RoleOperator,
+	mgmtpb.Management_UpdateAccountLimits_FullMethodName: models.RoleOperator,
+	mgmtpb.Management_DeleteAccount_FullMethodName:       models.RoleOperator,
+	mgmtpb.Management_ListClients_FullMethodName:         models.RoleAuditor,
+	mgmtpb.Management_CreateClient_FullMethodName:        models.RoleOperator,
+	mgmtpb.Management_DeleteClient_FullMethodName:        models.RoleOperator,
+	mgmtpb.Management_GetUsage_FullMethodName:            models.RoleAuditor,
+	mgmtpb.Management_WatchUsage_FullMethodName:          models.RoleAuditor,
+}
+
+func startManagement(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	go newManagementServer().Serve(l)
+}
+
+// newManagementServer returns the gRPC server with the authentication of
+// every RPC.
+func newManagementServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			tok, err := managementAuth(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			ctx = context.WithValue(ctx, actorKey{}, "token:"+tok.Name)
+			resp, err := handler(ctx, req)
+			return resp, grpcError(err)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if _, err := managementAuth(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return grpcError(handler(srv, ss))
+		}),
+	)
+	mgmtpb.RegisterManagementServer(srv, &ManagementServer{})
+	return srv
+}
+
+// managementAuth checks the API token of a request against the role
+// required by method and returns the token.
+func managementAuth(ctx context.Context, method string) (*models.APIToken, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	for _, v := range md.Get("authorization") {
+		if t, ok := strings.CutPrefix(v, "Bearer "); ok {
+			token = t
+		}
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	tok, err := lookupToken(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	role, ok := managementRoles[method]
+	if !ok || !tok.Role.Allows(role) {
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+	return tok, nil
+}
+
+type actorKey struct{}
+
+// grpcActor names the token making the changes of a request.
+func grpcActor(ctx context.Context) string {
+	a, _ := ctx.Value(actorKey{}).(string)
+	return a
+}
+
+// grpcError converts errors shared with the REST API to gRPC status errors.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var ae *apiError
+	switch {
+	case errors.As(err, &ae):
+		msg := ae.Message
+		if len(ae.Fields) > 0 {
+			var fields []string
+			for k, v := range ae.Fields {
+				fields = append(fields, k+": "+v)
+			}
+			sort.Strings(fields)
+			msg += ": " + strings.Join(fields, ", ")
+		}
+		code := codes.InvalidArgument
+		switch ae.status {
+		case http.StatusNotFound:
+			code = codes.NotFound
+		case http.StatusConflict:
+			code = codes.FailedPrecondition
+		}
+		return status.Error(code, msg)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return status.Error(codes.NotFound, "not found")
+	}
+	log.Printf("management: %v", err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+type ManagementServer struct {
+	mgmtpb.UnimplementedManagementServer
+}
+
+func (*ManagementServer) ListInterfaces(ctx context.Context, req *mgmtpb.ListInterfacesRequest) (*mgmtpb.ListInterfacesResponse, error) {
+	var ifaces []models.Interface
+	if ret := models.DB.Order("id").Find(&ifaces); ret.Error != nil {
+		return nil, ret.Error
+	}
+	resp := &mgmtpb.ListInterfacesResponse{}
+	for _, iface := range ifaces {
+		var pub string
+		if key, err := wgtypes.NewKey(iface.PrivateKey); err == nil {
+			pub = key.PublicKey().String()
+		}
+		resp.Interfaces = append(resp.Interfaces, &mgmtpb.Interface{
+			Id:         int64(iface.ID),
+			Name:       iface.Name,
+			PublicKey:  pub,
+			ListenPort: int32(iface.ListenPort),
+			Subnet:     iface.Subnet,
+			ExternalIp: iface.ExternalIP,
+		})
+	}
+	return resp, nil
+}
+
+func (*ManagementServer) ListAccounts(ctx context.Context, req *mgmtpb.ListAccountsRequest) (*mgmtpb.ListAccountsResponse, error) {
+	var accs []models.Account
+	q := models.DB.Order("id")
+	if req.InterfaceId != 0 {
+		q = q.Where("interface_id = ?", req.InterfaceId)
+	}
+	if ret := q.Find(&accs); ret.Error != nil {
+		return nil, ret.Error
+	}
+	resp := &mgmtpb.ListAccountsResponse{}
+	for _, acc := range accs {
+		resp.Accounts = append(resp.Accounts, pbAccount(acc))
+	}
+	return resp, nil
+}
+
+func (*ManagementServer) GetAccount(ctx context.Context, req *mgmtpb.GetAccountRequest) (*mgmtpb.Account, error) {
+	var acc models.Account
+	if ret := models.DB.Preload("Clients").First(&acc, req.Id); ret.Error != nil {
+		return nil, ret.Error
+	}
+	return pbAccount(acc), nil
+}
+
+func (*ManagementServer) CreateAccount(ctx context.Context, req *mgmtpb.CreateAccountRequest) (*mgmtpb.Account, error) {
+	limits := apiLimits(req.Limits)
+	v := validation{}
+	v.check(req.Name != "", "name", "must not be empty")
+	var iface models.Interface
+	v.check(models.DB.First(&iface, req.InterfaceId).Error == nil, "interface_id", "interface %d does not exist", req.InterfaceId)
+	limits.validate(v)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	acc := models.Account{Name: req.Name, InterfaceID: iface.ID}
+	limits.apply(&acc)
+	if ret := models.DB.Create(&acc); ret.Error != nil {
+		return nil, ret.Error
+	}
+	recordEvent(grpcActor(ctx), "create", nil, accountSnapshot(acc))
+	return pbAccount(acc), nil
+}
+
+func (*ManagementServer) UpdateAccountLimits(ctx context.Context, req *mgmtpb.UpdateAccountLimitsRequest) (*mgmtpb.Account, error) {
+	var acc models.Account
+	if ret := models.DB.First(&acc, req.Id); ret.Error != nil {
+		return nil, ret.Error
+	}
+	limits := apiLimits(req.Limits)
+	v := validation{}
+	limits.validate(v)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	before := accountSnapshot(acc)
+	limits.apply(&acc)
+	if ret := models.DB.Save(&acc); ret.Error != nil {
+		return nil, ret.Error
+	}
+	recordEvent(grpcActor(ctx), "update", before, accountSnapshot(acc))
+	syncers.UpdateAccounts(acc.InterfaceID)
+	return pbAccount(acc), nil
+}
+
+func (*ManagementServer) DeleteAccount(ctx context.Context, req *mgmtpb.DeleteAccountRequest) (*mgmtpb.DeleteAccountResponse, error) {
+	var acc models.Account
+	if ret := models.DB.First(&acc, req.Id); ret.Error != nil {
+		return nil, ret.Error
+	}
+	if ret := models.DB.Delete(&acc); ret.Error != nil {
+		return nil, ret.Error
+	}
+	recordEvent(grpcActor(ctx), "delete", accountSnapshot(acc), nil)
+	syncers.UpdateAccounts(acc.InterfaceID)
+	return &mgmtpb.DeleteAccountResponse{}, nil
+}
+
+func (*ManagementServer) ListClients(ctx context.Context, req *mgmtpb.ListClientsRequest) (*mgmtpb.ListClientsResponse, error) {
+	var acc models.Account
+	if ret := models.DB.Preload("Clients").First(&acc, req.AccountId); ret.Error != nil {
+		return nil, ret.Error
+	}
+	return &mgmtpb.ListClientsResponse{Clients: pbAccount(acc).Clients}, nil
+}
+
+func (*ManagementServer) CreateClient(ctx context.Context, req *mgmtpb.CreateClientRequest) (*mgmtpb.ClientConfig, error) {
+	var acc models.Account
+	if ret := models.DB.First(&acc, req.AccountId); ret.Error != nil {
+		return nil, ret.Error
+	}
+	v := validation{}
+	v.check(req.Name != "", "name", "must not be empty")
+	v.check(req.PersistentKeepalive >= 0 && req.PersistentKeepalive <= 65535, "persistent_keepalive", "must be between 0 and 65535")
+	if req.PublicKey != "" {
+		_, err := wgtypes.ParseKey(req.PublicKey)
+		v.check(err == nil, "public_key", "invalid key")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	psk := req.PresharedKey == nil || *req.PresharedKey
+	cli, iface, privateKey, err := newClient(acc, req.Name, req.PublicKey, int(req.PersistentKeepalive), psk, "")
+	if err != nil {
+		return nil, requestAPIError(err)
+	}
+	recordEvent(grpcActor(ctx), "create", nil, clientSnapshot(cli))
+	config, err := clientConfig(iface, cli, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &mgmtpb.ClientConfig{
+		Client:     pbClient(cli),
+		Config:     config,
+		PrivateKey: privateKey,
+	}, nil
+}
+
+func (*ManagementServer) DeleteClient(ctx context.Context, req *mgmtpb.DeleteClientRequest) (*mgmtpb.DeleteClientResponse, error) {
+	var acc models.Account
+	if ret := models.DB.First(&acc, req.AccountId); ret.Error != nil {
+		return nil, ret.Error
+	}
+	var cli models.Client
+	if ret := models.DB.Where("account_id = ?", acc.ID).First(&cli, req.Id); ret.Error != nil {
+		return nil, ret.Error
+	}
+	if ret := models.DB.Delete(&cli); ret.Error != nil {
+		return nil, ret.Error
+	}
+	recordEvent(grpcActor(ctx), "delete", clientSnapshot(cli), nil)
+	syncers.UpdateClients(acc.InterfaceID)
+	return &mgmtpb.DeleteClientResponse{}, nil
+}
+
+func (*ManagementServer) GetUsage(ctx context.Context, req *mgmtpb.GetUsageRequest) (*mgmtpb.AccountUsage, error) {
+	var acc models.Account
+	if ret := models.DB.First(&acc, req.AccountId); ret.Error != nil {
+		return nil, ret.Error
+	}
+	return &mgmtpb.AccountUsage{
+		AccountId: int64(acc.ID),
+		BytesIn:   acc.BytesIn,
+		BytesOut:  acc.BytesOut,
+	}, nil
+}
+
+func (*ManagementServer) WatchUsage(req *mgmtpb.WatchUsageRequest, stream mgmtpb.Management_WatchUsageServer) error {
+	ticks := usageHub.Subscribe()
+	defer usageHub.Unsubscribe(ticks)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case t := <-ticks:
+			if req.InterfaceId != 0 && int64(t.InterfaceID) != req.InterfaceId {
+				continue
+			}
+
+			var accs []models.Account
+			q := models.DB.Where("interface_id = ?", t.InterfaceID).Order("id")
+			if len(req.AccountIds) > 0 {
+				q = q.Where("id IN ?", req.AccountIds)
+			}
+			if ret := q.Find(&accs); ret.Error != nil {
+				return ret.Error
+			}
+			if len(accs) == 0 {
+				continue
+			}
+
+			update := &mgmtpb.UsageUpdate{
+				Time:        timestamppb.New(t.Time),
+				InterfaceId: int64(t.InterfaceID),
+			}
+			for _, acc := range accs {
+				d := t.Deltas[acc.ID]
+				update.Accounts = append(update.Accounts, &mgmtpb.AccountUsage{
+					AccountId: int64(acc.ID),
+					BytesIn:   acc.BytesIn,
+					BytesOut:  acc.BytesOut,
+					DeltaIn:   d.BytesIn,
+					DeltaOut:  d.BytesOut,
+				})
+			}
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func apiLimits(l *mgmtpb.Limits) apiAccountLimits {
+	return apiAccountLimits{
+		BandwidthInLimit:  l.GetBandwidthInLimit(),
+		BandwidthOutLimit: l.GetBandwidthOutLimit(),
+		DeviceLimit:       int(l.GetDeviceLimit()),
+	}
+}
+
+func pbAccount(acc models.Account) *mgmtpb.Account {
+	a := toAPIAccount(acc)
+	resp := &mgmtpb.Account{
+		Id:          int64(a.ID),
+		Name:        a.Name,
+		InterfaceId: int64(a.InterfaceID),
+		Limits: &mgmtpb.Limits{
+			BandwidthInLimit:  a.BandwidthInLimit,
+			BandwidthOutLimit: a.BandwidthOutLimit,
+			DeviceLimit:       int32(a.DeviceLimit),
+		},
+		BytesIn:  a.BytesIn,
+		BytesOut: a.BytesOut,
+	}
+	for _, cli := range acc.Clients {
+		resp.Clients = append(resp.Clients, pbClient(cli))
+	}
+	return resp
+}
+
+func pbClient(cli models.Client) *mgmtpb.Client {
+	c := toAPIClient(cli)
+	return &mgmtpb.Client{
+		Id:                  int64(c.ID),
+		Name:                c.Name,
+		IpAddress:           c.IPAddress,
+		PublicKey:           c.PublicKey,
+		PresharedKey:        c.PresharedKey,
+		PrivateKeyStored:    c.PrivateKeyStored,
+		PersistentKeepalive: int32(c.PersistentKeepalive),
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/brian14708/wg-gatekeeper/mgmtpb"
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+// testManagement serves the management API in memory and returns a client.
+func testManagement(t *testing.T) mgmtpb.ManagementClient {
+	l := bufconn.Listen(1 << 20)
+	srv := newManagementServer()
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return mgmtpb.NewManagementClient(conn)
+}
+
+// withToken authenticates the requests of ctx with token.
+func withToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+func TestManagementCreateAccount(t *testing.T) {
+	iface := testDB(t)
+	mc := testManagement(t)
+	ctx := context.Background()
+	req := &mgmtpb.CreateAccountRequest{Name: "bob", InterfaceId: int64(iface.ID),
+		Limits: &mgmtpb.Limits{BandwidthInLimit: 10, BandwidthOutLimit: 10}}
+
+	_, err := mc.CreateAccount(ctx, req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = mc.CreateAccount(withToken(ctx, testToken(t, models.RoleAuditor)), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx = withToken(ctx, testToken(t, models.RoleOperator))
+	_, err = mc.CreateAccount(ctx, &mgmtpb.CreateAccountRequest{Name: "bob", InterfaceId: int64(iface.ID)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "validation failed: bandwidth_in_limit: must be positive, bandwidth_out_limit: must be positive", status.Convert(err).Message())
+
+	acc, err := mc.CreateAccount(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", acc.GetName())
+	var e models.Event
+	assert.NoError(t, models.DB.Last(&e).Error)
+	assert.Equal(t, "token:operator", e.Actor)
+
+	_, err = mc.GetAccount(ctx, &mgmtpb.GetAccountRequest{Id: 100})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestManagementWatchUsage(t *testing.T) {
+	iface := testDB(t)
+	mc := testManagement(t)
+	other := models.Interface{Name: "wg1", ListenPort: 51821, Subnet: "10.1.0.1/24", ExternalIP: "192.0.2.1"}
+	assert.NoError(t, models.DB.Create(&other).Error)
+	bob := models.Account{Name: "bob", InterfaceID: iface.ID, BytesIn: 1000}
+	alice := models.Account{Name: "alice", InterfaceID: iface.ID}
+	carol := models.Account{Name: "carol", InterfaceID: other.ID}
+	for _, acc := range []*models.Account{&bob, &alice, &carol} {
+		assert.NoError(t, models.DB.Create(acc).Error)
+	}
+
+	ctx, cancel := context.WithTimeout(withToken(context.Background(), testToken(t, models.RoleAuditor)), 5*time.Second)
+	defer cancel()
+	stream, err := mc.WatchUsage(ctx, &mgmtpb.WatchUsageRequest{InterfaceId: int64(iface.ID), AccountIds: []int64{int64(bob.ID)}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	updates := make(chan *mgmtpb.UsageUpdate)
+	go func() {
+		for {
+			u, err := stream.Recv()
+			if err != nil {
+				close(updates)
+				return
+			}
+			select {
+			case updates <- u:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	deltas := map[int]UsageDelta{bob.ID: {BytesIn: 10, BytesOut: 20}, alice.ID: {BytesIn: 1}, carol.ID: {BytesIn: 1}}
+	// the stream subscribes asynchronously, publish until the first update
+	for {
+		usageHub.Publish(UsageTick{InterfaceID: other.ID, Time: time.Now(), Deltas: deltas})
+		usageHub.Publish(UsageTick{InterfaceID: iface.ID, Time: time.Now(), Deltas: deltas})
+		select {
+		case u, ok := <-updates:
+			if !assert.True(t, ok, "stream closed") {
+				return
+			}
+			assert.Equal(t, int64(iface.ID), u.GetInterfaceId())
+			if assert.Len(t, u.GetAccounts(), 1) {
+				a := u.GetAccounts()[0]
+				assert.Equal(t, int64(bob.ID), a.GetAccountId())
+				assert.Equal(t, int64(1000), a.GetBytesIn())
+				assert.Equal(t, int64(10), a.GetDeltaIn())
+				assert.Equal(t, int64(20), a.GetDeltaOut())
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
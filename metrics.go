@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+var (
+	auditLogEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gatekeeper_audit_log_entries_total",
+		Help: "Access log entries received from envoy.",
+	}, []string{"protocol"})
+	auditLogErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gatekeeper_audit_log_errors_total",
+		Help: "Access log entries that could not be stored.",
+	})
+
+	syncStepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gatekeeper_sync_step_duration_seconds",
+		Help:    "Duration of the sync steps of an interface.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"interface", "step"})
+	syncStepErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gatekeeper_sync_step_errors_total",
+		Help: "Failed runs of the sync steps of an interface.",
+	}, []string{"interface", "step"})
+)
+
+func init() {
+	prometheus.MustRegister(accountCollector{}, peerCollector{})
+}
+
+// startMetrics serves the metrics for Prometheus on /metrics.
+func startMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+}
+
+var (
+	accountBytesDesc = prometheus.NewDesc("gatekeeper_account_bytes_total",
+		"Bytes transferred by the clients of an account.",
+		[]string{"interface", "account_id", "account", "direction"}, nil)
+	accountPacketsDesc = prometheus.NewDesc("gatekeeper_account_packets_total",
+		"Packets transferred by the clients of an account.",
+		[]string{"interface", "account_id", "account", "direction"}, nil)
+	accountDropsDesc = prometheus.NewDesc("gatekeeper_account_dropped_packets_total",
+		"Packets of an account dropped by the bandwidth limit.",
+		[]string{"interface", "account_id", "account", "direction"}, nil)
+)
+
+// accountCollector reports the traffic of the accounts collected by the
+// Syncers since the start of the process.
+type accountCollector struct{}
+
+func (accountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- accountBytesDesc
+	ch <- accountPacketsDesc
+	ch <- accountDropsDesc
+}
+
+func (accountCollector) Collect(ch chan<- prometheus.Metric) {
+	if syncers == nil {
+		return
+	}
+	for _, s := range syncers.all() {
+		totals := s.Traffic()
+		if len(totals) == 0 {
+			continue
+		}
+		var accounts []models.Account
+		if ret := models.DB.Where("interface_id = ?", s.ifaceID).Find(&accounts); ret.Error != nil {
+			log.Printf("metrics: %v", ret.Error)
+			continue
+		}
+		iface := s.Status().Interface
+		for _, acc := range accounts {
+			t, ok := totals[acc.ID]
+			if !ok {
+				continue
+			}
+			id := strconv.Itoa(acc.ID)
+			for _, m := range []struct {
+				desc    *prometheus.Desc
+				in, out int64
+			}{
+				{accountBytesDesc, t.BytesIn, t.BytesOut},
+				{accountPacketsDesc, t.PacketsIn, t.PacketsOut},
+				{accountDropsDesc, t.DropsIn, t.DropsOut},
+			} {
+				ch <- prometheus.MustNewConstMetric(m.desc, prometheus.CounterValue, float64(m.in), iface, id, acc.Name, "in")
+				ch <- prometheus.MustNewConstMetric(m.desc, prometheus.CounterValue, float64(m.out), iface, id, acc.Name, "out")
+			}
+		}
+	}
+}
+
+var (
+	peerHandshakeDesc = prometheus.NewDesc("gatekeeper_peer_last_handshake_timestamp_seconds",
+		"Time of the last handshake of a client, 0 if there was none.",
+		[]string{"interface", "account", "client_id", "client"}, nil)
+	peerReceiveDesc = prometheus.NewDesc("gatekeeper_peer_receive_bytes_total",
+		"Bytes received from a client by wireguard.",
+		[]string{"interface", "account", "client_id", "client"}, nil)
+	peerTransmitDesc = prometheus.NewDesc("gatekeeper_peer_transmit_bytes_total",
+		"Bytes sent to a client by wireguard.",
+		[]string{"interface", "account", "client_id", "client"}, nil)
+)
+
+// peerCollector reports the statistics of the wireguard peers of all
+// interfaces as last sampled by the Syncers. Peers that are not a client
+// are left out.
+type peerCollector struct{}
+
+func (peerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- peerHandshakeDesc
+	ch <- peerReceiveDesc
+	ch <- peerTransmitDesc
+}
+
+func (peerCollector) Collect(ch chan<- prometheus.Metric) {
+	if syncers == nil {
+		return
+	}
+	var ifaces []models.Interface
+	if ret := models.DB.Preload("Accounts.Clients").Find(&ifaces); ret.Error != nil {
+		log.Printf("metrics: %v", ret.Error)
+		return
+	}
+	for _, iface := range ifaces {
+		// sampled by the syncer, empty if the interface is not up yet
+		peers := syncers.Peers(iface.ID)
+		type client struct {
+			account string
+			models.Client
+		}
+		clients := map[wgtypes.Key]client{}
+		for _, acc := range iface.Accounts {
+			for _, cli := range acc.Clients {
+				if k, err := wgtypes.NewKey(cli.PublicKey); err == nil {
+					clients[k] = client{acc.Name, cli}
+				}
+			}
+		}
+		for key, p := range peers {
+			cli, ok := clients[key]
+			if !ok {
+				continue
+			}
+			labels := []string{iface.Name, cli.account, strconv.Itoa(cli.ID), cli.Name}
+			var handshake float64
+			if !p.LastHandshake.IsZero() {
+				handshake = float64(p.LastHandshake.Unix())
+			}
+			ch <- prometheus.MustNewConstMetric(peerHandshakeDesc, prometheus.GaugeValue, handshake, labels...)
+			ch <- prometheus.MustNewConstMetric(peerReceiveDesc, prometheus.CounterValue, float64(p.ReceiveBytes), labels...)
+			ch <- prometheus.MustNewConstMetric(peerTransmitDesc, prometheus.CounterValue, float64(p.TransmitBytes), labels...)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/brian14708/wg-gatekeeper/bwfilter"
+	"github.com/brian14708/wg-gatekeeper/models"
+	"github.com/brian14708/wg-gatekeeper/wireguard"
+)
+
+func TestMetrics(t *testing.T) {
+	iface := testDB(t)
+	acc := models.Account{Name: "bob", InterfaceID: iface.ID}
+	assert.NoError(t, models.DB.Create(&acc).Error)
+	key, err := wgtypes.GenerateKey()
+	assert.NoError(t, err)
+	cli := models.Client{AccountID: acc.ID, Name: "laptop", IPAddress: "10.0.0.2", PublicKey: key[:]}
+	assert.NoError(t, models.DB.Create(&cli).Error)
+	unknown, err := wgtypes.GenerateKey()
+	assert.NoError(t, err)
+
+	s := &Syncer{
+		ifaceID: iface.ID,
+		status:  SyncStatus{Interface: "wg0"},
+		traffic: map[int]bwfilter.Metric{acc.ID: {BytesIn: 100, BytesOut: 200, PacketsIn: 1, PacketsOut: 2, DropsOut: 3}},
+		peers: map[wgtypes.Key]PeerStatus{
+			key: {PeerStatus: wireguard.PeerStatus{PublicKey: key, LastHandshake: time.Unix(1000, 0), ReceiveBytes: 10, TransmitBytes: 20}},
+			// not a client
+			unknown: {PeerStatus: wireguard.PeerStatus{PublicKey: unknown, ReceiveBytes: 1}},
+		},
+	}
+	syncers = &Syncers{detached: true, m: map[int]*Syncer{iface.ID: s}}
+
+	// labels in the sorted order of the text format
+	accountLabels := `account="bob",account_id="` + strconv.Itoa(acc.ID) + `"`
+	assert.NoError(t, testutil.CollectAndCompare(accountCollector{}, strings.NewReader(`
+# HELP gatekeeper_account_bytes_total Bytes transferred by the clients of an account.
+# TYPE gatekeeper_account_bytes_total counter
+gatekeeper_account_bytes_total{`+accountLabels+`,direction="in",interface="wg0"} 100
+gatekeeper_account_bytes_total{`+accountLabels+`,direction="out",interface="wg0"} 200
+# HELP gatekeeper_account_packets_total Packets transferred by the clients of an account.
+# TYPE gatekeeper_account_packets_total counter
+gatekeeper_account_packets_total{`+accountLabels+`,direction="in",interface="wg0"} 1
+gatekeeper_account_packets_total{`+accountLabels+`,direction="out",interface="wg0"} 2
+# HELP gatekeeper_account_dropped_packets_total Packets of an account dropped by the bandwidth limit.
+# TYPE gatekeeper_account_dropped_packets_total counter
+gatekeeper_account_dropped_packets_total{`+accountLabels+`,direction="in",interface="wg0"} 0
+gatekeeper_account_dropped_packets_total{`+accountLabels+`,direction="out",interface="wg0"} 3
+`)))
+
+	peerLabels := `account="bob",client="laptop",client_id="` + strconv.Itoa(cli.ID) + `",interface="wg0"`
+	assert.NoError(t, testutil.CollectAndCompare(peerCollector{}, strings.NewReader(`
+# HELP gatekeeper_peer_last_handshake_timestamp_seconds Time of the last handshake of a client, 0 if there was none.
+# TYPE gatekeeper_peer_last_handshake_timestamp_seconds gauge
+gatekeeper_peer_last_handshake_timestamp_seconds{`+peerLabels+`} 1000
+# HELP gatekeeper_peer_receive_bytes_total Bytes received from a client by wireguard.
+# TYPE gatekeeper_peer_receive_bytes_total counter
+gatekeeper_peer_receive_bytes_total{`+peerLabels+`} 10
+# HELP gatekeeper_peer_transmit_bytes_total Bytes sent to a client by wireguard.
+# TYPE gatekeeper_peer_transmit_bytes_total counter
+gatekeeper_peer_transmit_bytes_total{`+peerLabels+`} 20
+`)))
+
+	syncStepDuration.Reset()
+	syncStepErrors.Reset()
+	s.step("clients", func() error { return nil }, nil)
+	s.step("accounts", func() error { return errors.New("failed") }, nil)
+	assert.NoError(t, testutil.CollectAndCompare(syncStepErrors, strings.NewReader(`
+# HELP gatekeeper_sync_step_errors_total Failed runs of the sync steps of an interface.
+# TYPE gatekeeper_sync_step_errors_total counter
+gatekeeper_sync_step_errors_total{interface="wg0",step="accounts"} 1
+`)))
+
+	// the durations vary, only check the series
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(syncStepDuration)
+	mfs, err := reg.Gather()
+	assert.NoError(t, err)
+	if assert.Len(t, mfs, 1) {
+		assert.Equal(t, "gatekeeper_sync_step_duration_seconds", mfs[0].GetName())
+		var series []string
+		for _, m := range mfs[0].GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			assert.Equal(t, uint64(1), m.GetHistogram().GetSampleCount())
+			series = append(series, strings.Join(labels, ","))
+		}
+		assert.Equal(t, []string{"interface=wg0,step=accounts", "interface=wg0,step=clients"}, series)
+	}
+}
@@ -0,0 +1,5 @@
+// Package mgmtpb contains the gRPC management service generated from
+// management.proto.
+package mgmtpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative management.proto
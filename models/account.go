@@ -1,6 +1,10 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type Account struct {
 	gorm.Model
@@ -13,5 +17,16 @@ type Account struct {
 	BytesIn  int64
 	BytesOut int64
 
+	// self-service portal, disabled if neither a password, a login token nor
+	// a single sign-on subject is set
+	PortalPasswordHash []byte
+	LoginTokenHash     []byte
+	LoginTokenExpiry   time.Time
+	// DeviceLimit is the number of clients the account holder may have, 0
+	// for no limit
+	DeviceLimit int
+	// Subject identifies the account holder signing in with single sign-on
+	Subject string `gorm:"index"`
+
 	Clients []Client
 }
@@ -9,5 +9,21 @@ type Client struct {
 	PublicKey []byte
 	IPAddress string `gorm:"uniqueIndex"`
 
+	// PrivateKey is sealed with the secret key, only stored if enabled and
+	// the key was generated by the server.
+	PrivateKey []byte
+	// PresharedKey is sealed with the secret key, empty if not used.
+	PresharedKey []byte
+	// PersistentKeepalive in seconds, 0 to use the interface setting.
+	PersistentKeepalive int
+
+	// Traffic of the client since it was created, in the same direction as
+	// the account counters. The default fills in clients created before the
+	// counters were added.
+	BytesIn    int64 `gorm:"not null;default:0"`
+	BytesOut   int64 `gorm:"not null;default:0"`
+	PacketsIn  int64 `gorm:"not null;default:0"`
+	PacketsOut int64 `gorm:"not null;default:0"`
+
 	AccountID int
 }
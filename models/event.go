@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Event records a change made to an entity for the change history. Events
+// are never updated or deleted.
+type Event struct {
+	ID        int
+	CreatedAt time.Time `gorm:"index"`
+	// Actor is the user, API token or account holder making the change
+	Actor string
+	// Action is e.g. create, update or delete
+	Action   string
+	Entity   string `gorm:"index:idx_events_entity"`
+	EntityID int    `gorm:"index:idx_events_entity"`
+	// AccountID is the account the entity belongs to, 0 for interfaces,
+	// users and tokens
+	AccountID int `gorm:"index"`
+
+	// Before and After are JSON snapshots of the entity, Before is empty
+	// for created and After for deleted entities
+	Before string
+	After  string
+}
@@ -15,5 +15,8 @@ type Interface struct {
 	ExternalIP string
 	DNS        string
 
+	// PersistentKeepalive in seconds for all clients, 0 to disable.
+	PersistentKeepalive int
+
 	Accounts []Account
 }
@@ -12,5 +12,9 @@ func Init(db *gorm.DB) {
 		&Interface{},
 		&Account{},
 		&Client{},
+		&User{},
+		&APIToken{},
+		&Event{},
+		&Usage{},
 	)
 }
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIToken authenticates requests to the REST API with the privileges of
+// Role. Only the SHA-256 hash of the token is stored.
+type APIToken struct {
+	gorm.Model
+	ID         int
+	Name       string
+	TokenHash  []byte `gorm:"uniqueIndex"`
+	Role       Role
+	LastUsedAt time.Time
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Usage is the traffic of an account, or of one of its clients if ClientID
+// is set, in the time bucket starting at Time.
+type Usage struct {
+	AccountID int `gorm:"primaryKey;autoIncrement:false"`
+	ClientID  int `gorm:"primaryKey;autoIncrement:false"`
+	// Resolution is the length of the bucket in seconds
+	Resolution int       `gorm:"primaryKey;autoIncrement:false"`
+	Time       time.Time `gorm:"primaryKey;autoIncrement:false"`
+	BytesIn    int64
+	BytesOut   int64
+}
@@ -0,0 +1,37 @@
+package models
+
+import "gorm.io/gorm"
+
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"
+	RoleOperator Role = "operator"
+	RoleAuditor  Role = "auditor"
+)
+
+// Roles lists all roles from most to least privileged.
+var Roles = []Role{RoleAdmin, RoleOperator, RoleAuditor}
+
+// Allows reports whether r has at least the privileges of other.
+func (r Role) Allows(other Role) bool {
+	switch r {
+	case RoleAdmin:
+		return true
+	case RoleOperator:
+		return other == RoleOperator || other == RoleAuditor
+	case RoleAuditor:
+		return other == RoleAuditor
+	}
+	return false
+}
+
+type User struct {
+	gorm.Model
+	ID           int
+	Username     string `gorm:"uniqueIndex"`
+	PasswordHash []byte
+	Role         Role
+	// Subject identifies users signing in with single sign-on
+	Subject string `gorm:"index"`
+}
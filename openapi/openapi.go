@@ -0,0 +1,273 @@
+// Package openapi builds an OpenAPI 3 document from route descriptions and
+// the Go types of their request and response bodies.
+package openapi
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Spec struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+	Security   []map[string][]string            `json:"security,omitempty"`
+
+	// TypeName returns the schema name of a named type, defaults to the
+	// name of the Go type.
+	TypeName func(reflect.Type) string `json:"-"`
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas,omitempty"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+type Operation struct {
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+}
+
+// Route describes an API endpoint.
+type Route struct {
+	Method string
+	// Path in fiber syntax, e.g. /accounts/:id
+	Path    string
+	Summary string
+	Tags    []string
+	Query   []*Parameter
+
+	// Request is a value of the JSON request body type, nil if there is no
+	// body.
+	Request any
+	// Response is a value of the JSON response body type, nil if there is
+	// no body. A string response is returned as text/plain and a []byte
+	// response as a file of any type.
+	Response any
+	// Status of a successful response, defaults to 200 or 204 without
+	// response body.
+	Status int
+}
+
+// New returns an empty document using bearer token authentication.
+func New(title, version string) *Spec {
+	return &Spec{
+		OpenAPI: "3.0.3",
+		Info:    Info{Title: title, Version: version},
+		Paths:   map[string]map[string]*Operation{},
+		Components: Components{
+			Schemas: map[string]*Schema{},
+			SecuritySchemes: map[string]*SecurityScheme{
+				"bearer": {Type: "http", Scheme: "bearer"},
+			},
+		},
+		Security: []map[string][]string{{"bearer": {}}},
+	}
+}
+
+// Add documents the route under prefix. errorBody is a value of the type
+// returned on errors.
+func (s *Spec) Add(prefix string, r Route, errorBody any) {
+	var path []string
+	op := &Operation{
+		Summary:   r.Summary,
+		Tags:      r.Tags,
+		Responses: map[string]*Response{},
+	}
+	for _, seg := range strings.Split(prefix+r.Path, "/") {
+		if strings.HasPrefix(seg, ":") {
+			seg = strings.TrimPrefix(seg, ":")
+			op.Parameters = append(op.Parameters, &Parameter{
+				Name:     seg,
+				In:       "path",
+				Required: true,
+				Schema:   &Schema{Type: "integer"},
+			})
+			seg = "{" + seg + "}"
+		}
+		path = append(path, seg)
+	}
+	op.Parameters = append(op.Parameters, r.Query...)
+
+	if r.Request != nil {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  s.content(r.Request),
+		}
+	}
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+		if r.Response == nil {
+			status = http.StatusNoContent
+		}
+	}
+	resp := &Response{Description: http.StatusText(status)}
+	if r.Response != nil {
+		resp.Content = s.content(r.Response)
+	}
+	op.Responses[strconv.Itoa(status)] = resp
+	if errorBody != nil {
+		op.Responses["default"] = &Response{
+			Description: "Error",
+			Content:     s.content(errorBody),
+		}
+	}
+
+	p := strings.Join(path, "/")
+	if s.Paths[p] == nil {
+		s.Paths[p] = map[string]*Operation{}
+	}
+	s.Paths[p][strings.ToLower(r.Method)] = op
+}
+
+func (s *Spec) content(v any) map[string]*MediaType {
+	switch v.(type) {
+	case string:
+		return map[string]*MediaType{
+			"text/plain": {Schema: &Schema{Type: "string"}},
+		}
+	case []byte:
+		return map[string]*MediaType{
+			"application/octet-stream": {Schema: &Schema{Type: "string", Format: "binary"}},
+		}
+	}
+	return map[string]*MediaType{
+		"application/json": {Schema: s.Schema(reflect.TypeOf(v))},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Schema returns the schema of t. Named struct types are added to the
+// components of the document and referenced.
+func (s *Spec) Schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return &Schema{Type: "number"}
+	case t.Kind() == reflect.String:
+		return &Schema{Type: "string"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return &Schema{Type: "string", Format: "byte"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return &Schema{Type: "array", Items: s.Schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: s.Schema(t.Elem())}
+	case t.Kind() == reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := t.Name()
+		if s.TypeName != nil {
+			name = s.TypeName(t)
+		}
+		if _, ok := s.Components.Schemas[name]; !ok {
+			// reserve the name first for recursive types
+			s.Components.Schemas[name] = nil
+			s.Components.Schemas[name] = s.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	return &Schema{}
+}
+
+// object returns the schema of a struct type using its json tags. Fields
+// without omitempty are required, the doc tag is used as description.
+func (s *Spec) object(t reflect.Type) *Schema {
+	o := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		// fields of embedded structs are promoted like in encoding/json
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			embedded := s.object(f.Type)
+			for k, v := range embedded.Properties {
+				o.Properties[k] = v
+			}
+			o.Required = append(o.Required, embedded.Required...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		p := s.Schema(f.Type)
+		// siblings of $ref are ignored
+		if doc := f.Tag.Get("doc"); doc != "" && p.Ref == "" {
+			p.Description = doc
+		}
+		o.Properties[name] = p
+		if !strings.Contains(opts, "omitempty") {
+			o.Required = append(o.Required, name)
+		}
+	}
+	return o
+}
@@ -0,0 +1,83 @@
+package openapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type item struct {
+	ID      int       `json:"id"`
+	Name    string    `json:"name" doc:"display name"`
+	Tags    []string  `json:"tags,omitempty"`
+	Created time.Time `json:"created"`
+	Parent  *item     `json:"parent,omitempty"`
+	hidden  int
+}
+
+type itemWithKey struct {
+	item
+	Key []byte `json:"key"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func TestSpec(t *testing.T) {
+	s := New("test", "1")
+	s.Add("/api", Route{
+		Method:   "POST",
+		Path:     "/items/:id/children",
+		Summary:  "Create child",
+		Query:    []*Parameter{{Name: "dry_run", In: "query", Schema: &Schema{Type: "boolean"}}},
+		Request:  item{},
+		Response: itemWithKey{},
+		Status:   201,
+	}, apiError{})
+	s.Add("/api", Route{Method: "DELETE", Path: "/items/:id"}, apiError{})
+	s.Add("/api", Route{Method: "GET", Path: "/items/:id/text", Response: ""}, nil)
+	s.Add("/api", Route{Method: "GET", Path: "/items/:id/file", Response: []byte{}}, nil)
+
+	op := s.Paths["/api/items/{id}/children"]["post"]
+	assert.Equal(t, "Create child", op.Summary)
+	assert.Equal(t, []*Parameter{
+		{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "integer"}},
+		{Name: "dry_run", In: "query", Schema: &Schema{Type: "boolean"}},
+	}, op.Parameters)
+	assert.Equal(t, "#/components/schemas/item", op.RequestBody.Content["application/json"].Schema.Ref)
+	assert.Equal(t, "#/components/schemas/itemWithKey", op.Responses["201"].Content["application/json"].Schema.Ref)
+	assert.Equal(t, "#/components/schemas/apiError", op.Responses["default"].Content["application/json"].Schema.Ref)
+
+	assert.Equal(t, &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"id":      {Type: "integer"},
+			"name":    {Type: "string", Description: "display name"},
+			"tags":    {Type: "array", Items: &Schema{Type: "string"}},
+			"created": {Type: "string", Format: "date-time"},
+			"parent":  {Ref: "#/components/schemas/item"},
+		},
+		Required: []string{"id", "name", "created"},
+	}, s.Components.Schemas["item"])
+	withKey := s.Components.Schemas["itemWithKey"]
+	assert.Equal(t, &Schema{Type: "string", Format: "byte"}, withKey.Properties["key"])
+	assert.Contains(t, withKey.Properties, "name")
+	assert.Equal(t, []string{"id", "name", "created", "key"}, withKey.Required)
+
+	del := s.Paths["/api/items/{id}"]["delete"]
+	assert.Contains(t, del.Responses, "204")
+	assert.Nil(t, del.RequestBody)
+
+	text := s.Paths["/api/items/{id}/text"]["get"]
+	assert.Equal(t, &Schema{Type: "string"}, text.Responses["200"].Content["text/plain"].Schema)
+	assert.NotContains(t, text.Responses, "default")
+
+	file := s.Paths["/api/items/{id}/file"]["get"]
+	assert.Equal(t, &Schema{Type: "string", Format: "binary"}, file.Responses["200"].Content["application/octet-stream"].Schema)
+
+	_, err := json.Marshal(s)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+const LoginTokenValidity = 24 * time.Hour
+
+// requireAccount only lets account holders logged in to the portal through.
+func requireAccount(c *fiber.Ctx) error {
+	sess, err := sessions.Get(c)
+	if err != nil {
+		return err
+	}
+	if id, ok := sess.Get("account").(int); ok {
+		var acc models.Account
+		if ret := models.DB.First(&acc, id); ret.Error == nil {
+			c.Locals("account", &acc)
+			c.Bind(fiber.Map{
+				"PortalAccount": acc,
+			})
+			return c.Next()
+		}
+	}
+	return c.Redirect("/portal/login")
+}
+
+func currentAccount(c *fiber.Ctx) *models.Account {
+	a, _ := c.Locals("account").(*models.Account)
+	return a
+}
+
+func portalLogin(c *fiber.Ctx, acc *models.Account) error {
+	sess, err := sessions.Get(c)
+	if err != nil {
+		return err
+	}
+	if err := sess.Regenerate(); err != nil {
+		return err
+	}
+	// Regenerate keeps the data, a signed in user is signed out
+	sess.Delete("user")
+	sess.Set("account", acc.ID)
+	return sess.Save()
+}
+
+// newLoginToken generates a one-time login link token for the account and
+// stores its hash.
+func newLoginToken(acc *models.Account) (string, error) {
+	token, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(token))
+	acc.LoginTokenHash = hash[:]
+	acc.LoginTokenExpiry = time.Now().Add(LoginTokenValidity)
+	if ret := models.DB.Save(acc); ret.Error != nil {
+		return "", ret.Error
+	}
+	return token, nil
+}
+
+func portalHandler(app *fiber.App) {
+	// portal login page
+	app.Get("/portal/login", func(c *fiber.Ctx) error {
+		return c.Render("portal_login", fiber.Map{
+			"SSO": ssoProvider != nil,
+		})
+	})
+
+	// portal login
+	app.Post("/portal/login", func(c *fiber.Ctx) error {
+		var accs []models.Account
+		models.DB.Where("name = ? AND portal_password_hash IS NOT NULL", c.FormValue("name")).Find(&accs)
+		for _, acc := range accs {
+			if bcrypt.CompareHashAndPassword(acc.PortalPasswordHash, []byte(c.FormValue("password"))) == nil {
+				if err := portalLogin(c, &acc); err != nil {
+					return err
+				}
+				return c.Redirect("/portal")
+			}
+		}
+		flashError(c, "Invalid account name or password")
+		return c.Redirect("/portal/login")
+	})
+
+	// login link
+	app.Get("/portal/token/:token", func(c *fiber.Ctx) error {
+		hash := sha256.Sum256([]byte(c.Params("token")))
+		var acc models.Account
+		ret := models.DB.Where("login_token_hash = ?", hash[:]).First(&acc)
+		if ret.Error != nil || subtle.ConstantTimeCompare(acc.LoginTokenHash, hash[:]) != 1 ||
+			time.Now().After(acc.LoginTokenExpiry) {
+			flashError(c, "Invalid or expired login link")
+			return c.Redirect("/portal/login")
+		}
+
+		// tokens can only be used once
+		acc.LoginTokenHash = nil
+		if ret := models.DB.Save(&acc); ret.Error != nil {
+			return ret.Error
+		}
+		if err := portalLogin(c, &acc); err != nil {
+			return err
+		}
+		return c.Redirect("/portal")
+	})
+
+	// portal logout
+	app.Post("/portal/logout", func(c *fiber.Ctx) error {
+		sess, err := sessions.Get(c)
+		if err != nil {
+			return err
+		}
+		if err := sess.Destroy(); err != nil {
+			return err
+		}
+		return c.Redirect("/portal/login")
+	})
+
+	// own account
+	app.Get("/portal", requireAccount, func(c *fiber.Ctx) error {
+		var acc models.Account
+		models.DB.Preload("Clients", func(db *gorm.DB) *gorm.DB {
+			return db.Order("clients.id DESC")
+		}).First(&acc, currentAccount(c).ID)
+
+		data, err := accountUsage(acc)
+		if err != nil {
+			log.Printf("portal: usage of account %d: %v", acc.ID, err)
+			return c.SendStatus(500)
+		}
+		data["Account"] = acc
+		data["CanAdd"] = acc.DeviceLimit == 0 || len(acc.Clients) < acc.DeviceLimit
+		return c.Render("portal", data)
+	})
+
+	// create own client
+	app.Post("/portal/client", requireAccount, func(c *fiber.Ctx) error {
+		acc := currentAccount(c)
+
+		var cnt int64
+		models.DB.Model(&models.Client{}).Where("account_id = ?", acc.ID).Count(&cnt)
+		if acc.DeviceLimit > 0 && cnt >= int64(acc.DeviceLimit) {
+			flashError(c, fmt.Sprintf("Device limit of %d reached", acc.DeviceLimit))
+			return c.Redirect("/portal")
+		}
+
+		cli, iface, privateKey, err := newClient(*acc, c.FormValue("name"), c.FormValue("public_key"), 0, true, "")
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/portal")
+		}
+		recordEvent(actor(c), "create", nil, clientSnapshot(cli))
+		return renderClient(c, "/portal", iface, cli, privateKey)
+	})
+
+	// get own client
+	app.Get("/portal/client/:cid", requireAccount, func(c *fiber.Ctx) error {
+		acc := currentAccount(c)
+		var cli models.Client
+		if ret := models.DB.Where("account_id = ?", acc.ID).First(&cli, c.Params("cid")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/portal")
+		}
+		privateKey, err := openPrivateKey(cli)
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/portal")
+		}
+
+		iface := models.Interface{}
+		models.DB.First(&iface, acc.InterfaceID)
+		return renderClient(c, "/portal", iface, cli, privateKey)
+	})
+
+	// download own client config
+	app.Get("/portal/client/:cid/config", requireAccount, func(c *fiber.Ctx) error {
+		acc := currentAccount(c)
+		var cli models.Client
+		if ret := models.DB.Where("account_id = ?", acc.ID).First(&cli, c.Params("cid")); ret.Error != nil {
+			return c.SendStatus(404)
+		}
+		privateKey, err := openPrivateKey(cli)
+		if err != nil {
+			return c.SendStatus(500)
+		}
+
+		iface := models.Interface{}
+		models.DB.First(&iface, acc.InterfaceID)
+		config, err := clientConfig(iface, cli, privateKey)
+		if err != nil {
+			return c.SendStatus(500)
+		}
+		c.Attachment(iface.Name + ".conf")
+		return c.SendString(config)
+	})
+
+	// rotate own client key
+	app.Post("/portal/client/:cid/key", requireAccount, func(c *fiber.Ctx) error {
+		acc := currentAccount(c)
+		var cli models.Client
+		if ret := models.DB.Where("account_id = ?", acc.ID).First(&cli, c.Params("cid")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/portal")
+		}
+		before := clientSnapshot(cli)
+		iface, privateKey, err := rotateClientKey(*acc, &cli, c.FormValue("public_key"))
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/portal")
+		}
+		recordEvent(actor(c), "rotate_key", before, clientSnapshot(cli))
+		return renderClient(c, "/portal", iface, cli, privateKey)
+	})
+
+	// delete own client
+	app.Post("/portal/client/:cid/delete", requireAccount, func(c *fiber.Ctx) error {
+		acc := currentAccount(c)
+		var cli models.Client
+		if ret := models.DB.Where("account_id = ?", acc.ID).First(&cli, c.Params("cid")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/portal")
+		}
+		if ret := models.DB.Delete(&cli); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+		} else {
+			flashInfo(c, "Client deleted")
+			recordEvent(actor(c), "delete", clientSnapshot(cli), nil)
+		}
+		syncers.UpdateClients(acc.InterfaceID)
+		return c.Redirect("/portal")
+	})
+
+	// configure portal access of an account
+	app.Post("/account/:id/portal", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		var acc models.Account
+		if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/")
+		}
+		before := accountSnapshot(acc)
+
+		if limit, err := strconv.Atoi(c.FormValue("device_limit", "0")); err != nil || limit < 0 {
+			flashError(c, "Invalid device limit")
+			return c.Redirect("/account/" + c.Params("id"))
+		} else {
+			acc.DeviceLimit = limit
+		}
+		if c.FormValue("disable") != "" {
+			acc.PortalPasswordHash = nil
+			acc.LoginTokenHash = nil
+		} else if pw := c.FormValue("password"); pw != "" {
+			hash, err := hashPassword(pw)
+			if err != nil {
+				flashError(c, err.Error())
+				return c.Redirect("/account/" + c.Params("id"))
+			}
+			acc.PortalPasswordHash = hash
+		}
+		if ret := models.DB.Save(&acc); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+		} else {
+			flashInfo(c, "Portal access updated")
+			action := "update_portal"
+			if c.FormValue("disable") == "" && c.FormValue("password") != "" {
+				action = "set_portal_password"
+			}
+			recordEvent(actor(c), action, before, accountSnapshot(acc))
+		}
+		return c.Redirect("/account/" + c.Params("id"))
+	})
+
+	// generate a login link for an account
+	app.Post("/account/:id/portal/link", requireRole(models.RoleOperator), func(c *fiber.Ctx) error {
+		var acc models.Account
+		if ret := models.DB.First(&acc, c.Params("id")); ret.Error != nil {
+			flashError(c, ret.Error.Error())
+			return c.Redirect("/")
+		}
+		token, err := newLoginToken(&acc)
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/account/" + c.Params("id"))
+		}
+		recordEvent(actor(c), "create_login_link", accountSnapshot(acc), accountSnapshot(acc))
+		flashInfo(c, fmt.Sprintf("Login link, valid until %s: %s/portal/token/%s",
+			acc.LoginTokenExpiry.Format("2006-01-02 15:04"), c.BaseURL(), token))
+		return c.Redirect("/account/" + c.Params("id"))
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+func TestPortalDeviceLimit(t *testing.T) {
+	app, iface := testApp(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	acc := models.Account{Name: "bob", InterfaceID: iface.ID, DeviceLimit: 1, PortalPasswordHash: hash}
+	assert.NoError(t, models.DB.Create(&acc).Error)
+
+	s := newTestSession(t, app)
+	s.do("GET", "/portal/login", nil)
+	resp := s.post("/portal/login", url.Values{"name": {"bob"}, "password": {"password"}})
+	assert.Equal(t, "/portal", resp.Header.Get("Location"))
+
+	resp, body := s.do("GET", "/portal", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, body, "showModal()")
+
+	resp = s.post("/portal/client", url.Values{"name": {"laptop"}})
+	assert.Equal(t, 200, resp.StatusCode, "configuration of the new client")
+	var cnt int64
+	models.DB.Model(&models.Client{}).Where("account_id = ?", acc.ID).Count(&cnt)
+	assert.Equal(t, int64(1), cnt)
+
+	_, body = s.do("GET", "/portal", nil)
+	assert.NotContains(t, body, "showModal()")
+	resp = s.post("/portal/client", url.Values{"name": {"phone"}})
+	assert.Equal(t, "/portal", resp.Header.Get("Location"))
+	assert.Equal(t, "Device limit of 1 reached", s.cookies["flash_error"])
+	models.DB.Model(&models.Client{}).Where("account_id = ?", acc.ID).Count(&cnt)
+	assert.Equal(t, int64(1), cnt)
+}
+
+func TestPortalLoginSignsOut(t *testing.T) {
+	app, iface := testApp(t)
+	testUser(t, "alice", models.RoleAdmin)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	assert.NoError(t, models.DB.Create(&models.Account{Name: "bob", InterfaceID: iface.ID, PortalPasswordHash: hash}).Error)
+	portalLogin := func(s *testSession) {
+		s.do("GET", "/portal/login", nil)
+		resp := s.post("/portal/login", url.Values{"name": {"bob"}, "password": {"password"}})
+		assert.Equal(t, "/portal", resp.Header.Get("Location"))
+	}
+
+	s := newTestSession(t, app)
+	s.login("alice")
+	portalLogin(s)
+	resp, _ := s.do("GET", "/", nil)
+	assert.Equal(t, "/login", resp.Header.Get("Location"), "user signed out by the portal login")
+	resp, _ = s.do("GET", "/portal", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	s.login("alice")
+	resp, _ = s.do("GET", "/portal", nil)
+	assert.Equal(t, "/portal/login", resp.Header.Get("Location"), "account signed out by the user login")
+}
@@ -0,0 +1,83 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+var ErrInvalid = errors.New("invalid sealed secret")
+
+// Box encrypts small secrets such as wireguard keys before they are written
+// to the database.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// New creates a Box from arbitrary key material.
+func New(key []byte) (*Box, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty secret key")
+	}
+	k := sha256.Sum256(key)
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Load creates a Box from key if it is non-empty, otherwise from the key
+// stored at path. A new random key is written to path if it does not exist.
+func Load(key string, path string) (*Box, error) {
+	if key != "" {
+		return New([]byte(key))
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		k := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, k); err != nil {
+			return nil, err
+		}
+		b = []byte(base64.StdEncoding.EncodeToString(k))
+		if err := os.WriteFile(path, append(b, '\n'), 0o600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return New([]byte(strings.TrimSpace(string(b))))
+}
+
+// Seal encrypts plain. The nonce is prepended to the returned ciphertext.
+func (b *Box) Seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize(), b.aead.NonceSize()+len(plain)+b.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Open decrypts a secret returned by Seal.
+func (b *Box) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < b.aead.NonceSize() {
+		return nil, ErrInvalid
+	}
+	nonce, ct := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	plain, err := b.aead.Open(nil, nonce, ct, nil)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	return plain, nil
+}
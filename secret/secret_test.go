@@ -0,0 +1,49 @@
+package secret
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeal(t *testing.T) {
+	b, err := New([]byte("key"))
+	assert.NoError(t, err)
+
+	sealed, err := b.Seal([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(sealed), "hello")
+
+	plain, err := b.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), plain)
+
+	other, err := New([]byte("other"))
+	assert.NoError(t, err)
+	_, err = other.Open(sealed)
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	_, err = b.Open([]byte("x"))
+	assert.ErrorIs(t, err, ErrInvalid)
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret.key")
+
+	b1, err := Load("", path)
+	assert.NoError(t, err)
+	st, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), st.Mode().Perm())
+
+	sealed, err := b1.Seal([]byte("hello"))
+	assert.NoError(t, err)
+
+	b2, err := Load("", path)
+	assert.NoError(t, err)
+	plain, err := b2.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), plain)
+}
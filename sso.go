@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+	"github.com/brian14708/wg-gatekeeper/sso"
+)
+
+func ssoHandler(app *fiber.App, provider *sso.Provider) {
+	// redirect to identity provider
+	app.Get("/sso/login", func(c *fiber.Ctx) error {
+		state, err := randomString()
+		if err != nil {
+			return err
+		}
+		nonce, err := randomString()
+		if err != nil {
+			return err
+		}
+		sess, err := sessions.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("sso_state", state)
+		sess.Set("sso_nonce", nonce)
+		if err := sess.Save(); err != nil {
+			return err
+		}
+		return c.Redirect(provider.AuthCodeURL(state, nonce))
+	})
+
+	// identity provider callback
+	app.Get("/sso/callback", func(c *fiber.Ctx) error {
+		sess, err := sessions.Get(c)
+		if err != nil {
+			return err
+		}
+		state, _ := sess.Get("sso_state").(string)
+		nonce, _ := sess.Get("sso_nonce").(string)
+		sess.Delete("sso_state")
+		sess.Delete("sso_nonce")
+		if err := sess.Save(); err != nil {
+			return err
+		}
+
+		if e := c.Query("error"); e != "" {
+			flashError(c, "Single sign-on failed: "+e)
+			return c.Redirect("/login")
+		}
+		if state == "" || c.Query("state") != state {
+			flashError(c, "Single sign-on failed: invalid state")
+			return c.Redirect("/login")
+		}
+		id, err := provider.Exchange(c.Context(), c.Query("code"), nonce)
+		if err != nil {
+			log.Printf("sso: %v", err)
+			flashError(c, "Single sign-on failed")
+			return c.Redirect("/login")
+		}
+
+		if role, ok := provider.Role(id); ok {
+			user, err := ssoUser(id, role)
+			if err != nil {
+				flashError(c, err.Error())
+				return c.Redirect("/login")
+			}
+			if err := login(c, user); err != nil {
+				return err
+			}
+			return c.Redirect("/")
+		}
+
+		acc, err := ssoAccount(id)
+		if err != nil {
+			flashError(c, err.Error())
+			return c.Redirect("/portal/login")
+		}
+		if err := portalLogin(c, acc); err != nil {
+			return err
+		}
+		return c.Redirect("/portal")
+	})
+}
+
+// ssoUser returns the user signing in with id, creating it on first login.
+// The role always follows the group membership at the identity provider.
+func ssoUser(id *sso.Identity, role models.Role) (*models.User, error) {
+	var user models.User
+	ret := models.DB.Where("subject = ?", id.Subject).First(&user)
+	if errors.Is(ret.Error, gorm.ErrRecordNotFound) {
+		user = models.User{
+			Username: id.Username,
+			Role:     role,
+			Subject:  id.Subject,
+		}
+		if ret := models.DB.Create(&user); ret.Error != nil {
+			return nil, fmt.Errorf("Cannot create user %s: %w", id.Username, ret.Error)
+		}
+		recordEvent("sso", "create", nil, userSnapshot(user))
+		return &user, nil
+	} else if ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	if user.Role != role {
+		before := userSnapshot(user)
+		user.Role = role
+		if ret := models.DB.Save(&user); ret.Error != nil {
+			return nil, ret.Error
+		}
+		recordEvent("sso", "update", before, userSnapshot(user))
+	}
+	return &user, nil
+}
+
+// ssoAccount returns the account of the account holder signing in with id.
+// If enabled, the account is provisioned on first login.
+func ssoAccount(id *sso.Identity) (*models.Account, error) {
+	var acc models.Account
+	ret := models.DB.Where("subject = ?", id.Subject).First(&acc)
+	if ret.Error == nil {
+		return &acc, nil
+	} else if !errors.Is(ret.Error, gorm.ErrRecordNotFound) {
+		return nil, ret.Error
+	}
+
+	if *flagOIDCProvisionInterface == 0 {
+		return nil, fmt.Errorf("No account for %s", id.Username)
+	}
+	var iface models.Interface
+	if ret := models.DB.First(&iface, *flagOIDCProvisionInterface); ret.Error != nil {
+		return nil, fmt.Errorf("Cannot provision account: %w", ret.Error)
+	}
+	acc = models.Account{
+		Name:              id.Username,
+		InterfaceID:       iface.ID,
+		BandwidthInLimit:  int64(*flagOIDCProvisionBandwidth * 1024 * 1024),
+		BandwidthOutLimit: int64(*flagOIDCProvisionBandwidth * 1024 * 1024),
+		DeviceLimit:       *flagOIDCProvisionDeviceLimit,
+		Subject:           id.Subject,
+	}
+	if ret := models.DB.Create(&acc); ret.Error != nil {
+		return nil, ret.Error
+	}
+	recordEvent("sso", "create", nil, accountSnapshot(acc))
+	return &acc, nil
+}
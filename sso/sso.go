@@ -0,0 +1,128 @@
+// Package sso implements OpenID Connect login with a mapping from identity
+// provider groups to gatekeeper roles.
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+var ErrNonce = errors.New("sso: nonce mismatch")
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	// GroupsClaim is the ID token claim that lists the groups of a user.
+	GroupsClaim string
+	// RoleGroups maps roles to the groups that are granted the role.
+	RoleGroups map[models.Role][]string
+}
+
+type Provider struct {
+	cfg      Config
+	verifier *oidc.IDTokenVerifier
+	oauth2   oauth2.Config
+}
+
+// Identity is a user authenticated by the identity provider.
+type Identity struct {
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// New discovers the issuer and returns a Provider for it.
+func New(ctx context.Context, cfg Config) (*Provider, error) {
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	p, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{
+		cfg:      cfg,
+		verifier: p.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     p.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+	}, nil
+}
+
+// AuthCodeURL returns the URL of the identity provider login page.
+func (p *Provider) AuthCodeURL(state, nonce string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce))
+}
+
+// Exchange redeems an authorization code and returns the verified identity.
+func (p *Provider) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	tok, err := p.oauth2.Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("sso: no id_token in token response")
+	}
+	idToken, err := p.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, ErrNonce
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	id := &Identity{Subject: idToken.Subject}
+	id.Email, _ = claims["email"].(string)
+	id.Username, _ = claims["preferred_username"].(string)
+	if id.Username == "" {
+		id.Username = id.Email
+	}
+	if id.Username == "" {
+		id.Username = id.Subject
+	}
+	switch g := claims[p.cfg.GroupsClaim].(type) {
+	case string:
+		id.Groups = []string{g}
+	case []any:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+// Role returns the most privileged role granted by the groups of id. ok is
+// false if none of its groups are mapped to a role.
+func (p *Provider) Role(id *Identity) (role models.Role, ok bool) {
+	for _, r := range models.Roles {
+		for _, g := range p.cfg.RoleGroups[r] {
+			for _, ig := range id.Groups {
+				if g == ig {
+					return r, true
+				}
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,160 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+// mockIssuer is a minimal OpenID provider that issues an ID token with
+// claims for every authorization code.
+type mockIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]any
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &key.PublicKey,
+			KeyID:     "test",
+			Algorithm: "RS256",
+			Use:       "sig",
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+			(&jose.SignerOptions{}).WithHeader("kid", "test"))
+		assert.NoError(t, err)
+		claims := map[string]any{
+			"iss": m.URL,
+			"exp": time.Now().Add(time.Hour).Unix(),
+			"iat": time.Now().Unix(),
+		}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		payload, _ := json.Marshal(claims)
+		jws, err := signer.Sign(payload)
+		assert.NoError(t, err)
+		idToken, err := jws.CompactSerialize()
+		assert.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func newProvider(t *testing.T, m *mockIssuer) *Provider {
+	p, err := New(context.Background(), Config{
+		Issuer:      m.URL,
+		ClientID:    "gatekeeper",
+		RedirectURL: "http://localhost/sso/callback",
+		RoleGroups: map[models.Role][]string{
+			models.RoleAdmin:   {"wg-admins"},
+			models.RoleAuditor: {"wg-auditors", "security"},
+		},
+	})
+	assert.NoError(t, err)
+	return p
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	m := newMockIssuer(t)
+	p := newProvider(t, m)
+
+	u, err := url.Parse(p.AuthCodeURL("state", "nonce"))
+	assert.NoError(t, err)
+	assert.Equal(t, m.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, "state", u.Query().Get("state"))
+	assert.Equal(t, "nonce", u.Query().Get("nonce"))
+	assert.Equal(t, "gatekeeper", u.Query().Get("client_id"))
+}
+
+func TestExchange(t *testing.T) {
+	m := newMockIssuer(t)
+	p := newProvider(t, m)
+
+	m.claims = map[string]any{
+		"sub":                "1234",
+		"aud":                "gatekeeper",
+		"nonce":              "nonce",
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+		"groups":             []string{"users", "security", "wg-admins"},
+	}
+	id, err := p.Exchange(context.Background(), "code", "nonce")
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{
+		Subject:  "1234",
+		Username: "alice",
+		Email:    "alice@example.com",
+		Groups:   []string{"users", "security", "wg-admins"},
+	}, id)
+	role, ok := p.Role(id)
+	assert.True(t, ok)
+	assert.Equal(t, models.RoleAdmin, role)
+
+	// falls back to email and a single group
+	m.claims = map[string]any{
+		"sub":    "5678",
+		"aud":    "gatekeeper",
+		"nonce":  "nonce",
+		"email":  "bob@example.com",
+		"groups": "security",
+	}
+	id, err = p.Exchange(context.Background(), "code", "nonce")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob@example.com", id.Username)
+	role, ok = p.Role(id)
+	assert.True(t, ok)
+	assert.Equal(t, models.RoleAuditor, role)
+
+	// no mapped groups
+	m.claims["groups"] = []string{"users"}
+	id, err = p.Exchange(context.Background(), "code", "nonce")
+	assert.NoError(t, err)
+	_, ok = p.Role(id)
+	assert.False(t, ok)
+
+	_, err = p.Exchange(context.Background(), "code", "other")
+	assert.ErrorIs(t, err, ErrNonce)
+
+	m.claims["aud"] = "other-client"
+	_, err = p.Exchange(context.Background(), "code", "nonce")
+	assert.Error(t, err)
+}
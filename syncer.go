@@ -1,24 +1,116 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/brian14708/wg-gatekeeper/bwfilter"
 	"github.com/brian14708/wg-gatekeeper/models"
 	"github.com/brian14708/wg-gatekeeper/wireguard"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
 )
 
+// Syncer converges the state of a single wireguard interface to the database.
 type Syncer struct {
+	ifaceID int
+
 	updateInterface chan struct{}
 	updateClients   chan struct{}
 	updateAccounts  chan struct{}
 	deleteInterface chan struct{}
+
+	// owned by the Run goroutine
+	wg     *wireguard.Interface
+	handle *bwfilter.Handle
+	// configuration the interface was last created with
+	applied models.Interface
+
+	mu     sync.Mutex
+	status SyncStatus
+	// traffic of the accounts since the start of the process
+	traffic map[int]bwfilter.Metric
+	peers   map[wgtypes.Key]PeerStatus
+}
+
+// PeerStatus is the last sampled state of a peer with its throughput since
+// the previous sample.
+type PeerStatus struct {
+	wireguard.PeerStatus
+	SampledAt time.Time
+	// bytes per second, received from and transmitted to the peer
+	ReceiveRate  float64
+	TransmitRate float64
+}
+
+// Online reports whether the peer completed a handshake recently. Peers
+// with traffic handshake every two minutes.
+func (p PeerStatus) Online() bool {
+	return !p.LastHandshake.IsZero() && p.SampledAt.Sub(p.LastHandshake) < PeerOnlineTimeout
 }
 
-func NewSyncer() *Syncer {
+// SyncStatus describes the outcome of the last reconciliation of the device
+// state against the database, and of every sync step.
+type SyncStatus struct {
+	Interface string
+
+	LastReconciled time.Time
+	Corrections    []string
+
+	Steps   map[string]StepStatus
+	Skipped []string
+}
+
+// StepStatus is the result of the last run of a single sync step.
+type StepStatus struct {
+	Interface string
+	Name      string
+	LastRun   time.Time
+	Err       string
+	Failures  int
+}
+
+// Errors returns the failing steps ordered by name.
+func (s SyncStatus) Errors() []StepStatus {
+	var ret []StepStatus
+	for _, st := range s.Steps {
+		if st.Err != "" {
+			ret = append(ret, st)
+		}
+	}
+	sortSteps(ret)
+	return ret
+}
+
+func sortSteps(st []StepStatus) {
+	sort.Slice(st, func(i, j int) bool {
+		if st[i].Interface != st[j].Interface {
+			return st[i].Interface < st[j].Interface
+		}
+		return st[i].Name < st[j].Name
+	})
+}
+
+const (
+	stepInterface = "interface"
+	stepDelete    = "delete interface"
+	stepClients   = "clients"
+	stepMetrics   = "metrics"
+	stepReconcile = "reconcile"
+	stepPeers     = "peers"
+)
+
+func NewSyncer(ifaceID int) *Syncer {
 	s := &Syncer{
+		ifaceID:         ifaceID,
 		updateInterface: make(chan struct{}, 1),
 		updateClients:   make(chan struct{}, 1),
 		updateAccounts:  make(chan struct{}, 1),
@@ -56,118 +148,649 @@ func (s *Syncer) DeleteInterface() {
 	}
 }
 
+func (s *Syncer) Status() SyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.status
+	st.Corrections = append([]string(nil), s.status.Corrections...)
+	st.Skipped = append([]string(nil), s.status.Skipped...)
+	st.Steps = make(map[string]StepStatus, len(s.status.Steps))
+	for k, v := range s.status.Steps {
+		st.Steps[k] = v
+	}
+	return st
+}
+
+// Traffic returns the traffic of the accounts on the interface collected
+// since the start of the process, by account ID.
+func (s *Syncer) Traffic() map[int]bwfilter.Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make(map[int]bwfilter.Metric, len(s.traffic))
+	for k, v := range s.traffic {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Peers returns the last sampled status of the peers on the interface.
+func (s *Syncer) Peers() map[wgtypes.Key]PeerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make(map[wgtypes.Key]PeerStatus, len(s.peers))
+	for k, v := range s.peers {
+		ret[k] = v
+	}
+	return ret
+}
+
+func (s *Syncer) setReconciled(corrections []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.LastReconciled = time.Now()
+	s.status.Corrections = corrections
+}
+
+func (s *Syncer) setSkipped(skipped []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Skipped = skipped
+}
+
 const (
 	MetricInterval = 30 * time.Second
+	PeerInterval   = 5 * time.Second
+	// PeerOnlineTimeout is how long a peer is considered online after its
+	// last handshake, wireguard rejects sessions older than three minutes.
+	PeerOnlineTimeout = 3 * time.Minute
+
+	retryMinBackoff = time.Second
+	retryMaxBackoff = 5 * time.Minute
 )
 
+// retryBackoff is the delay before the retry after the given number of
+// consecutive failures, doubling from retryMinBackoff up to retryMaxBackoff.
+func retryBackoff(failures int) time.Duration {
+	if failures < 32 && retryMinBackoff<<(failures-1) < retryMaxBackoff {
+		return retryMinBackoff << (failures - 1)
+	}
+	return retryMaxBackoff
+}
+
+// step runs f and records its outcome. A failing step is retried by calling
+// retry after an exponential backoff; retry may be nil for steps that run
+// periodically anyway.
+func (s *Syncer) step(name string, f func() error, retry func()) {
+	start := time.Now()
+	err := f()
+
+	s.mu.Lock()
+	iface := s.status.Interface
+	if iface == "" {
+		iface = strconv.Itoa(s.ifaceID)
+	}
+	syncStepDuration.WithLabelValues(iface, name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		syncStepErrors.WithLabelValues(iface, name).Inc()
+	}
+	if s.status.Steps == nil {
+		s.status.Steps = make(map[string]StepStatus)
+	}
+	st := s.status.Steps[name]
+	st.Interface = s.status.Interface
+	st.Name = name
+	st.LastRun = time.Now()
+	if err == nil {
+		st.Err = ""
+		st.Failures = 0
+	} else {
+		st.Err = err.Error()
+		st.Failures++
+	}
+	s.status.Steps[name] = st
+	s.mu.Unlock()
+
+	if err == nil {
+		return
+	}
+
+	backoff := retryBackoff(st.Failures)
+	if retry != nil {
+		log.Printf("sync %d %s failed (attempt %d), retrying in %s: %v", s.ifaceID, name, st.Failures, backoff, err)
+		time.AfterFunc(backoff, retry)
+	} else {
+		log.Printf("sync %d %s failed (attempt %d): %v", s.ifaceID, name, st.Failures, err)
+	}
+}
+
 func (s *Syncer) Run() {
-	var wg *wireguard.Interface
-	var handle *bwfilter.Handle
 	timer := time.NewTimer(MetricInterval)
+	reconcile := time.NewTicker(*flagReconcileInterval)
+	defer reconcile.Stop()
+	peers := time.NewTicker(PeerInterval)
+	defer peers.Stop()
 	for {
 		select {
 		case <-timer.C:
-			// update metrics
-			if handle != nil {
-				handle.GetMetric(func(accountID int, bytesIn, bytesOut int64) {
-					models.DB.Exec("UPDATE accounts SET bytes_in = bytes_in + ?, bytes_out = bytes_out + ? WHERE id = ?", bytesIn, bytesOut, accountID)
-				})
-			}
+			s.step(stepMetrics, s.syncMetrics, nil)
 			timer.Reset(MetricInterval)
 		case <-s.updateInterface:
-			// update interface
-			var iface models.Interface
-			models.DB.Last(&iface)
-			if iface.ID == 0 {
-				continue
-			}
-			i, err := wireguard.New(iface.Name, iface.PrivateKey, iface.ListenPort)
-			if err != nil {
-				panic(err)
-			}
-			err = i.AddrAdd(iface.Subnet)
-			if err != nil {
-				panic(err)
-			}
-			if *flagEnvoy {
-				err = i.NatAdd(iface.NatIface, *flagEnvoyTcp)
-			} else {
-				err = i.NatAdd(iface.NatIface, -1)
-			}
-			if err != nil {
-				panic(err)
-			}
-			err = i.LinkUp()
-			if err != nil {
-				panic(err)
-			}
-			old := handle
-			handle, err = bwfilter.Attach(i.LinkIndex())
-			if err != nil {
-				log.Fatalf("attaching filter: %v", err)
-			}
-			if old != nil {
-				old.Close()
-			}
-			wg = i
-			s.UpdateAccounts()
+			s.step(stepInterface, s.syncInterface, s.UpdateInterface)
+		case <-s.deleteInterface:
+			s.step(stepDelete, s.syncDelete, nil)
+			return
+		case <-s.updateClients:
+			s.step(stepClients, s.syncClients, s.UpdateClients)
+		case <-s.updateAccounts:
 			s.UpdateClients()
+		case <-reconcile.C:
+			s.step(stepReconcile, s.reconcile, nil)
+		case <-peers.C:
+			s.step(stepPeers, s.syncPeers, nil)
+		}
+	}
+}
 
-		case <-s.deleteInterface:
-			if handle != nil {
-				handle.Close()
-				handle = nil
-			}
-			if wg != nil {
-				wg.Delete()
-				wg = nil
-			}
+func (s *Syncer) syncMetrics() error {
+	tick := UsageTick{
+		InterfaceID: s.ifaceID,
+		Time:        time.Now(),
+		Deltas:      make(map[int]UsageDelta),
+		Clients:     make(map[int]ClientUsageDelta),
+	}
+	// watchers are notified on every tick, even without traffic
+	defer func() { usageHub.Publish(tick) }()
 
-		case <-s.updateClients:
-			// update clients
-			var iface models.Interface
-			models.DB.Last(&iface)
-
-			rows, err := models.DB.Table("clients").
-				Select("clients.public_key, clients.ip_address, accounts.id, clients.id, accounts.bandwidth_in_limit, accounts.bandwidth_out_limit").
-				Joins("left join accounts on accounts.id = clients.account_id").
-				Joins("left join interfaces on interfaces.id = accounts.interface_id").
-				Where("interfaces.id = ? AND clients.deleted_at IS NULL AND accounts.deleted_at IS NULL", iface.ID).
-				Rows()
-			if err != nil {
-				panic(err)
+	if s.handle == nil {
+		return nil
+	}
+	var errs []error
+	clients := make(map[string]bwfilter.Metric)
+	s.handle.GetMetric(func(accountID int, m bwfilter.Metric) {
+		s.addTraffic(accountID, m)
+		ret := models.DB.Exec("UPDATE accounts SET bytes_in = bytes_in + ?, bytes_out = bytes_out + ? WHERE id = ?", m.BytesIn, m.BytesOut, accountID)
+		if ret.Error != nil {
+			errs = append(errs, fmt.Errorf("account %d: %w", accountID, ret.Error))
+			return
+		}
+		tick.Deltas[accountID] = UsageDelta{BytesIn: m.BytesIn, BytesOut: m.BytesOut}
+	}, func(ip string, m bwfilter.Metric) {
+		clients[ip] = m
+	})
+	if err := s.syncClientMetrics(clients, tick.Clients); err != nil {
+		errs = append(errs, err)
+	}
+	if err := recordUsage(tick); err != nil {
+		errs = append(errs, fmt.Errorf("recording usage: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// syncClientMetrics adds the traffic of client IP addresses to their clients
+// and fills deltas. Traffic of addresses without a client is dropped.
+func (s *Syncer) syncClientMetrics(metrics map[string]bwfilter.Metric, deltas map[int]ClientUsageDelta) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	ips := make([]string, 0, len(metrics))
+	for ip := range metrics {
+		ips = append(ips, ip)
+	}
+	var clients []models.Client
+	if ret := models.DB.Where("ip_address IN ?", ips).Find(&clients); ret.Error != nil {
+		return fmt.Errorf("loading clients: %w", ret.Error)
+	}
+	var errs []error
+	for _, cli := range clients {
+		m := metrics[cli.IPAddress]
+		ret := models.DB.Exec("UPDATE clients SET bytes_in = bytes_in + ?, bytes_out = bytes_out + ?, packets_in = packets_in + ?, packets_out = packets_out + ? WHERE id = ?",
+			m.BytesIn, m.BytesOut, m.PacketsIn, m.PacketsOut, cli.ID)
+		if ret.Error != nil {
+			errs = append(errs, fmt.Errorf("client %d: %w", cli.ID, ret.Error))
+			continue
+		}
+		deltas[cli.ID] = ClientUsageDelta{
+			AccountID:  cli.AccountID,
+			UsageDelta: UsageDelta{BytesIn: m.BytesIn, BytesOut: m.BytesOut},
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syncPeers samples the status of the peers and computes their throughput.
+func (s *Syncer) syncPeers() error {
+	var curr []wireguard.PeerStatus
+	if s.wg != nil {
+		var err error
+		if curr, err = s.wg.PeerStatus(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	prev := s.peers
+	peers := make(map[wgtypes.Key]PeerStatus, len(curr))
+	for _, p := range curr {
+		st := PeerStatus{PeerStatus: p, SampledAt: now}
+		// counters go back to zero if the peer was removed and added again
+		if old, ok := prev[p.PublicKey]; ok && p.ReceiveBytes >= old.ReceiveBytes && p.TransmitBytes >= old.TransmitBytes {
+			d := now.Sub(old.SampledAt).Seconds()
+			st.ReceiveRate = float64(p.ReceiveBytes-old.ReceiveBytes) / d
+			st.TransmitRate = float64(p.TransmitBytes-old.TransmitBytes) / d
+		}
+		peers[p.PublicKey] = st
+	}
+	s.peers = peers
+	s.mu.Unlock()
+
+	// peers is never modified after this point
+	peerHub.Publish(PeerTick{InterfaceID: s.ifaceID, Time: now, Peers: peers})
+	return nil
+}
+
+func (s *Syncer) addTraffic(accountID int, m bwfilter.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.traffic == nil {
+		s.traffic = make(map[int]bwfilter.Metric)
+	}
+	t := s.traffic[accountID]
+	t.BytesIn += m.BytesIn
+	t.BytesOut += m.BytesOut
+	t.PacketsIn += m.PacketsIn
+	t.PacketsOut += m.PacketsOut
+	t.DropsIn += m.DropsIn
+	t.DropsOut += m.DropsOut
+	s.traffic[accountID] = t
+}
+
+func (s *Syncer) syncInterface() error {
+	var iface models.Interface
+	if ret := models.DB.First(&iface, s.ifaceID); ret.Error != nil && !errors.Is(ret.Error, gorm.ErrRecordNotFound) {
+		return ret.Error
+	}
+	if iface.ID == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	s.status.Interface = iface.Name
+	s.mu.Unlock()
+
+	i, err := wireguard.New(iface.Name, iface.PrivateKey, iface.ListenPort)
+	if err != nil {
+		return fmt.Errorf("creating interface %s: %w", iface.Name, err)
+	}
+	err = i.AddrAdd(iface.Subnet)
+	if err != nil {
+		i.Close()
+		return fmt.Errorf("adding address %s: %w", iface.Subnet, err)
+	}
+	if *flagEnvoy {
+		err = i.NatAdd(iface.NatIface, *flagEnvoyTcp)
+	} else {
+		err = i.NatAdd(iface.NatIface, -1)
+	}
+	if err != nil {
+		i.Close()
+		return fmt.Errorf("adding NAT rules: %w", err)
+	}
+	err = i.LinkUp()
+	if err != nil {
+		i.Close()
+		return fmt.Errorf("setting link up: %w", err)
+	}
+	handle, err := bwfilter.Attach(i.LinkIndex())
+	if err != nil {
+		i.Close()
+		return fmt.Errorf("attaching filter: %w", err)
+	}
+	if s.handle != nil {
+		s.handle.Close()
+	}
+	if s.wg != nil {
+		s.wg.Close()
+	}
+	s.handle = handle
+	s.wg = i
+	s.applied = iface
+	s.UpdateAccounts()
+	s.UpdateClients()
+	return nil
+}
+
+func (s *Syncer) syncDelete() error {
+	var errs []error
+	if s.handle != nil {
+		if err := s.handle.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing filter: %w", err))
+		}
+		s.handle = nil
+	}
+	if s.wg != nil {
+		if err := s.wg.Delete(); err != nil {
+			errs = append(errs, fmt.Errorf("deleting interface: %w", err))
+		}
+		s.wg.Close()
+		s.wg = nil
+	}
+
+	s.mu.Lock()
+	labels := prometheus.Labels{"interface": s.status.Interface}
+	s.mu.Unlock()
+	syncStepDuration.DeletePartialMatch(labels)
+	syncStepErrors.DeletePartialMatch(labels)
+	return errors.Join(errs...)
+}
+
+func (s *Syncer) syncClients() error {
+	if s.wg == nil || s.handle == nil {
+		// clients are synced once the interface is up
+		return nil
+	}
+
+	peers, accounts, err := s.loadClients()
+	if err != nil {
+		return err
+	}
+	if err := s.wg.PeerSync(peers); err != nil {
+		return fmt.Errorf("syncing peers: %w", err)
+	}
+	if err := s.handle.UpdateClientAccount(accounts); err != nil {
+		return fmt.Errorf("updating client account: %w", err)
+	}
+	return nil
+}
+
+func (s *Syncer) reconcile() error {
+	if s.wg == nil || s.handle == nil {
+		return nil
+	}
+
+	// the interface may have been changed by another process
+	var iface models.Interface
+	if ret := models.DB.First(&iface, s.ifaceID); ret.Error != nil && !errors.Is(ret.Error, gorm.ErrRecordNotFound) {
+		return ret.Error
+	}
+	if iface.ID != 0 && !sameInterface(iface, s.applied) {
+		log.Printf("reconcile %d: interface configuration changed, recreating", s.ifaceID)
+		s.setReconciled([]string{"interface configuration changed"})
+		s.UpdateInterface()
+		return nil
+	}
+
+	peers, accounts, err := s.loadClients()
+	if err != nil {
+		return err
+	}
+
+	corrections, err := s.wg.Reconcile(peers)
+	if errors.Is(err, wireguard.ErrLinkNotFound) {
+		log.Printf("reconcile %d: interface is gone, recreating", s.ifaceID)
+		s.UpdateInterface()
+		return nil
+	}
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if ok, err := s.handle.Attached(); err != nil {
+		errs = append(errs, fmt.Errorf("checking filter: %w", err))
+	} else if !ok {
+		h, err := bwfilter.Attach(s.wg.LinkIndex())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("attaching filter: %w", err))
+		} else {
+			s.handle.Close()
+			s.handle = h
+			corrections = append(corrections, "reattached bandwidth filter")
+		}
+	}
+
+	// changes made to the database by other processes are applied here as
+	// well, so the map is reconciled even if nothing else drifted
+	if c, err := s.handle.ReconcileClientAccount(accounts); err != nil {
+		errs = append(errs, fmt.Errorf("reconciling client account: %w", err))
+	} else {
+		corrections = append(corrections, c...)
+	}
+
+	for _, c := range corrections {
+		log.Printf("reconcile %d: %s", s.ifaceID, c)
+	}
+	s.setReconciled(corrections)
+	return errors.Join(errs...)
+}
+
+// sameInterface reports whether a and b configure the device the same.
+func sameInterface(a, b models.Interface) bool {
+	return a.Name == b.Name && bytes.Equal(a.PrivateKey, b.PrivateKey) && a.ListenPort == b.ListenPort &&
+		a.Subnet == b.Subnet && a.NatIface == b.NatIface
+}
+
+// loadClients returns the peers and bandwidth accounts of all clients on the
+// interface. Clients that cannot be configured are skipped and recorded in
+// the sync status instead of failing the whole sync.
+func (s *Syncer) loadClients() (map[wgtypes.Key]wireguard.Peer, map[string]bwfilter.ClientAccount, error) {
+	rows, err := models.DB.Table("clients").
+		Select("clients.public_key, clients.ip_address, accounts.id, clients.id, accounts.bandwidth_in_limit, accounts.bandwidth_out_limit, "+
+			"clients.preshared_key, clients.persistent_keepalive, interfaces.persistent_keepalive").
+		Joins("left join accounts on accounts.id = clients.account_id").
+		Joins("left join interfaces on interfaces.id = accounts.interface_id").
+		Where("interfaces.id = ? AND clients.deleted_at IS NULL AND accounts.deleted_at IS NULL", s.ifaceID).
+		Rows()
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading clients: %w", err)
+	}
+	defer rows.Close()
+
+	var skipped []string
+	peers := make(map[wgtypes.Key]wireguard.Peer)
+	accounts := make(map[string]bwfilter.ClientAccount)
+	for rows.Next() {
+		var pubKey string
+		var ipAddr string
+		var accountID int
+		var clientID int
+		var bandwidthInLimit int64
+		var bandwidthOutLimit int64
+		var presharedKey []byte
+		var keepalive, ifaceKeepalive int
+		if err := rows.Scan(&pubKey, &ipAddr, &accountID, &clientID, &bandwidthInLimit, &bandwidthOutLimit,
+			&presharedKey, &keepalive, &ifaceKeepalive); err != nil {
+			return nil, nil, fmt.Errorf("loading clients: %w", err)
+		}
+		k, err := wgtypes.NewKey([]byte(pubKey))
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("client %d: invalid public key: %v", clientID, err))
+			continue
+		}
+		if ip := net.ParseIP(ipAddr); ip == nil || ip.To4() == nil {
+			skipped = append(skipped, fmt.Sprintf("client %d: invalid IP address %q", clientID, ipAddr))
+			continue
+		}
+		peer := wireguard.Peer{
+			IP: ipAddr,
+		}
+		if len(presharedKey) > 0 {
+			psk, err := secrets.Open(presharedKey)
+			if err == nil {
+				peer.PresharedKey, err = wgtypes.NewKey(psk)
 			}
-			peers := make(map[wgtypes.Key]string)
-			accounts := make(map[string]bwfilter.ClientAccount)
-			for rows.Next() {
-				var pubKey string
-				var ipAddr string
-				var accountID int
-				var clientID int
-				var bandwidthInLimit int64
-				var bandwidthOutLimit int64
-				rows.Scan(&pubKey, &ipAddr, &accountID, &clientID, &bandwidthInLimit, &bandwidthOutLimit)
-				k, err := wgtypes.NewKey([]byte(pubKey))
-				if err != nil {
-					panic(err)
-				}
-				peers[k] = ipAddr
-
-				accounts[ipAddr] = bwfilter.ClientAccount{
-					AccountID:    uint32(accountID),
-					BandwidthIn:  uint64(bandwidthInLimit),
-					BandwidthOut: uint64(bandwidthOutLimit),
-				}
+			if err != nil {
+				skipped = append(skipped, fmt.Sprintf("client %d: invalid preshared key: %v", clientID, err))
+				continue
 			}
-			rows.Close()
-			wg.PeerSync(peers)
+		}
+		if keepalive == 0 {
+			keepalive = ifaceKeepalive
+		}
+		peer.PersistentKeepalive = time.Duration(keepalive) * time.Second
+		peers[k] = peer
+
+		accounts[ipAddr] = bwfilter.ClientAccount{
+			AccountID:    uint32(accountID),
+			BandwidthIn:  uint64(bandwidthInLimit),
+			BandwidthOut: uint64(bandwidthOutLimit),
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("loading clients: %w", err)
+	}
+
+	for _, m := range skipped {
+		log.Printf("sync %d: skipping %s", s.ifaceID, m)
+	}
+	s.setSkipped(skipped)
+	return peers, accounts, nil
+}
+
+// Syncers keeps one Syncer for every configured interface.
+type Syncers struct {
+	// detached Syncers start no Syncer, for processes that only change
+	// the database and leave applying the changes to a running server
+	detached bool
+
+	mu sync.Mutex
+	m  map[int]*Syncer
+}
 
-			if err := handle.UpdateClientAccount(accounts); err != nil {
-				log.Fatalf("updating client account: %v", err)
+// NewSyncers starts a Syncer for every interface in the database, and
+// periodically for interfaces created or deleted by other processes.
+func NewSyncers() *Syncers {
+	ss := &Syncers{
+		m: make(map[int]*Syncer),
+	}
+	if err := ss.reconcile(); err != nil {
+		log.Println("fail to load interfaces", err)
+	}
+	go func() {
+		t := time.NewTicker(*flagReconcileInterval)
+		defer t.Stop()
+		for range t.C {
+			if err := ss.reconcile(); err != nil {
+				log.Println("fail to reconcile interfaces", err)
 			}
+		}
+	}()
+	return ss
+}
 
-		case <-s.updateAccounts:
-			s.UpdateClients()
+// reconcile starts a Syncer for every interface in the database without
+// one and stops the Syncers of interfaces no longer in the database.
+func (ss *Syncers) reconcile() error {
+	var ids []int
+	if ret := models.DB.Model(&models.Interface{}).Pluck("id", &ids); ret.Error != nil {
+		return ret.Error
+	}
+	want := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+		if ss.get(id) == nil {
+			log.Printf("reconcile: starting interface %d", id)
+			ss.UpdateInterface(id)
 		}
 	}
+	for _, s := range ss.all() {
+		if !want[s.ifaceID] {
+			log.Printf("reconcile: deleting interface %d", s.ifaceID)
+			ss.DeleteInterface(s.ifaceID)
+		}
+	}
+	return nil
+}
+
+func (ss *Syncers) get(ifaceID int) *Syncer {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.m[ifaceID]
+}
+
+// UpdateInterface (re)creates the interface, starting a Syncer for it if
+// there is none yet.
+func (ss *Syncers) UpdateInterface(ifaceID int) {
+	if ss.detached {
+		return
+	}
+	ss.mu.Lock()
+	s, ok := ss.m[ifaceID]
+	if !ok {
+		s = NewSyncer(ifaceID)
+		ss.m[ifaceID] = s
+	}
+	ss.mu.Unlock()
+	s.UpdateInterface()
+}
+
+func (ss *Syncers) UpdateClients(ifaceID int) {
+	if s := ss.get(ifaceID); s != nil {
+		s.UpdateClients()
+	}
+}
+
+func (ss *Syncers) UpdateAccounts(ifaceID int) {
+	if s := ss.get(ifaceID); s != nil {
+		s.UpdateAccounts()
+	}
+}
+
+// DeleteInterface tears down the interface and stops its Syncer.
+func (ss *Syncers) DeleteInterface(ifaceID int) {
+	ss.mu.Lock()
+	s, ok := ss.m[ifaceID]
+	delete(ss.m, ifaceID)
+	ss.mu.Unlock()
+	if ok {
+		s.DeleteInterface()
+	}
+}
+
+func (ss *Syncers) Status(ifaceID int) SyncStatus {
+	if s := ss.get(ifaceID); s != nil {
+		return s.Status()
+	}
+	return SyncStatus{}
+}
+
+// Peers returns the status of the peers on the interface, empty if it is
+// not up.
+func (ss *Syncers) Peers(ifaceID int) map[wgtypes.Key]PeerStatus {
+	if s := ss.get(ifaceID); s != nil {
+		return s.Peers()
+	}
+	return nil
+}
+
+func (ss *Syncers) all() []*Syncer {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ret := make([]*Syncer, 0, len(ss.m))
+	for _, s := range ss.m {
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// Errors returns the failing steps of all interfaces.
+func (ss *Syncers) Errors() []StepStatus {
+	var ret []StepStatus
+	for _, s := range ss.all() {
+		ret = append(ret, s.Status().Errors()...)
+	}
+	sortSteps(ret)
+	return ret
+}
+
+// Skipped returns the clients skipped during the last sync of all interfaces.
+func (ss *Syncers) Skipped() []string {
+	var ret []string
+	for _, s := range ss.all() {
+		ret = append(ret, s.Status().Skipped...)
+	}
+	sort.Strings(ret)
+	return ret
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/brian14708/wg-gatekeeper/bwfilter"
+	"github.com/brian14708/wg-gatekeeper/models"
+	"github.com/brian14708/wg-gatekeeper/wireguard"
+)
+
+func TestSameInterface(t *testing.T) {
+	applied := models.Interface{ID: 1, Name: "wg0", PrivateKey: []byte{1, 2}, ListenPort: 51820,
+		Subnet: "10.0.0.1/24", NatIface: "eth0", ExternalIP: "192.0.2.1", DNS: "1.1.1.1"}
+	assert.True(t, sameInterface(applied, applied))
+
+	for name, change := range map[string]func(*models.Interface){
+		"name":        func(i *models.Interface) { i.Name = "wg1" },
+		"private key": func(i *models.Interface) { i.PrivateKey = []byte{1, 3} },
+		"listen port": func(i *models.Interface) { i.ListenPort = 51821 },
+		"subnet":      func(i *models.Interface) { i.Subnet = "10.0.0.1/16" },
+		"nat iface":   func(i *models.Interface) { i.NatIface = "" },
+	} {
+		iface := applied
+		iface.PrivateKey = append([]byte(nil), applied.PrivateKey...)
+		change(&iface)
+		assert.False(t, sameInterface(iface, applied), name)
+	}
+
+	// only used in the client configurations
+	iface := applied
+	iface.ExternalIP = "192.0.2.2"
+	iface.DNS = ""
+	iface.PersistentKeepalive = 25
+	assert.True(t, sameInterface(iface, applied))
+}
+
+func TestStepBackoff(t *testing.T) {
+	var backoffs []time.Duration
+	for failures := 1; failures <= 10; failures++ {
+		backoffs = append(backoffs, retryBackoff(failures))
+	}
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second,
+		32 * time.Second, 64 * time.Second, 128 * time.Second, 256 * time.Second, 5 * time.Minute,
+	}, backoffs)
+	// no overflow of the shift
+	assert.Equal(t, 5*time.Minute, retryBackoff(64))
+
+	s := &Syncer{ifaceID: 1, status: SyncStatus{Interface: "wg0"}}
+	fail := func() error { return errors.New("failed") }
+	s.step("clients", fail, nil)
+	s.step("clients", fail, nil)
+	st := s.Status().Steps["clients"]
+	assert.Equal(t, 2, st.Failures)
+	assert.Equal(t, "failed", st.Err)
+	assert.Equal(t, "wg0", st.Interface)
+
+	s.step("clients", func() error { return nil }, nil)
+	st = s.Status().Steps["clients"]
+	assert.Equal(t, 0, st.Failures)
+	assert.Empty(t, st.Err)
+}
+
+func TestLoadClients(t *testing.T) {
+	iface := testDB(t)
+	iface.PersistentKeepalive = 25
+	assert.NoError(t, models.DB.Save(&iface).Error)
+	other := models.Interface{Name: "wg1", ListenPort: 51821, Subnet: "10.1.0.1/24", ExternalIP: "192.0.2.1"}
+	assert.NoError(t, models.DB.Create(&other).Error)
+	bob := models.Account{Name: "bob", InterfaceID: iface.ID, BandwidthInLimit: 100, BandwidthOutLimit: 200}
+	deleted := models.Account{Name: "alice", InterfaceID: iface.ID}
+	carol := models.Account{Name: "carol", InterfaceID: other.ID}
+	for _, acc := range []*models.Account{&bob, &deleted, &carol} {
+		assert.NoError(t, models.DB.Create(acc).Error)
+	}
+
+	newClient := func(acc models.Account, ip string, keepalive int) (models.Client, wgtypes.Key) {
+		key, err := wgtypes.GenerateKey()
+		assert.NoError(t, err)
+		cli := models.Client{AccountID: acc.ID, Name: ip, IPAddress: ip, PublicKey: key[:], PersistentKeepalive: keepalive}
+		assert.NoError(t, models.DB.Create(&cli).Error)
+		return cli, key
+	}
+	_, laptop := newClient(bob, "10.0.0.2", 0)
+	phone, phoneKey := newClient(bob, "10.0.0.3", 10)
+	psk, err := wgtypes.GenerateKey()
+	assert.NoError(t, err)
+	phone.PresharedKey, err = secrets.Seal(psk[:])
+	assert.NoError(t, err)
+	assert.NoError(t, models.DB.Save(&phone).Error)
+
+	badKey, _ := newClient(bob, "10.0.0.4", 0)
+	assert.NoError(t, models.DB.Model(&badKey).Update("public_key", []byte{1, 2, 3}).Error)
+	badIP, _ := newClient(bob, "10.0.0.5", 0)
+	assert.NoError(t, models.DB.Model(&badIP).Update("ip_address", "fd00::5").Error)
+	badPSK, _ := newClient(bob, "10.0.0.6", 0)
+	assert.NoError(t, models.DB.Model(&badPSK).Update("preshared_key", []byte("invalid")).Error)
+	revoked, _ := newClient(bob, "10.0.0.7", 0)
+	assert.NoError(t, models.DB.Delete(&revoked).Error)
+	newClient(deleted, "10.0.0.8", 0)
+	assert.NoError(t, models.DB.Delete(&deleted).Error)
+	newClient(carol, "10.1.0.2", 0)
+
+	s := &Syncer{ifaceID: iface.ID}
+	peers, accounts, err := s.loadClients()
+	assert.NoError(t, err)
+	assert.Equal(t, map[wgtypes.Key]wireguard.Peer{
+		laptop:   {IP: "10.0.0.2", PersistentKeepalive: 25 * time.Second},
+		phoneKey: {IP: "10.0.0.3", PresharedKey: psk, PersistentKeepalive: 10 * time.Second},
+	}, peers)
+	ca := bwfilter.ClientAccount{AccountID: uint32(bob.ID), BandwidthIn: 100, BandwidthOut: 200}
+	assert.Equal(t, map[string]bwfilter.ClientAccount{"10.0.0.2": ca, "10.0.0.3": ca}, accounts)
+
+	skipped := s.Status().Skipped
+	if assert.Len(t, skipped, 3) {
+		assert.Contains(t, skipped[0], fmt.Sprintf("client %d: invalid public key", badKey.ID))
+		assert.Equal(t, fmt.Sprintf(`client %d: invalid IP address "fd00::5"`, badIP.ID), skipped[1])
+		assert.Contains(t, skipped[2], fmt.Sprintf("client %d: invalid preshared key", badPSK.ID))
+	}
+}
+
+func TestPeerOnline(t *testing.T) {
+	now := time.Now()
+	peer := func(handshake time.Time) PeerStatus {
+		return PeerStatus{PeerStatus: wireguard.PeerStatus{LastHandshake: handshake}, SampledAt: now}
+	}
+	assert.False(t, peer(time.Time{}).Online(), "never connected")
+	assert.True(t, peer(now).Online())
+	assert.True(t, peer(now.Add(-PeerOnlineTimeout+time.Second)).Online())
+	assert.False(t, peer(now.Add(-PeerOnlineTimeout)).Online())
+	// relative to the sample, not the current time
+	assert.True(t, PeerStatus{PeerStatus: wireguard.PeerStatus{LastHandshake: now.Add(-time.Hour)}, SampledAt: now.Add(-time.Hour)}.Online())
+}
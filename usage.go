@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+// UsageTick is published by a Syncer every time it collects the metrics of
+// its interface.
+type UsageTick struct {
+	InterfaceID int
+	Time        time.Time
+	// Deltas maps account IDs to the bytes transferred since the previous
+	// tick, accounts without traffic are omitted.
+	Deltas map[int]UsageDelta
+	// Clients maps client IDs to the bytes transferred by the client since
+	// the previous tick.
+	Clients map[int]ClientUsageDelta
+}
+
+type UsageDelta struct {
+	BytesIn  int64
+	BytesOut int64
+}
+
+type ClientUsageDelta struct {
+	AccountID int
+	UsageDelta
+}
+
+var usageHub = NewHub[UsageTick]()
+
+// usageResolutions are the bucket lengths usage is stored at and how long
+// the buckets are kept. Every delta is added to the bucket of each
+// resolution on its own, so the coarser buckets outlive the finer ones.
+var usageResolutions = []struct {
+	Length    time.Duration
+	Retention time.Duration
+}{
+	{5 * time.Minute, 2 * 24 * time.Hour},
+	{time.Hour, 8 * 24 * time.Hour},
+	{24 * time.Hour, 400 * 24 * time.Hour},
+}
+
+// recordUsage adds the deltas of a tick to the usage buckets.
+func recordUsage(t UsageTick) error {
+	var rows []models.Usage
+	add := func(accountID, clientID int, d UsageDelta) {
+		for _, r := range usageResolutions {
+			rows = append(rows, models.Usage{
+				AccountID:  accountID,
+				ClientID:   clientID,
+				Resolution: int(r.Length / time.Second),
+				Time:       t.Time.UTC().Truncate(r.Length),
+				BytesIn:    d.BytesIn,
+				BytesOut:   d.BytesOut,
+			})
+		}
+	}
+	for accountID, d := range t.Deltas {
+		add(accountID, 0, d)
+	}
+	for clientID, d := range t.Clients {
+		add(d.AccountID, clientID, d.UsageDelta)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return models.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "account_id"}, {Name: "client_id"}, {Name: "resolution"}, {Name: "time"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"bytes_in":  gorm.Expr("bytes_in + excluded.bytes_in"),
+			"bytes_out": gorm.Expr("bytes_out + excluded.bytes_out"),
+		}),
+	}).Create(&rows).Error
+}
+
+// pruneUsage deletes the buckets past their retention every hour.
+func pruneUsage() {
+	for {
+		deleteExpiredUsage(time.Now())
+		time.Sleep(time.Hour)
+	}
+}
+
+// deleteExpiredUsage deletes the buckets that are past their retention at
+// now.
+func deleteExpiredUsage(now time.Time) {
+	for _, r := range usageResolutions {
+		ret := models.DB.Where("resolution = ? AND time < ?", int(r.Length/time.Second), now.UTC().Add(-r.Retention)).
+			Delete(&models.Usage{})
+		if ret.Error != nil {
+			log.Printf("pruning usage: %v", ret.Error)
+		}
+	}
+}
+
+// usageRanges are the time ranges of the usage graphs and the bucket length
+// they are shown at.
+type usageRange struct {
+	Name       string
+	Span       time.Duration
+	Resolution time.Duration
+}
+
+var usageRanges = []usageRange{
+	{"day", 24 * time.Hour, 5 * time.Minute},
+	{"week", 7 * 24 * time.Hour, time.Hour},
+	{"month", 30 * 24 * time.Hour, 24 * time.Hour},
+}
+
+type usagePoint struct {
+	Time     time.Time
+	BytesIn  int64
+	BytesOut int64
+}
+
+// usageSeries returns the usage of an account, or of one of its clients if
+// clientID is not 0, with a point for every bucket in the named range.
+func usageSeries(accountID, clientID int, rng string) ([]usagePoint, error) {
+	var r usageRange
+	for _, ur := range usageRanges {
+		if ur.Name == rng {
+			r = ur
+		}
+	}
+	if r.Name == "" {
+		return nil, fmt.Errorf("Unknown range %q", rng)
+	}
+
+	end := time.Now().UTC().Truncate(r.Resolution)
+	start := end.Add(-r.Span + r.Resolution)
+	var rows []models.Usage
+	ret := models.DB.Where("account_id = ? AND client_id = ? AND resolution = ? AND time >= ?",
+		accountID, clientID, int(r.Resolution/time.Second), start).Find(&rows)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+	byTime := make(map[time.Time]models.Usage, len(rows))
+	for _, u := range rows {
+		byTime[u.Time.UTC()] = u
+	}
+
+	var points []usagePoint
+	for t := start; !t.After(end); t = t.Add(r.Resolution) {
+		u := byTime[t]
+		points = append(points, usagePoint{Time: t, BytesIn: u.BytesIn, BytesOut: u.BytesOut})
+	}
+	return points, nil
+}
+
+const (
+	usageChartWidth  = 720
+	usageChartHeight = 160
+)
+
+// usageChart is a bar chart of a usage series, downloads are drawn above and
+// uploads below the middle line.
+type usageChart struct {
+	Range  string
+	Ranges []string
+	Width  int
+	Height int
+	Bars   []usageBar
+
+	Start, End        time.Time
+	Max               int64
+	TotalIn, TotalOut int64
+}
+
+type usageBar struct {
+	usagePoint
+	X, Width  float64
+	InY       float64
+	InHeight  float64
+	OutY      float64
+	OutHeight float64
+}
+
+func newUsageChart(accountID, clientID int, rng string) (*usageChart, error) {
+	points, err := usageSeries(accountID, clientID, rng)
+	if err != nil {
+		return nil, err
+	}
+	c := &usageChart{
+		Range:  rng,
+		Width:  usageChartWidth,
+		Height: usageChartHeight,
+		Start:  points[0].Time,
+		End:    points[len(points)-1].Time,
+	}
+	for _, r := range usageRanges {
+		c.Ranges = append(c.Ranges, r.Name)
+	}
+	for _, p := range points {
+		c.TotalIn += p.BytesIn
+		c.TotalOut += p.BytesOut
+		if p.BytesIn > c.Max {
+			c.Max = p.BytesIn
+		}
+		if p.BytesOut > c.Max {
+			c.Max = p.BytesOut
+		}
+	}
+
+	w := float64(usageChartWidth) / float64(len(points))
+	half := float64(usageChartHeight) / 2
+	for i, p := range points {
+		b := usageBar{usagePoint: p, X: float64(i) * w, Width: w * 0.8, InY: half, OutY: half}
+		if c.Max > 0 {
+			b.InHeight = float64(p.BytesIn) / float64(c.Max) * half
+			b.OutHeight = float64(p.BytesOut) / float64(c.Max) * half
+			b.InY = half - b.InHeight
+		}
+		c.Bars = append(c.Bars, b)
+	}
+	return c, nil
+}
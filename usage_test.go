@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/brian14708/wg-gatekeeper/models"
+)
+
+func TestUsageSeries(t *testing.T) {
+	testDB(t)
+	// a boundary of the hourly and the 5 minute buckets
+	boundary := time.Now().UTC().Truncate(time.Hour)
+	for _, tick := range []UsageTick{
+		{Time: boundary.Add(-time.Second), Deltas: map[int]UsageDelta{1: {BytesIn: 100, BytesOut: 10}},
+			Clients: map[int]ClientUsageDelta{5: {1, UsageDelta{BytesIn: 100, BytesOut: 10}}}},
+		{Time: boundary, Deltas: map[int]UsageDelta{1: {BytesIn: 200, BytesOut: 20}, 2: {BytesIn: 1}}},
+		{Time: boundary.Add(time.Second), Deltas: map[int]UsageDelta{1: {BytesIn: 300, BytesOut: 30}}},
+	} {
+		assert.NoError(t, recordUsage(tick))
+	}
+
+	// nonzero points of the series by their offset from the boundary
+	nonzero := func(accountID, clientID int, rng string) map[time.Duration]usagePoint {
+		points, err := usageSeries(accountID, clientID, rng)
+		assert.NoError(t, err)
+		m := map[time.Duration]usagePoint{}
+		for _, p := range points {
+			if p.BytesIn != 0 || p.BytesOut != 0 {
+				m[p.Time.Sub(boundary)] = p
+			}
+		}
+		return m
+	}
+	day := nonzero(1, 0, "day")
+	assert.Equal(t, map[time.Duration]usagePoint{
+		-5 * time.Minute: {boundary.Add(-5 * time.Minute), 100, 10},
+		0:                {boundary, 500, 50},
+	}, day)
+	week := nonzero(1, 0, "week")
+	assert.Equal(t, map[time.Duration]usagePoint{
+		-time.Hour: {boundary.Add(-time.Hour), 100, 10},
+		0:          {boundary, 500, 50},
+	}, week)
+	assert.Equal(t, map[time.Duration]usagePoint{
+		-time.Hour: {boundary.Add(-time.Hour), 100, 10},
+	}, nonzero(1, 5, "week"))
+	assert.Len(t, nonzero(2, 0, "day"), 1)
+
+	_, err := usageSeries(1, 0, "year")
+	assert.EqualError(t, err, `Unknown range "year"`)
+
+	c, err := newUsageChart(1, 0, "day")
+	assert.NoError(t, err)
+	assert.Len(t, c.Bars, 24*12)
+	assert.Equal(t, int64(600), c.TotalIn)
+	assert.Equal(t, int64(60), c.TotalOut)
+	assert.Equal(t, int64(500), c.Max)
+	assert.Equal(t, []string{"day", "week", "month"}, c.Ranges)
+	last := c.Bars[len(c.Bars)-1]
+	assert.Equal(t, float64(usageChartHeight)/2, last.InHeight+last.InY)
+}
+
+func TestDeleteExpiredUsage(t *testing.T) {
+	testDB(t)
+	now := time.Now()
+	assert.NoError(t, recordUsage(UsageTick{Time: now.Add(-3 * 24 * time.Hour), Deltas: map[int]UsageDelta{1: {BytesIn: 1}}}))
+	assert.NoError(t, recordUsage(UsageTick{Time: now, Deltas: map[int]UsageDelta{1: {BytesIn: 1}}}))
+
+	deleteExpiredUsage(now)
+	var resolutions []int
+	assert.NoError(t, models.DB.Model(&models.Usage{}).Order("resolution").Order("time").Pluck("resolution", &resolutions).Error)
+	// only the 5 minute bucket of three days ago is past its retention
+	assert.Equal(t, []int{300, 3600, 3600, 86400, 86400}, resolutions)
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/lorenzosaino/go-sysctl"
@@ -19,9 +20,17 @@ type Interface struct {
 	client *wgctrl.Client
 	link   netlink.Link
 
-	prevPeer map[wgtypes.Key]string
+	addr       string
+	natIface   string
+	tcpForward int
+
+	prevPeer map[wgtypes.Key]Peer
 }
 
+// ErrLinkNotFound is returned by Reconcile when the link has been removed
+// from the system and the interface has to be recreated.
+var ErrLinkNotFound = errors.New("wireguard link not found")
+
 func New(name string, privateKey []byte, listenPort int) (_ *Interface, outErr error) {
 	i := &Interface{
 		name: name,
@@ -49,14 +58,7 @@ func New(name string, privateKey []byte, listenPort int) (_ *Interface, outErr e
 	}
 
 	// setup qdisc
-	fq := &netlink.Fq{
-		QdiscAttrs: netlink.QdiscAttrs{
-			LinkIndex: i.link.Attrs().Index,
-			Parent:    netlink.HANDLE_ROOT,
-		},
-		Pacing: 1,
-	}
-	if err := netlink.QdiscReplace(fq); err != nil {
+	if err := i.qdiscReplace(); err != nil {
 		return nil, err
 	}
 
@@ -89,6 +91,17 @@ func New(name string, privateKey []byte, listenPort int) (_ *Interface, outErr e
 	return i, nil
 }
 
+func (i *Interface) qdiscReplace() error {
+	fq := &netlink.Fq{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: i.link.Attrs().Index,
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Pacing: 1,
+	}
+	return netlink.QdiscReplace(fq)
+}
+
 func (i *Interface) AddrAdd(a string) error {
 	ip, ipnet, err := net.ParseCIDR(a)
 	if err != nil {
@@ -110,6 +123,7 @@ func (i *Interface) AddrAdd(a string) error {
 		},
 	})
 	if err == nil || errors.Is(err, os.ErrExist) {
+		i.addr = a
 		return nil
 	}
 	return err
@@ -123,60 +137,247 @@ func (i *Interface) LinkIndex() int {
 	return i.link.Attrs().Index
 }
 
-func (i *Interface) PeerSync(peers map[wgtypes.Key]string) error {
+// Peer is the desired configuration of a single peer.
+type Peer struct {
+	IP                  string
+	PresharedKey        wgtypes.Key
+	PersistentKeepalive time.Duration
+}
+
+func (i *Interface) PeerSync(peers map[wgtypes.Key]Peer) error {
 	if i.prevPeer == nil {
-		dev, err := i.client.Device(i.name)
+		curr, err := i.devicePeers()
 		if err != nil {
 			return err
 		}
-		i.prevPeer = make(map[wgtypes.Key]string)
-		for _, p := range dev.Peers {
-			i.prevPeer[p.PublicKey] = p.AllowedIPs[0].IP.String()
+		i.prevPeer = curr
+	}
+
+	_, err := i.peerApply(i.prevPeer, peers)
+	return err
+}
+
+// devicePeers reads back the peers configured on the device. Peers that do
+// not have exactly one allowed IP are reported with an empty address so that
+// they are reconfigured.
+func (i *Interface) devicePeers() (map[wgtypes.Key]Peer, error) {
+	dev, err := i.client.Device(i.name)
+	if err != nil {
+		return nil, err
+	}
+	peers := make(map[wgtypes.Key]Peer)
+	for _, p := range dev.Peers {
+		peer := Peer{
+			PresharedKey:        p.PresharedKey,
+			PersistentKeepalive: p.PersistentKeepaliveInterval,
+		}
+		if len(p.AllowedIPs) == 1 {
+			if ones, bits := p.AllowedIPs[0].Mask.Size(); ones == bits {
+				peer.IP = p.AllowedIPs[0].IP.String()
+			}
 		}
+		peers[p.PublicKey] = peer
 	}
+	return peers, nil
+}
 
-	toDelete := make(map[wgtypes.Key]struct{})
-	toAdd := make(map[wgtypes.Key]net.IP)
-	for k, p := range i.prevPeer {
-		if ip, ok := peers[k]; !ok {
-			toDelete[k] = struct{}{}
-		} else {
-			if p != ip {
-				toAdd[k] = net.ParseIP(ip)
+func (i *Interface) peerApply(curr, peers map[wgtypes.Key]Peer) ([]string, error) {
+	var changes []string
+	wgcfg := wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{},
+	}
+	for k, p := range curr {
+		if want, ok := peers[k]; !ok {
+			wgcfg.Peers = append(wgcfg.Peers, wgtypes.PeerConfig{
+				PublicKey: k,
+				Remove:    true,
+			})
+			changes = append(changes, fmt.Sprintf("removed peer %s", k))
+		} else if p != want {
+			wgcfg.Peers = append(wgcfg.Peers, peerConfig(k, want))
+			if p.IP != want.IP {
+				changes = append(changes, fmt.Sprintf("set allowed IP of peer %s to %s", k, want.IP))
+			}
+			if p.PresharedKey != want.PresharedKey {
+				changes = append(changes, fmt.Sprintf("set preshared key of peer %s", k))
+			}
+			if p.PersistentKeepalive != want.PersistentKeepalive {
+				changes = append(changes, fmt.Sprintf("set persistent keepalive of peer %s to %s", k, want.PersistentKeepalive))
 			}
 		}
 	}
-	for k := range peers {
-		_, found := i.prevPeer[k]
-		if !found {
-			toAdd[k] = net.ParseIP(peers[k])
+	for k, want := range peers {
+		if _, found := curr[k]; !found {
+			wgcfg.Peers = append(wgcfg.Peers, peerConfig(k, want))
+			changes = append(changes, fmt.Sprintf("added peer %s with allowed IP %s", k, want.IP))
 		}
 	}
 
-	wgcfg := wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{},
+	i.prevPeer = make(map[wgtypes.Key]Peer, len(peers))
+	for k, p := range peers {
+		i.prevPeer[k] = p
+	}
+	if len(wgcfg.Peers) == 0 {
+		return nil, nil
+	}
+	if err := i.client.ConfigureDevice(i.name, wgcfg); err != nil {
+		// force a full read back on the next sync
+		i.prevPeer = nil
+		return nil, err
 	}
-	for k := range toDelete {
-		wgcfg.Peers = append(wgcfg.Peers, wgtypes.PeerConfig{
-			PublicKey: k,
-			Remove:    true,
-		})
-	}
-	for k, ip := range toAdd {
-		mask := net.CIDRMask(32, 32)
-		wgcfg.Peers = append(wgcfg.Peers, wgtypes.PeerConfig{
-			PublicKey: k,
-			AllowedIPs: []net.IPNet{
-				{
-					IP:   ip,
-					Mask: mask,
-				},
+	return changes, nil
+}
+
+func peerConfig(k wgtypes.Key, p Peer) wgtypes.PeerConfig {
+	psk := p.PresharedKey
+	keepalive := p.PersistentKeepalive
+	return wgtypes.PeerConfig{
+		PublicKey:                   k,
+		PresharedKey:                &psk,
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs: []net.IPNet{
+			{
+				IP:   net.ParseIP(p.IP),
+				Mask: net.CIDRMask(32, 32),
 			},
-		})
+		},
+	}
+}
+
+// Reconcile reads back the actual state of the link, its address, qdisc,
+// NAT rules and peers, and converges it to the configuration last applied
+// through AddrAdd, NatAdd and the given peers. It returns a description of
+// every correction that was made.
+func (i *Interface) Reconcile(peers map[wgtypes.Key]Peer) ([]string, error) {
+	link, err := netlink.LinkByName(i.name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, ErrLinkNotFound
+		}
+		return nil, err
+	}
+	if link.Attrs().Index != i.link.Attrs().Index {
+		return nil, ErrLinkNotFound
+	}
+	i.link = link
+
+	var changes []string
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err := i.LinkUp(); err != nil {
+			return changes, err
+		}
+		changes = append(changes, "set link up")
 	}
 
-	i.prevPeer = peers
-	return i.client.ConfigureDevice(i.name, wgcfg)
+	if ok, err := i.qdiscOk(); err != nil {
+		return changes, err
+	} else if !ok {
+		if err := i.qdiscReplace(); err != nil {
+			return changes, err
+		}
+		changes = append(changes, "restored fq qdisc")
+	}
+
+	if i.addr != "" {
+		if ok, err := i.addrOk(); err != nil {
+			return changes, err
+		} else if !ok {
+			if err := i.addrRestore(); err != nil {
+				return changes, err
+			}
+			changes = append(changes, fmt.Sprintf("restored address %s", i.addr))
+		}
+	}
+
+	if i.natIface != "" {
+		if ok, err := i.natOk(); err != nil {
+			return changes, err
+		} else if !ok {
+			if err := i.NatAdd(i.natIface, i.tcpForward); err != nil {
+				return changes, err
+			}
+			changes = append(changes, fmt.Sprintf("restored NAT rules for %s", i.natIface))
+		}
+	}
+
+	curr, err := i.devicePeers()
+	if err != nil {
+		return changes, err
+	}
+	c, err := i.peerApply(curr, peers)
+	return append(changes, c...), err
+}
+
+func (i *Interface) qdiscOk() (bool, error) {
+	qdiscs, err := netlink.QdiscList(i.link)
+	if err != nil {
+		return false, err
+	}
+	for _, q := range qdiscs {
+		if _, ok := q.(*netlink.Fq); ok && q.Attrs().Parent == netlink.HANDLE_ROOT {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (i *Interface) addrOk() (bool, error) {
+	ip, ipnet, err := net.ParseCIDR(i.addr)
+	if err != nil {
+		return false, err
+	}
+	addrs, err := netlink.AddrList(i.link, netlink.FAMILY_V4)
+	if err != nil {
+		return false, err
+	}
+	// other addresses added by the administrator are left alone
+	for _, a := range addrs {
+		if a.IP.Equal(ip) && a.Mask.String() == ipnet.Mask.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// addrRestore adds back the configured address without removing the other
+// addresses of the link, unlike AddrAdd.
+func (i *Interface) addrRestore() error {
+	ip, ipnet, err := net.ParseCIDR(i.addr)
+	if err != nil {
+		return err
+	}
+	err = netlink.AddrAdd(i.link, &netlink.Addr{
+		IPNet: &net.IPNet{
+			IP:   ip,
+			Mask: ipnet.Mask,
+		},
+	})
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+func (i *Interface) natOk() (bool, error) {
+	if val, err := sysctl.Get("net.ipv4.ip_forward"); err != nil {
+		return false, err
+	} else if val != "1" {
+		return false, nil
+	}
+
+	tbl, err := iptables.New()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range i.natRules(i.natIface, i.tcpForward) {
+		ok, err := tbl.Exists(r.table, r.chain, r.spec...)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
 func (i *Interface) Close() error {
@@ -220,8 +421,6 @@ func (i *Interface) NatAdd(iface string, tcpForward int) error {
 		}
 	}
 
-	comment := fmt.Sprintf("wg-gatekeeper-%d", i.LinkIndex())
-
 	tbl, err := iptables.New()
 	if err != nil {
 		return err
@@ -230,36 +429,42 @@ func (i *Interface) NatAdd(iface string, tcpForward int) error {
 	if err != nil {
 		return err
 	}
+	i.natIface = ""
 	if iface == "" {
 		return nil
 	}
 
-	mark := fmt.Sprintf("0x%x", 0x500+i.LinkIndex())
-	err = tbl.AppendUnique("filter", "FORWARD", "-i", i.name, "-j", "ACCEPT", "-m", "comment", "--comment", comment)
-	if err != nil {
-		return err
-	}
-	err = tbl.AppendUnique("filter", "FORWARD", "-o", i.name, "-i", iface, "-j", "ACCEPT", "-m", "comment", "--comment", comment)
-	if err != nil {
-		return err
-	}
-	err = tbl.AppendUnique("mangle", "PREROUTING", "-i", i.name, "-j", "MARK", "--set-mark", mark, "-m", "comment", "--comment", comment)
-	if err != nil {
-		return err
-	}
-	if tcpForward > 0 {
-		err = tbl.AppendUnique("nat", "PREROUTING", "-i", i.name, "-p", "tcp", "-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", tcpForward), "-m", "comment", "--comment", comment)
-		if err != nil {
+	for _, r := range i.natRules(iface, tcpForward) {
+		if err := tbl.AppendUnique(r.table, r.chain, r.spec...); err != nil {
 			return err
 		}
 	}
-	err = tbl.AppendUnique("nat", "POSTROUTING", "-o", iface, "-m", "mark", "--mark", mark, "-j", "MASQUERADE", "-m", "comment", "--comment", comment)
-	if err != nil {
-		return err
-	}
+	i.natIface = iface
+	i.tcpForward = tcpForward
 	return nil
 }
 
+type natRule struct {
+	table string
+	chain string
+	spec  []string
+}
+
+func (i *Interface) natRules(iface string, tcpForward int) []natRule {
+	comment := fmt.Sprintf("wg-gatekeeper-%d", i.LinkIndex())
+	mark := fmt.Sprintf("0x%x", 0x500+i.LinkIndex())
+	rules := []natRule{
+		{"filter", "FORWARD", []string{"-i", i.name, "-j", "ACCEPT", "-m", "comment", "--comment", comment}},
+		{"filter", "FORWARD", []string{"-o", i.name, "-i", iface, "-j", "ACCEPT", "-m", "comment", "--comment", comment}},
+		{"mangle", "PREROUTING", []string{"-i", i.name, "-j", "MARK", "--set-mark", mark, "-m", "comment", "--comment", comment}},
+	}
+	if tcpForward > 0 {
+		rules = append(rules, natRule{"nat", "PREROUTING", []string{"-i", i.name, "-p", "tcp", "-j", "REDIRECT", "--to-port", fmt.Sprintf("%d", tcpForward), "-m", "comment", "--comment", comment}})
+	}
+	rules = append(rules, natRule{"nat", "POSTROUTING", []string{"-o", iface, "-m", "mark", "--mark", mark, "-j", "MASQUERADE", "-m", "comment", "--comment", comment}})
+	return rules
+}
+
 func clearChain(ipt *iptables.IPTables, tbl, chain, comment string) error {
 	rules, err := ipt.List(tbl, chain)
 	if err != nil {
@@ -274,3 +479,37 @@ func clearChain(ipt *iptables.IPTables, tbl, chain, comment string) error {
 	}
 	return nil
 }
+
+// PeerStatus is the state of a peer as reported by the device. The transfer
+// counters are reset when the peer is removed from the device.
+type PeerStatus struct {
+	PublicKey wgtypes.Key
+	// Endpoint is the last address the peer connected from, empty if it
+	// never connected.
+	Endpoint      string
+	LastHandshake time.Time
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// PeerStatus returns the status of every peer of the device.
+func (i *Interface) PeerStatus() ([]PeerStatus, error) {
+	dev, err := i.client.Device(i.name)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]PeerStatus, 0, len(dev.Peers))
+	for _, p := range dev.Peers {
+		st := PeerStatus{
+			PublicKey:     p.PublicKey,
+			LastHandshake: p.LastHandshakeTime,
+			ReceiveBytes:  p.ReceiveBytes,
+			TransmitBytes: p.TransmitBytes,
+		}
+		if p.Endpoint != nil {
+			st.Endpoint = p.Endpoint.String()
+		}
+		ret = append(ret, st)
+	}
+	return ret, nil
+}